@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"os"
+)
+
+// The check subcommand validates an archive without melting it. It is useful
+// on its own to find out why an image does not load, or before handing an
+// archive to melt.
+
+var checkCmd = &command{
+	name:    "check",
+	summary: "Validate an archive without melting it.",
+	usage:   "check input",
+	flags:   flag.NewFlagSet("check", flag.ExitOnError),
+}
+
+func init() {
+	checkCmd.run = runCheck
+	commands = append(commands, checkCmd)
+}
+
+// printFindings prints findings and returns the number of errors among them.
+func printFindings(w io.Writer, findings []melt.Finding) int {
+	errors := 0
+	for _, f := range findings {
+		level := "WARNING"
+		if f.Error {
+			level = "ERROR"
+			errors++
+		}
+		where := ""
+		if f.Image != "" {
+			where += f.Image + ": "
+		}
+		if f.Layer != "" {
+			where += f.Layer + ": "
+		}
+		fmt.Fprintf(w, "%s %s%s\n", level, where, f.Message)
+	}
+	return errors
+}
+
+func runCheck(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], checkCmd.usage)
+	}
+
+	findings, err := melt.New().Check(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	errors := printFindings(os.Stdout, findings)
+	if errors > 0 {
+		fmt.Printf("FAIL: %d errors, %d warnings.\n", errors, len(findings)-errors)
+		os.Exit(1)
+	}
+	fmt.Printf("PASS: %d warnings.\n", len(findings))
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The completion subcommand prints shell completion scripts. They are
+// generated from the flag sets and the command table so they never get out of
+// sync with the actual command line interface.
+
+var completionCmd = &command{
+	name:    "completion",
+	summary: "Print a shell completion script.",
+	usage:   "completion bash|zsh|fish",
+	args:    []string{"bash", "zsh", "fish"},
+	flags:   flag.NewFlagSet("completion", flag.ExitOnError),
+}
+
+func init() {
+	completionCmd.run = runCompletion
+	commands = append(commands, completionCmd)
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && b.IsBoolFlag()
+}
+
+func flagNames(fs *flag.FlagSet) []string {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	return names
+}
+
+func commandNames() []string {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+// shellFunc turns the program name into a valid shell function name.
+func shellFunc(prog string) string {
+	return "_" + strings.NewReplacer("-", "_", ".", "_").Replace(prog)
+}
+
+func bashCompletion(prog string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s() {\n", shellFunc(prog))
+	fmt.Fprintf(&b, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(&b, "\tlocal words=\"\"\n")
+	fmt.Fprintf(&b, "\tcase \"${COMP_WORDS[1]}\" in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "\t%s)\n", cmd.name)
+		fmt.Fprintf(&b, "\t\twords=\"%s\"\n", strings.Join(append(flagNames(cmd.flags), cmd.args...), " "))
+		fmt.Fprintf(&b, "\t\t;;\n")
+	}
+	fmt.Fprintf(&b, "\t*)\n")
+	fmt.Fprintf(&b, "\t\twords=\"%s\"\n", strings.Join(flagNames(flag.CommandLine), " "))
+	fmt.Fprintf(&b, "\t\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(&b, "\t\t\twords=\"$words %s\"\n", strings.Join(commandNames(), " "))
+	fmt.Fprintf(&b, "\t\tfi\n")
+	fmt.Fprintf(&b, "\t\t;;\n")
+	fmt.Fprintf(&b, "\tesac\n")
+	fmt.Fprintf(&b, "\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	fmt.Fprintf(&b, "}\n")
+	fmt.Fprintf(&b, "complete -o default -F %s %s\n", shellFunc(prog), prog)
+	return b.String()
+}
+
+// zshQuote escapes a flag description for use in an _arguments spec.
+func zshQuote(s string) string {
+	return strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:").Replace(s)
+}
+
+func zshArguments(b *bytes.Buffer, fs *flag.FlagSet, args []string) {
+	fmt.Fprintf(b, "\t\t_arguments")
+	fs.VisitAll(func(f *flag.Flag) {
+		if isBoolFlag(f) {
+			fmt.Fprintf(b, " \\\n\t\t\t'-%s[%s]'", f.Name, zshQuote(f.Usage))
+		} else {
+			fmt.Fprintf(b, " \\\n\t\t\t'-%s[%s]:%s:_files'", f.Name, zshQuote(f.Usage), f.Name)
+		}
+	})
+	if len(args) > 0 {
+		fmt.Fprintf(b, " \\\n\t\t\t'1:argument:(%s)'", strings.Join(args, " "))
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+func zshCompletion(prog string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#compdef %s\n\n", prog)
+	fmt.Fprintf(&b, "%s() {\n", shellFunc(prog))
+	fmt.Fprintf(&b, "\tlocal -a commands\n")
+	fmt.Fprintf(&b, "\tcommands=(\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "\t\t'%s:%s'\n", cmd.name, zshQuote(cmd.summary))
+	}
+	fmt.Fprintf(&b, "\t)\n")
+	fmt.Fprintf(&b, "\tif (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then\n")
+	fmt.Fprintf(&b, "\t\t_describe 'command' commands\n")
+	fmt.Fprintf(&b, "\t\treturn\n")
+	fmt.Fprintf(&b, "\tfi\n")
+	fmt.Fprintf(&b, "\tcase $words[2] in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "\t%s)\n", cmd.name)
+		fmt.Fprintf(&b, "\t\tshift words\n")
+		fmt.Fprintf(&b, "\t\t(( CURRENT-- ))\n")
+		zshArguments(&b, cmd.flags, cmd.args)
+		fmt.Fprintf(&b, "\t\t;;\n")
+	}
+	fmt.Fprintf(&b, "\t*)\n")
+	zshArguments(&b, flag.CommandLine, nil)
+	fmt.Fprintf(&b, "\t\t;;\n")
+	fmt.Fprintf(&b, "\tesac\n")
+	fmt.Fprintf(&b, "}\n\n")
+	fmt.Fprintf(&b, "%s \"$@\"\n", shellFunc(prog))
+	return b.String()
+}
+
+// fishQuote escapes a string for use inside single quotes in fish.
+func fishQuote(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(s)
+}
+
+func fishFlags(b *bytes.Buffer, prog string, cond string, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(b, "complete -c %s -n '%s' -o %s -d '%s'", prog, cond, f.Name, fishQuote(f.Usage))
+		if !isBoolFlag(f) {
+			fmt.Fprintf(b, " -r")
+		}
+		fmt.Fprintf(b, "\n")
+	})
+}
+
+func fishCompletion(prog string) string {
+	var b bytes.Buffer
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "complete -c %s -f -n '__fish_use_subcommand' -a %s -d '%s'\n", prog, cmd.name, fishQuote(cmd.summary))
+	}
+	fishFlags(&b, prog, "__fish_use_subcommand", flag.CommandLine)
+	for _, cmd := range commands {
+		cond := "__fish_seen_subcommand_from " + cmd.name
+		fishFlags(&b, prog, cond, cmd.flags)
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(&b, "complete -c %s -f -n '%s' -a '%s'\n", prog, cond, strings.Join(cmd.args, " "))
+		}
+	}
+	return b.String()
+}
+
+func runCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], completionCmd.usage)
+	}
+
+	prog := filepath.Base(os.Args[0])
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion(prog))
+	case "zsh":
+		fmt.Print(zshCompletion(prog))
+	case "fish":
+		fmt.Print(fishCompletion(prog))
+	default:
+		return fmt.Errorf("Unsupported shell %q.", args[0])
+	}
+	return nil
+}
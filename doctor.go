@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// The doctor subcommand checks the host: the tools melts call, the kernel
+// features some options need, and extended attribute support and free space
+// of the temporary directory. It prints which features will not work and
+// fails if melting does not work at all.
+
+var doctorCmd = &command{
+	name:    "doctor",
+	summary: "Check which features work on this host.",
+	usage:   "doctor [-t tmpdir] [archive]",
+	flags:   flag.NewFlagSet("doctor", flag.ExitOnError),
+}
+
+var doctorTmpDir string
+
+func init() {
+	doctorCmd.flags.StringVar(&doctorTmpDir, "t", "", "Directory to hold temporary data, like -t of a melt.")
+	doctorCmd.run = runDoctor
+	commands = append(commands, doctorCmd)
+}
+
+func printDiagnoses(w io.Writer, ds []melt.Diagnosis) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, d := range ds {
+		status := "ok"
+		if !d.OK {
+			status = "missing"
+			if d.Affects == "" {
+				status = "failed"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Check, status, d.Detail)
+	}
+	tw.Flush()
+}
+
+func runDoctor(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], doctorCmd.usage)
+	}
+	// Melting an archive needs about diskFactor times its size.
+	var need uint64
+	if len(args) == 1 {
+		fi, err := os.Stat(args[0])
+		if err != nil {
+			return err
+		}
+		need = uint64(fi.Size()) * diskFactor
+	}
+
+	ds := melt.Diagnose(context.Background(), doctorTmpDir, need)
+	printDiagnoses(os.Stdout, ds)
+
+	var broken, unavailable []string
+	for _, d := range ds {
+		switch {
+		case d.OK:
+		case d.Affects == "":
+			broken = append(broken, d.Check)
+		default:
+			unavailable = append(unavailable, fmt.Sprintf("  %s (%s)", d.Affects, d.Check))
+		}
+	}
+	fmt.Println()
+	if len(unavailable) > 0 {
+		fmt.Printf("Not available on this host:\n%s\n", strings.Join(unavailable, "\n"))
+	}
+	if len(broken) > 0 {
+		return fmt.Errorf("Melting does not work on this host: %s failed.", strings.Join(broken, ", "))
+	}
+	fmt.Println("Melting works on this host.")
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"os"
+)
+
+// The duplicates subcommand reports file contents stored in more than one
+// layer. Melting those layers together, or choosing a different split
+// between shared and unique layers, would store them only once.
+
+var duplicatesCmd = &command{
+	name:    "duplicates",
+	summary: "Report files duplicated across layers.",
+	usage:   "duplicates archive",
+	flags:   flag.NewFlagSet("duplicates", flag.ExitOnError),
+}
+
+func init() {
+	duplicatesCmd.run = runDuplicates
+	commands = append(commands, duplicatesCmd)
+}
+
+func printDuplicates(w io.Writer, dups []melt.Duplicate) {
+	var wasted int64
+	for _, d := range dups {
+		fmt.Fprintf(w, "%s %d bytes, %d bytes wasted:\n", d.Digest, d.Size, d.Wasted)
+		for _, f := range d.Files {
+			fmt.Fprintf(w, "\t%s: %s\n", f.Layer, f.Path)
+		}
+		wasted += d.Wasted
+	}
+	fmt.Fprintf(w, "%d duplicated files, %d bytes wasted in total.\n", len(dups), wasted)
+}
+
+func runDuplicates(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], duplicatesCmd.usage)
+	}
+
+	dups, err := melt.Duplicates(args[0])
+	if err != nil {
+		return err
+	}
+	printDuplicates(os.Stdout, dups)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -events writes the progress of a melt as newline-delimited JSON for
+// automation that tracks it live. Every melt event becomes one line and a
+// final summary line reports the outcome.
+
+// jsonEvent is a single line of the event stream.
+type jsonEvent struct {
+	Time    string `json:"time"`
+	Type    string `json:"type"`
+	Phase   string `json:"phase,omitempty"`
+	Layer   string `json:"layer,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	DiffID  string `json:"diff_id,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Set for the summary only.
+	Status   string  `json:"status,omitempty"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+	Layers   int     `json:"layers,omitempty"`
+	Warnings int     `json:"warnings,omitempty"`
+}
+
+// eventStream writes melt events to w.
+type eventStream struct {
+	mu       sync.Mutex
+	w        io.WriteCloser
+	enc      *json.Encoder
+	start    time.Time
+	layers   int
+	bytes    int64
+	warnings int
+}
+
+// openEvents opens the target of -events. fd:N writes to the already open
+// file descriptor N, anything else is the path of a file that is created or
+// truncated.
+func openEvents(target string) (*eventStream, error) {
+	var w io.WriteCloser
+	if strings.HasPrefix(target, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("Invalid file descriptor %q.", target)
+		}
+		w = os.NewFile(uintptr(fd), target)
+	} else {
+		f, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &eventStream{w: w, enc: json.NewEncoder(w), start: time.Now()}, nil
+}
+
+func (s *eventStream) write(e jsonEvent) {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	// The melt must not fail because nobody is listening anymore.
+	s.enc.Encode(e)
+}
+
+// event records a melt event.
+func (s *eventStream) event(e melt.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch e.Type {
+	case melt.LayerHashed:
+		s.layers++
+		s.bytes += e.Bytes
+	case melt.Warning:
+		s.warnings++
+	}
+	s.write(jsonEvent{
+		Type:    e.Type.String(),
+		Phase:   string(e.Phase),
+		Layer:   e.Layer,
+		Bytes:   e.Bytes,
+		DiffID:  e.DiffID,
+		Message: e.Message,
+	})
+}
+
+// finish writes the summary for a melt that returned err and closes the
+// stream. Layers and Bytes are the number and total size of the layers that
+// were packed.
+func (s *eventStream) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := jsonEvent{
+		Type:     "summary",
+		Status:   "succeeded",
+		Duration: time.Since(s.start).Seconds(),
+		Layers:   s.layers,
+		Bytes:    s.bytes,
+		Warnings: s.warnings,
+	}
+	switch {
+	case err == melt.ErrSingleLayer || err == melt.ErrAllShared:
+		summary.Status = "unchanged"
+		summary.Message = err.Error()
+	case err != nil:
+		summary.Status = "failed"
+		summary.Message = err.Error()
+	}
+	s.write(summary)
+	s.w.Close()
+}
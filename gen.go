@@ -0,0 +1,387 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The gen subcommand builds small synthetic docker-archives. The generated
+// layers contain whiteouts, opaque directories, hardlinks, symlinks, xattrs and
+// files that are overwritten by later layers. Together with -shared-with, which
+// stacks the generated layers on top of the first image of another archive,
+// this allows to reproduce melt bugs without shipping proprietary images.
+
+var genCmd = &command{
+	name:    "gen",
+	summary: "Build a synthetic docker-archive for testing.",
+	usage:   "gen -o output.tar [-layers n] [-files n] [-shared-with input.tar] [-tag name:tag] [-seed n]",
+	flags:   flag.NewFlagSet("gen", flag.ExitOnError),
+}
+
+var genOut string
+var genLayers int
+var genFiles int
+var genSharedWith string
+var genTag string
+var genSeed int64
+
+// genTime is used for all timestamps in generated archives to keep them
+// reproducible.
+var genTime = time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func init() {
+	genCmd.flags.StringVar(&genOut, "o", "", "Name of output tarball.")
+	genCmd.flags.IntVar(&genLayers, "layers", 3, "Number of layers to generate.")
+	genCmd.flags.IntVar(&genFiles, "files", 4, "Number of regular files per generated layer.")
+	genCmd.flags.StringVar(&genSharedWith, "shared-with", "", "Tarball whose first image provides the lower layers of the generated image.")
+	genCmd.flags.StringVar(&genTag, "tag", "go-docker-melt-gen:latest", "Tag of the generated image.")
+	genCmd.flags.Int64Var(&genSeed, "seed", 1, "Seed for the contents of generated files.")
+	genCmd.run = runGen
+	commands = append(commands, genCmd)
+}
+
+func genWriteDir(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:     name + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  genTime,
+	})
+}
+
+func genWriteFile(tw *tar.Writer, name string, data []byte, xattrs map[string]string) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  genTime,
+	}
+	for k, v := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+k] = v
+	}
+	err := tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func genWriteLink(tw *tar.Writer, typeflag byte, name string, target string) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: typeflag,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  genTime,
+	})
+}
+
+// genLayer returns the n-th synthetic layer tarball.
+func genLayer(rng *rand.Rand, n int) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	dir := fmt.Sprintf("gen/layer%d", n)
+	for _, d := range []string{"gen", dir, "gen/opaque"} {
+		if err := genWriteDir(tw, d); err != nil {
+			return nil, err
+		}
+	}
+
+	if n > 0 {
+		// Hide everything lower layers put into gen/opaque.
+		if err := genWriteFile(tw, "gen/opaque/.wh..wh..opq", nil, nil); err != nil {
+			return nil, err
+		}
+		// Remove a file created by the previous layer.
+		if genFiles > 1 {
+			wh := fmt.Sprintf("gen/layer%d/.wh.file1", n-1)
+			if err := genWriteFile(tw, wh, nil, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := genWriteFile(tw, fmt.Sprintf("gen/opaque/layer%d", n), []byte(dir+"\n"), nil); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < genFiles; i++ {
+		data := make([]byte, rng.Intn(4096))
+		rng.Read(data)
+		var xattrs map[string]string
+		if i == 0 {
+			xattrs = map[string]string{"user.go-docker-melt": dir}
+		}
+		if err := genWriteFile(tw, fmt.Sprintf("%s/file%d", dir, i), data, xattrs); err != nil {
+			return nil, err
+		}
+	}
+	if genFiles > 0 {
+		if err := genWriteLink(tw, tar.TypeLink, dir+"/hardlink", dir+"/file0"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Overwritten by every layer.
+	if err := genWriteLink(tw, tar.TypeSymlink, "gen/current", path.Base(dir)); err != nil {
+		return nil, err
+	}
+	if err := genWriteFile(tw, "gen/state", []byte(dir+"\n"), nil); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// genArchive holds the global metadata of the archive passed to -shared-with.
+type genArchive struct {
+	manifest     melt.RawManifest
+	configs      map[string][]byte
+	repositories map[string]map[string]string
+}
+
+// genCopyArchive copies all members of the docker-archive in to tw except for
+// manifest.json and repositories which are returned for merging.
+func genCopyArchive(tw *tar.Writer, in string) (*genArchive, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &genArchive{configs: make(map[string][]byte)}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case hdr.Name == "manifest.json":
+			buf, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			err = a.manifest.Parse(buf)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case hdr.Name == "repositories":
+			buf, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			err = json.Unmarshal(buf, &a.repositories)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(hdr.Name, ".json") && !strings.Contains(hdr.Name, "/") {
+			buf, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			a.configs[hdr.Name] = buf
+			_, err = tw.Write(buf)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(a.manifest.Manifest) == 0 {
+		return nil, fmt.Errorf("%s does not contain any images.", in)
+	}
+	return a, nil
+}
+
+func runGen(args []string) error {
+	if genOut == "" || genLayers < 1 {
+		genCmd.flags.Usage()
+		return errors.New("An output tarball and at least one layer are required.")
+	}
+
+	f, err := os.Create(genOut)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+
+	var manifest []melt.Manifest
+	var layers []string
+	var history []melt.History
+	rootfs := melt.Rootfs{Type: "layers"}
+	repositories := make(map[string]map[string]string)
+	var parent string
+
+	if genSharedWith != "" {
+		base, err := genCopyArchive(tw, genSharedWith)
+		if err != nil {
+			return err
+		}
+		manifest = base.manifest.Manifest
+		if base.repositories != nil {
+			repositories = base.repositories
+		}
+
+		var config melt.ImageConfig
+		first := manifest[0]
+		err = config.Parse(base.configs[first.ConfigHash])
+		if err != nil {
+			return err
+		}
+		layers = append(layers, first.Layers()...)
+		history = append(history, config.History...)
+		rootfs.DiffIDs = append(rootfs.DiffIDs, config.RootFS.DiffIDs...)
+		if len(layers) > 0 {
+			parent = path.Dir(layers[len(layers)-1])
+		}
+	}
+
+	created := genTime
+	ts := created.Format(time.RFC3339)
+	rng := rand.New(rand.NewSource(genSeed))
+	for i := 0; i < genLayers; i++ {
+		data, err := genLayer(rng, i)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		diffID := "sha256:" + hex.EncodeToString(sum[:])
+		sum = sha256.Sum256([]byte(parent + " " + diffID))
+		id := hex.EncodeToString(sum[:])
+
+		layerJSON, err := json.Marshal(melt.LayerJSON{
+			Id:      id,
+			Parent:  parent,
+			Created: ts,
+			OS:      "linux",
+		})
+		if err != nil {
+			return err
+		}
+
+		err = genWriteDir(tw, id)
+		if err != nil {
+			return err
+		}
+		err = genWriteFile(tw, id+"/VERSION", []byte("1.0"), nil)
+		if err != nil {
+			return err
+		}
+		err = genWriteFile(tw, id+"/json", layerJSON, nil)
+		if err != nil {
+			return err
+		}
+		err = genWriteFile(tw, id+"/layer.tar", data, nil)
+		if err != nil {
+			return err
+		}
+
+		layers = append(layers, id+"/layer.tar")
+		rootfs.DiffIDs = append(rootfs.DiffIDs, digest.Digest(diffID))
+		history = append(history, melt.History{History: imagespec.History{
+			Created:   &created,
+			CreatedBy: fmt.Sprintf("go-docker-melt gen layer %d", i),
+		}})
+		parent = id
+	}
+
+	config, err := json.Marshal(melt.ImageConfig{
+		Image: imagespec.Image{
+			Created:  &created,
+			Platform: imagespec.Platform{Architecture: "amd64", OS: "linux"},
+			RootFS:   rootfs,
+		},
+		Config: &melt.GenericConfig{
+			Env: []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+			Cmd: []string{"/bin/sh"},
+		},
+		History: history,
+	})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(config)
+	configHash := hex.EncodeToString(sum[:]) + ".json"
+	err = genWriteFile(tw, configHash, config, nil)
+	if err != nil {
+		return err
+	}
+
+	rawLayers, err := json.Marshal(layers)
+	if err != nil {
+		return err
+	}
+	manifest = append(manifest, melt.Manifest{
+		ConfigHash: configHash,
+		RepoTags:   []string{genTag},
+		RawLayers:  (*json.RawMessage)(&rawLayers),
+	})
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = genWriteFile(tw, "manifest.json", buf, nil)
+	if err != nil {
+		return err
+	}
+
+	name, tag := melt.SplitTag(genTag)
+	if repositories[name] == nil {
+		repositories[name] = make(map[string]string)
+	}
+	repositories[name][tag] = parent
+	buf, err = json.Marshal(repositories)
+	if err != nil {
+		return err
+	}
+	err = genWriteFile(tw, "repositories", buf, nil)
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
@@ -1,668 +1,620 @@
 package main
 
 import (
-	"bytes"
-	"encoding/hex"
-	"encoding/json"
-	"errors"
+	"compress/gzip"
 	"flag"
 	"fmt"
-	"github.com/brauner/tarski"
-	"io"
-	"io/ioutil"
+	"github.com/brauner/go-docker-melt/melt"
 	"log"
+	"log/slog"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"regexp"
+	"path"
 	"runtime"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type genericConfig struct {
-	Hostname     string   `json:"Hostname,omitempty"`
-	Domainname   string   `json:"Domainname,omitempty"`
-	User         string   `json:"User,omitempty"`
-	AttachStdin  bool     `json:"AttachStdin,omitempty"`
-	AttachStdout bool     `json:"AttachStdout,omitempty"`
-	AttachStderr bool     `json:"AttachStderr,omitempty"`
-	Tty          bool     `json:"Tty,omitempty"`
-	OpenStdin    bool     `json:"OpenStdin,omitempty"`
-	StdinOnce    bool     `json:"StdinOnce,omitempty"`
-	Env          []string `json:"Env,omitempty"`
-	Cmd          []string `json:"Cmd,omitempty"`
-	Image        string   `json:"Image,omitempty"`
-	WorkingDir   string   `json:"WorkingDir,omitempty"`
-	Entrypoint   []string `json:"Entrypoint,omitempty"`
-	OnBuild      []string `json:"OnBuild,omitempty"`
-	rawJSON      []byte
-}
-
-// https://gist.github.com/aaronlehmann/b42a2eaf633fc949f93b
-type History struct {
-	Created    string `json:"created,omitempty"`
-	Author     string `json:"author,omitempty"`
-	CreatedBy  string `json:"created_by,omitempty"`
-	Comment    string `json:"comment,omitempty"`
-	EmptyLayer bool   `json:"empty_layer,omitempty"`
-}
-
-// https://gist.github.com/aaronlehmann/b42a2eaf633fc949f93b
-type Rootfs struct {
-	Type    string   `json:"type,omitempty"`
-	DiffIds []string `json:"diff_ids,omitempty"`
-}
-
-func (rfs *Rootfs) delRootfsElem(pos int) {
-	rfs.DiffIds = append(rfs.DiffIds[:pos], rfs.DiffIds[pos+1:]...)
+var image string
+var imageOut string
+var tmpDir string
+var workDir string
+var noAnnotate bool
+var created string
+var workers int
+var verbose bool
+var load bool
+var importContainerd bool
+var containerdNamespace string
+var outputFormat string
+var exportLayer string
+var reportDuplicates bool
+var plan string
+
+// planners maps the values of -plan to their planners.
+var planners = map[string]melt.Planner{
+	"default": melt.DefaultPlanner,
+	"shared":  melt.SharedPlanner,
 }
 
-type ImageConfig struct {
-	Arch            string           `json:"architecture,omitempty"`
-	Config          *genericConfig   `json:"config,omitempty"`
-	Container       string           `json:"container,omitempty"`
-	ContainerConfig *genericConfig   `json:"container_config,omitempty"`
-	Created         string           `json:"created,omitempty"`
-	DockerVersion   string           `json:"docker_version,omitempty"`
-	RawHistory      *json.RawMessage `json:"history,omitempty"`
-	history         *[]History
-	OS              string           `json:"os,omitempty"`
-	RawRootfs       *json.RawMessage `json:"rootfs,omitempty"`
-	rootfs          *Rootfs
-	rawJSON         []byte
+var base string
+var baseRootfs string
+var previous string
+var expectDigest string
+var verifySignature string
+var signatureKey string
+var signatureIdentity string
+var signatureIssuer string
+var signKey string
+var signCommand string
+var clampMtime string
+var preserveAtime bool
+var umask string
+var testCmd string
+var stripXattr string
+var selinux string
+var selinuxContext string
+var verifyCaps string
+var verifyPermissions string
+var verifyMetadata string
+var verifySymlinks string
+var breakHardlinks bool
+var dereference bool
+var dereferenceExclude string
+var caseCollisions string
+var sandbox bool
+var backend string
+var events string
+var retries int
+var retryDelay time.Duration
+var keepOriginal bool
+var meltedSuffix string
+var sizeReport bool
+var tags string
+var canonicalJSON bool
+var jsonStyle string
+var strict bool
+var repair bool
+var stripBinaries bool
+var removeMatching string
+var truncateLogs bool
+var prunePreset string
+var layerRanges string
+var layerRules string
+var minLayerSize int64
+var memoryBudget int64
+
+// annotationFlag collects the key=value pairs of repeated -annotation flags.
+type annotationFlag map[string]string
+
+func (a annotationFlag) String() string {
+	pairs := make([]string, 0, len(a))
+	for k, v := range a {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
 
-func (img *ImageConfig) UnmarshalJSON(file string) error {
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_EXCL, 0755)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		return err
-	}
-
-	size := fi.Size()
-	if !(size > 0) {
-		return nil
-	}
-
-	buf := make([]byte, size)
-	_, err = f.Read(buf)
-	if err != nil {
-		return err
-	}
-
-	err = json.Unmarshal(buf, &img)
-	if err != nil {
-		return err
-	}
-	img.rawJSON = buf
-
-	if (img.RawHistory == nil) || (img.RawRootfs == nil) {
-		return errors.New("Corrupt image configuration.")
+func (a annotationFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("Invalid annotation %q, expected key=value.", s)
 	}
-
-	err = json.Unmarshal(*img.RawHistory, &img.history)
-	if err != nil {
-		return err
-	}
-
-	err = json.Unmarshal(*img.RawRootfs, &img.rootfs)
-	if err != nil {
-		return err
-	}
-
-	if (img.history == nil) || (img.rootfs == nil) {
-		return errors.New("Corrupt image configuration.")
-	}
-
+	a[s[:i]] = s[i+1:]
 	return nil
 }
 
-func (img *ImageConfig) updateHistory() error {
-	repl, err := json.Marshal(*img.history)
-	if err != nil {
-		return err
-	}
-	img.rawJSON = bytes.Replace(img.rawJSON, *img.RawHistory, repl, 1)
-	return nil
+var annotations = make(annotationFlag)
+var compress string
+var verifyReproducible bool
+var compressionLevel int
+var plain bool
+var noColor bool
+
+func init() {
+	flag.StringVar(&image, "i", "", "Image to melt as [transport:]reference, by default a docker save tarball.")
+	flag.StringVar(&imageOut, "o", "", "Where to store the melted image as [transport:]reference.")
+	flag.StringVar(&tmpDir, "t", "", "Directory to hold temporary data.")
+	flag.StringVar(&workDir, "workdir", "", "Empty or missing directory to melt in instead of a temporary one below -t. It is kept for inspection.")
+	flag.BoolVar(&noAnnotate, "no-annotate", false, "Do not record a go-docker-melt note in the image history.")
+	flag.IntVar(&workers, "j", runtime.NumCPU(), "Number of layers to unpack and pack concurrently.")
+	flag.Int64Var(&memoryBudget, "memory-budget", 0, "Limit the combined size in bytes of the layers unpacked and packed concurrently. 0 only limits their number with -j.")
+	flag.BoolVar(&verbose, "v", false, "Log debug messages.")
+	flag.BoolVar(&plain, "plain", false, "Print one line per step instead of a status line, even on a terminal.")
+	flag.BoolVar(&noColor, "no-color", false, "Do not color the output. Setting NO_COLOR has the same effect.")
+	flag.BoolVar(&load, "load", false, "Load the melted image into the Docker daemon instead of writing it to -o.")
+	flag.BoolVar(&importContainerd, "import-containerd", false, "Import the melted image into containerd instead of writing it to -o.")
+	flag.StringVar(&outputFormat, "output-format", string(melt.FormatDockerArchive), "Output format: docker-archive, dockerfile (rootfs.tar and a Dockerfile written to the directory -o), layer (the melted layer written to -o) runtime-bundle (an OCI runtime bundle written to the directory -o) or oci (an OCI image layout written to -o, a tarball unless -o is oci:dir or dir:dir).")
+	flag.StringVar(&exportLayer, "export-layer", "", "Write only the melted layer of a single layer image to this tarball and print its diffID. Short for -output-format layer -o.")
+	flag.StringVar(&plan, "plan", "default", "How to melt archives with multiple images: default or shared (keep as much sharing between the images as possible).")
+	flag.StringVar(&layerRanges, "layers", "", "Comma separated ranges of layers to melt as from:to, leaving all other layers untouched. Ends are indexes counted from 0 at the bottom or prefixes of diffIDs.")
+	flag.StringVar(&layerRules, "layer-rules", "", "JSON file listing the ranges of layers to melt by index, diffID or history pattern, like -layers.")
+	flag.Int64Var(&minLayerSize, "min-layer-size", 0, "Only melt runs of adjacent layers smaller than this many bytes, leaving larger layers untouched.")
+	flag.Var(annotations, "annotation", "Add the annotation key=value to the melted images. Can be given multiple times.")
+	flag.StringVar(&base, "base", "", "Keep the layers of this base image untouched and melt everything above them.")
+	flag.StringVar(&previous, "previous", "", "Reuse the melted layers of this earlier output of the same melt whose source layers did not change.")
+	flag.StringVar(&baseRootfs, "base-rootfs", "", "Melt the image onto the root filesystem in this tarball, e.g. to rebase it onto a golden root filesystem.")
+	flag.StringVar(&expectDigest, "expect-digest", "", "Fail unless the input tarball or the configuration of its only image has this sha256 digest.")
+	flag.StringVar(&verifySignature, "verify-signature", "", "Refuse to melt images from a registry without a valid signature checked by this tool: cosign or notation.")
+	flag.StringVar(&signatureKey, "signature-key", "", "Public key cosign verifies signatures with.")
+	flag.StringVar(&signatureIdentity, "signature-identity", "", "Certificate identity keyless cosign signatures have to be made by.")
+	flag.StringVar(&signatureIssuer, "signature-issuer", "", "OIDC issuer of the certificate of keyless cosign signatures.")
+	flag.StringVar(&signKey, "sign-key", "", "Sign the melted image in the registry with cosign and this private key or KMS reference.")
+	flag.StringVar(&signCommand, "sign-command", "", "Run this shell command to sign the melted image once it is written. It gets MELT_OUTPUT, MELT_DIGEST and MELT_IMAGE_IDS in its environment.")
+	flag.StringVar(&clampMtime, "clamp-mtime", "", "Clamp file times in melted layers to this time (RFC 3339 or seconds since the epoch).")
+	flag.BoolVar(&preserveAtime, "preserve-atime", false, "Carry file access times through melting in PAX headers. Costs rewriting every melted layer once more.")
+	flag.StringVar(&umask, "umask", "0", "Octal umask to extract layers with, so results do not depend on the umask of the caller.")
+	flag.StringVar(&testCmd, "test-cmd", "", "Shell command to run chrooted into every melted image before its layers are packed, e.g. \"/usr/bin/app --version\". The melt fails if it fails. Linux only, needs root.")
+	flag.StringVar(&stripXattr, "strip-xattr", "", "Comma separated xattrs to remove from melted layers, e.g. security.selinux,user.overlay.*")
+	flag.StringVar(&selinux, "selinux", string(melt.SELinuxPreserve), "How to treat SELinux labels in melted layers: preserve, strip or relabel.")
+	flag.StringVar(&selinuxContext, "selinux-context", "", "SELinux context to label files with for -selinux=relabel.")
+	flag.StringVar(&verifyCaps, "verify-caps", string(melt.CheckWarn), "What to do if file capabilities are lost while melting: off, warn or fail. -strict implies fail.")
+	flag.StringVar(&verifySymlinks, "verify-symlinks", string(melt.CheckOff), "What to do if symlinks in the melted images point to missing files: off, warn or fail. -strict turns warn into fail.")
+	flag.StringVar(&verifyPermissions, "verify-permissions", string(melt.CheckWarn), "What to do if melting hides files becoming setuid, setgid or world-writable or changing owner: off, warn or fail.")
+	flag.StringVar(&verifyMetadata, "verify-metadata", string(melt.CheckWarn), "What to do if modes, owners, times, xattrs or ACLs are lost while melting: off, warn or fail. -strict implies fail.")
+	flag.BoolVar(&breakHardlinks, "break-hardlinks", false, "Store every hardlinked file in melted layers as an independent copy.")
+	flag.BoolVar(&dereference, "dereference", false, "Replace symlinks in melted layers by copies of the files they point to.")
+	flag.StringVar(&dereferenceExclude, "dereference-exclude", "", "Comma separated path patterns of symlinks -dereference keeps, e.g. usr/lib/*")
+	flag.StringVar(&caseCollisions, "case-collisions", string(melt.CaseWarn), "What to do with paths that differ only by case: off, warn, fail or rename.")
+	flag.BoolVar(&sandbox, "sandbox", false, "Run rsync and -test-cmd with Landlock and seccomp restrictions, writing only to -t. Extraction and -backend=go or umoci are not sandboxed.")
+	flag.StringVar(&backend, "backend", string(melt.BackendAuto), "How to merge layers: auto, rsync, go (in process, without external tools) or umoci (with the umoci library, Linux only). auto uses rsync if it is installed.")
+	flag.StringVar(&events, "events", "", "Write progress events as JSON lines to this file or to an open file descriptor given as fd:N.")
+	flag.IntVar(&retries, "retries", 0, "Number of times to retry steps that failed with a transient I/O or network error.")
+	flag.DurationVar(&retryDelay, "retry-delay", time.Second, "Delay before the first retry, doubled for every further one.")
+	flag.BoolVar(&keepOriginal, "keep-original", false, "Keep the original images in the output next to the melted ones.")
+	flag.StringVar(&meltedSuffix, "melted-tag-suffix", "-melted", "Suffix appended to the tags of the melted images with -keep-original.")
+	flag.BoolVar(&sizeReport, "size-report", false, "Print the size of every image before and after melting, uncompressed and gzip compressed.")
+	flag.StringVar(&tags, "tag", "", "Comma separated tags of the melted image, replacing the original ones. The input has to contain a single image.")
+	flag.BoolVar(&canonicalJSON, "canonical-json", false, "Write manifest.json and image configurations formatted like docker save.")
+	flag.StringVar(&jsonStyle, "json-style", "", "Format manifest.json and image configurations compact or pretty instead of keeping their formatting.")
+	flag.BoolVar(&strict, "strict", false, "Fail on problems that are otherwise worked around with a warning, like layer entries that cannot be extracted or lost metadata, capabilities and SELinux labels.")
+	flag.BoolVar(&repair, "repair", false, "Repair images whose layers, diffIDs and history entries do not line up instead of failing.")
+	flag.BoolVar(&stripBinaries, "strip-binaries", false, "Strip unneeded symbols from ELF binaries and libraries in melted layers.")
+	flag.StringVar(&removeMatching, "remove-matching", "", "Comma separated path patterns of files to remove from melted layers, e.g. *.pyc,usr/share/doc/*")
+	flag.StringVar(&prunePreset, "prune-preset", "", "Comma separated package managers whose caches are removed from melted layers: apt, dnf, yum, apk, pip, npm or gradle.")
+	flag.BoolVar(&truncateLogs, "truncate-logs", false, "Empty *.log files and files below var/log in melted layers.")
+	flag.StringVar(&compress, "compress", "", "Write melted layers, the output archive or both gzip compressed: layers, archive or all.")
+	flag.IntVar(&compressionLevel, "compression-level", gzip.DefaultCompression, "gzip level from 1 (fastest) to 9 (smallest) for -compress and -size-report.")
+	flag.BoolVar(&verifyReproducible, "verify-reproducible", false, "Melt twice and fail unless both melts produce identical images.")
+	flag.BoolVar(&reportDuplicates, "report-duplicates", false, "Report files duplicated across the layers of the melted images.")
+	flag.StringVar(&containerdNamespace, "containerd-namespace", "k8s.io", "containerd namespace -import-containerd imports into.")
+	flag.StringVar(&created, "created", "", "Creation time to record in the image configuration and melted history entries (RFC 3339 or seconds since the epoch).")
 }
 
-func (img *ImageConfig) updateRootfs() error {
-	repl, err := json.Marshal(img.rootfs)
-	if err != nil {
-		return err
+// parseCreated accepts either an RFC 3339 timestamp or the number of seconds
+// since the epoch. The latter is the format of SOURCE_DATE_EPOCH and makes it
+// easy to clear the field to a fixed date with -created=0.
+func parseCreated(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
 	}
-	img.rawJSON = bytes.Replace(img.rawJSON, *img.RawRootfs, repl, 1)
-	return nil
+	return time.Parse(time.RFC3339, s)
 }
 
-func (img *ImageConfig) delHistoryElem(pos int) {
-	*img.history = append((*img.history)[:pos], (*img.history)[pos+1:]...)
+// meltOptions returns the options that were explicitly passed on the command
+// line. Input, output and temporary paths are left out since they do not
+// influence the result.
+func meltOptions() string {
+	var opts []string
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "i", "o", "export-layer", "expect-digest", "verify-signature", "signature-key", "signature-identity", "signature-issuer", "sign-key", "sign-command", "t", "workdir", "load", "import-containerd", "containerd-namespace", "report-duplicates", "size-report", "events", "retries", "retry-delay", "plain", "no-color":
+			return
+		}
+		opts = append(opts, "-"+f.Name+"="+f.Value.String())
+	})
+	return strings.Join(opts, " ")
 }
 
-// The reference for manifests can be found at:
-// https://github.com/docker/distribution/blob/master/docs/spec/manifest-v2-2.md
-// However, we do not need to support this currently since docker save only
-// exports in the format outlined in this struct.
-type Manifest struct {
-	ConfigHash string `json:"Config,omitempty"`
-	config     *ImageConfig
-	RepoTags   []string `json:"RepoTags,omitempty"`
-	layers     []string
-	RawLayers  *json.RawMessage `json:"Layers,omitempty"`
-	Parent     string
+func Usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	if len(commands) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", os.Args[0], cmd.usage)
+	}
 }
 
-func (m *Manifest) delLayerElem(pos int) {
-	m.layers = append(m.layers[:pos], m.layers[pos+1:]...)
+// command is a subcommand of go-docker-melt. Running go-docker-melt without a
+// subcommand melts an image.
+type command struct {
+	name    string
+	summary string
+	usage   string
+	// args lists the fixed set of arguments the command accepts, if any.
+	args  []string
+	flags *flag.FlagSet
+	run   func(args []string) error
 }
 
-type RawManifest struct {
-	Manifest []Manifest
-	rawJSON  []byte // holds raw manifest.json file
-}
+// commands holds all subcommands. They register themselves from init().
+var commands []*command
 
-func (r *RawManifest) updateLayers(manifest Manifest) error {
-	repl, err := json.Marshal(manifest.layers)
-	if err != nil {
-		return err
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
 	}
-	r.rawJSON = bytes.Replace(r.rawJSON, *manifest.RawLayers, repl, 1)
 	return nil
 }
 
-func (r *RawManifest) UnmarshalJSON(file string) error {
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_EXCL, 0755)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		return err
-	}
-
-	size := fi.Size()
-	if !(size > 0) {
-		return nil
-	}
+func main() {
+	melt.SandboxInit()
+	log.SetFlags(log.Lshortfile)
 
-	buf := make([]byte, size)
-	_, err = f.Read(buf)
-	if err != nil {
-		return err
+	if len(os.Args) > 1 {
+		if cmd := lookupCommand(os.Args[1]); cmd != nil {
+			cmd.flags.Parse(os.Args[2:])
+			err := cmd.run(cmd.flags.Args())
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 	}
 
-	err = json.Unmarshal(buf, &r.Manifest)
-	if err != nil {
-		return err
+	flag.Parse()
+	if load && importContainerd {
+		log.Fatal("-load and -import-containerd are mutually exclusive.")
 	}
-
-	for i := 0; i < len(r.Manifest); i++ {
-		manfst := &r.Manifest[i]
-		if manfst.RawLayers == nil {
-			return errors.New("Corrupt manifest file.")
+	if exportLayer != "" {
+		if imageOut != "" {
+			log.Fatal("-export-layer cannot be used with -o.")
 		}
-		err = json.Unmarshal(*manfst.RawLayers, &manfst.layers)
-		if err != nil {
-			return err
+		imageOut = exportLayer
+		outputFormat = string(melt.FormatLayer)
+	}
+	switch melt.OutputFormat(outputFormat) {
+	case melt.FormatDockerArchive:
+	case melt.FormatDockerfile, melt.FormatLayer, melt.FormatRuntimeBundle, melt.FormatOCI:
+		if load || importContainerd {
+			log.Fatal("-load and -import-containerd need the docker-archive output format.")
 		}
+	default:
+		log.Fatalf("Unsupported output format %q.", outputFormat)
 	}
-	r.rawJSON = buf
-	return nil
-}
-
-// Currently unused since we currently do not support squashing of v1 images
-// that do not rely on manifest.json.
-type LayerJSON struct {
-	Id              string         `json:"id,omitempty"`
-	Parent          string         `json:"parent,omitempty"`
-	Created         string         `json:"created,omitempty"`
-	Container       string         `json:"container,omitempty"`
-	ContainerConfig *genericConfig `json:"container_config,omitempty"`
-	DockerVersion   string         `json:"docker_version,omitempty"`
-	Config          *genericConfig `json:"config,omitempty"`
-	Arch            string         `json:"architecture,omitempty"`
-	OS              string         `json:"os,omitempty"`
-	rawJSON         []byte
-}
-
-func rsyncLayer(from string, to string) *exec.Cmd {
-	fromexcl := from + "/./"
-	cmd := exec.Command("rsync", "-aXhsrpR", "--numeric-ids",
-		"--remove-source-files", "--exclude=.wh.*", fromexcl, to)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd
-}
-
-// This implements a barebone recursive readdir() since the filepath.Walk()
-// function causes unnecessary overhead due to it sorting the directory entries.
-func removeWhiteouts(oldpath string, newpath string, nentries int, isWhiteout *regexp.Regexp) error {
-	f, err := os.Open(oldpath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	var dirEntries = make([]os.FileInfo, nentries)
-	var cur string
-	for dirEntries, err = f.Readdir(nentries); err != io.EOF && err == nil; dirEntries, err = f.Readdir(nentries) {
-		for _, n := range dirEntries {
-			cur = n.Name()
-			curTmp := filepath.Join(oldpath, cur)
-			newTmp := filepath.Join(newpath, cur)
-			if n.IsDir() {
-				removeWhiteouts(curTmp, newTmp, nentries, isWhiteout)
-			} else {
-				if isWhiteout.MatchString(cur) {
-					if err := os.RemoveAll(filepath.Join(newpath, cur[ /* .wh. */ 4:])); err != nil {
-						return err
-					}
-				}
-			}
+	if load || importContainerd {
+		if imageOut != "" {
+			log.Fatal("-load and -import-containerd cannot be used with -o.")
+		}
+		imageOut = "docker-load:"
+		if importContainerd {
+			imageOut = "containerd-import:" + containerdNamespace
 		}
 	}
-	return err
-}
-
-func IsEmptyDir(dir string) error {
-	f, err := os.Open(dir)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	_, err = f.Readdirnames(1)
-	return err
-}
-
-var image string
-var imageOut string
-var tmpDir string
-
-func init() {
-	flag.StringVar(&image, "i", "", "Tarball of the image to melt.")
-	flag.StringVar(&imageOut, "o", "", "Name of output tarball.")
-	flag.StringVar(&tmpDir, "t", "", "Directory to hold temporary data.")
-}
-
-func Usage() {
-	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	flag.PrintDefaults()
-}
-
-func main() {
-	flag.Parse()
 	if image == "" || imageOut == "" {
 		Usage()
 		os.Exit(1)
 	}
-
-	log.SetFlags(log.Lshortfile)
-
-	tmpDir, err := ioutil.TempDir(tmpDir, "go-docker-melt_")
-	if err != nil {
-		log.Fatal(err)
+	if reportDuplicates {
+		name, _ := melt.ParseReference(imageOut)
+		if name != "docker-archive" || melt.OutputFormat(outputFormat) != melt.FormatDockerArchive {
+			log.Fatal("-report-duplicates needs a docker save tarball as output.")
+		}
+		if melt.Compression(compress) != melt.CompressNone {
+			log.Fatal("-report-duplicates cannot be used with -compress.")
+		}
 	}
 
-	err = tarski.Extract(image, tmpDir)
-	if err != nil {
-		os.RemoveAll(tmpDir)
-		log.Fatal(err)
+	planner, ok := planners[plan]
+	if !ok {
+		log.Fatalf("Unsupported plan %q.", plan)
 	}
 
-	var manifest RawManifest
-	err = manifest.UnmarshalJSON(filepath.Join(tmpDir, "manifest.json"))
-	if err != nil {
-		os.RemoveAll(tmpDir)
-		log.Fatal(err)
+	opts := []melt.Option{
+		melt.WithPlanner(planner),
+		melt.WithTmpDir(tmpDir),
+		melt.WithWorkDir(workDir),
+		melt.WithWorkers(workers),
+		melt.WithInvocation(meltOptions()),
+		melt.WithOutputFormat(melt.OutputFormat(outputFormat)),
 	}
-
-	numManifest := len(manifest.Manifest)
-	var numLayers int
-	var configs = make([]ImageConfig, numManifest, numManifest)
-	for i, val := range manifest.Manifest {
-		numLayers += len(val.layers)
-		conf := val.ConfigHash
-		if conf == "" {
-			continue
-		}
-		err = configs[i].UnmarshalJSON(filepath.Join(tmpDir, conf))
-		if err != nil {
-			os.RemoveAll(tmpDir)
-			log.Fatal(err)
-		}
-		manifest.Manifest[i].config = &configs[i]
+	term := newTerminal(os.Stderr, plain, noColor)
+	log.SetOutput(term)
+	switch {
+	case term.interactive && verbose:
+		opts = append(opts, melt.WithLogger(term.handler(slog.LevelDebug)))
+	case term.interactive:
+		opts = append(opts, melt.WithLogger(term.handler(slog.LevelInfo)))
+	case verbose:
+		opts = append(opts, melt.WithLogger(slog.NewTextHandler(term, &slog.HandlerOptions{Level: slog.LevelDebug})))
 	}
-
-	// Check if it is worth doing any work at all.
-	if numLayers <= 1 {
-		fmt.Errorf("%s\n", "Image does only have one layer.")
-		fmt.Errorf("%s\n", "There is nothing to be done.")
-		os.RemoveAll(tmpDir)
-		os.Exit(0)
+	if noAnnotate {
+		opts = append(opts, melt.WithoutAnnotation())
 	}
-
-	// Maybe we can make the hashmap already in the preceding loop to avoid
-	// looping through all of this again.
-	// Let m be the runtime of the outer loop, n the runtime of the inner
-	// loop. Then adding all keys has complexity O(m*n).
-	// The allLayers hashmap holds all layers for all images in the tar
-	// archive without duplicates. If the int it indicates is set to 1 the
-	// layer is shared at least among two layers. If it is set to 0 the
-	// layer is unique.
-	allLayers := make(map[string]int, numLayers)
-	for _, val := range manifest.Manifest {
-		for _, lay := range val.layers {
-			if ret, ok := allLayers[lay]; !ok {
-				allLayers[lay] = 0 // unique layer
-			} else if ret == 0 { // only set it when it isn't already set
-				allLayers[lay]++ // shared layer
-			}
-		}
+	if base != "" {
+		opts = append(opts, melt.WithBase(base))
 	}
-
-	// The next checks only make sense when we found multiple config objects
-	// in the manifest.json file. Otherwise this is pointless work.
-	if numManifest > 1 {
-		var uniqueLayers int
-		for _, val := range allLayers {
-			if val == 0 {
-				uniqueLayers++
-			}
+	if (layerRanges != "" || layerRules != "") && base != "" {
+		log.Fatal("-layers and -layer-rules cannot be used with -base.")
+	}
+	if baseRootfs != "" {
+		if base != "" {
+			log.Fatal("-base-rootfs cannot be used with -base.")
 		}
-		if uniqueLayers == 0 {
-			fmt.Errorf("%s\n", "All layers are shared among images.")
-			fmt.Errorf("%s\n", "There is nothing to be done.")
-			os.RemoveAll(tmpDir)
-			os.Exit(0)
+		opts = append(opts, melt.WithBaseRootfs(baseRootfs))
+	}
+	if previous != "" {
+		opts = append(opts, melt.WithPrevious(previous))
+	}
+	if expectDigest != "" {
+		if !strings.HasPrefix(expectDigest, "sha256:") {
+			expectDigest = "sha256:" + expectDigest
 		}
-		var cur, prev string
-		// If the preceeding layer "prev" is shared and followed by a
-		// unique layer "cur" we cannot melt "cur" into "prev". To
-		// indicate this we assign the value 2.
-		for _, val := range manifest.Manifest {
-			for i := 1; i < len(val.layers); i++ {
-				cur = val.layers[i]
-				prev = val.layers[i-1]
-				if (allLayers[cur] == 0) && (allLayers[prev] == 1) {
-					allLayers[prev]++
-				}
-			}
+		opts = append(opts, melt.WithExpectedDigest(expectDigest))
+	}
+	if verifySignature != "" {
+		opts = append(opts, melt.WithSignaturePolicy(melt.SignaturePolicy{
+			Tool:     melt.SignatureTool(verifySignature),
+			Key:      signatureKey,
+			Identity: signatureIdentity,
+			Issuer:   signatureIssuer,
+		}))
+	} else if signatureKey != "" || signatureIdentity != "" || signatureIssuer != "" {
+		log.Fatal("-signature-key, -signature-identity and -signature-issuer need -verify-signature.")
+	}
+	if signKey != "" || signCommand != "" {
+		if signKey != "" && signCommand != "" {
+			log.Fatal("-sign-key cannot be used with -sign-command.")
 		}
+		opts = append(opts, melt.WithSigning(melt.SigningPolicy{Key: signKey, Command: signCommand}))
 	}
-
-	maxWorkers := runtime.NumCPU()
-	var sawError bool
-	sem := make(chan bool, maxWorkers)
-	errc := make(chan error, maxWorkers)
-
-	for key := range allLayers {
-		// We need to record the pure layerHash somewhere to avoid
-		// duplicating the work. That's for future tweaking.
-		layerHash := key[:len(key)- /* /layer.tar */ 10]
-		direntries, err := ioutil.ReadDir(filepath.Join(tmpDir, layerHash))
-		if err != nil {
-			os.RemoveAll(tmpDir)
-			os.Exit(1)
+	switch melt.Compression(compress) {
+	case melt.CompressNone, melt.CompressLayers, melt.CompressArchive, melt.CompressAll:
+	default:
+		log.Fatalf("Unsupported -compress mode %q.", compress)
+	}
+	if compressionLevel != gzip.DefaultCompression && (compressionLevel < gzip.BestSpeed || compressionLevel > gzip.BestCompression) {
+		log.Fatalf("-compression-level has to be between %d and %d.", gzip.BestSpeed, gzip.BestCompression)
+	}
+	opts = append(opts, melt.WithCompression(melt.Compression(compress), compressionLevel))
+	if verifyReproducible {
+		opts = append(opts, melt.WithVerifyReproducible())
+	}
+	if len(annotations) > 0 {
+		opts = append(opts, melt.WithAnnotations(annotations))
+	}
+	if memoryBudget < 0 {
+		log.Fatal("-memory-budget cannot be negative.")
+	}
+	if memoryBudget > 0 {
+		opts = append(opts, melt.WithMemoryBudget(memoryBudget))
+	}
+	if minLayerSize < 0 {
+		log.Fatal("-min-layer-size cannot be negative.")
+	}
+	if minLayerSize > 0 {
+		if layerRanges != "" || layerRules != "" {
+			log.Fatal("-min-layer-size cannot be used with -layers or -layer-rules.")
 		}
-		// There usually are only a few (<=3) entries per directory so
-		// there's no point in using goroutines for this.
-		for _, val := range direntries {
-			curName := val.Name()
-			if curName == "layer.tar" {
-				continue
-			}
-			err = os.Remove(filepath.Join(tmpDir, layerHash, curName))
+		opts = append(opts, melt.WithMinLayerSize(minLayerSize))
+	}
+	if layerRanges != "" {
+		var ranges []melt.LayerRange
+		for _, s := range strings.Split(layerRanges, ",") {
+			r, err := melt.ParseLayerRange(s)
 			if err != nil {
-				log.Println(err)
+				log.Fatal(err)
 			}
+			ranges = append(ranges, r)
 		}
-		// Unpacking everything under sha-hash/layer
-		tmptar := key[:len(key)- /* .tar */ 4]
-		err = os.Mkdir(filepath.Join(tmpDir, tmptar), 0755)
+		opts = append(opts, melt.WithLayerRanges(ranges...))
+	}
+	if layerRules != "" {
+		ranges, err := melt.LoadLayerRanges(layerRules)
 		if err != nil {
-			os.RemoveAll(tmpDir)
 			log.Fatal(err)
 		}
-		sem <- true
-		go func(tmpDir string, key string, tmptar string) {
-			defer func() { <-sem }()
-			errc <- tarski.Extract(filepath.Join(tmpDir, key), filepath.Join(tmpDir, tmptar))
-		}(tmpDir, key, tmptar)
-		select {
-		case err := <-errc:
-			if err != nil {
-				log.Println(err)
-				sawError = true
-				break
-			}
-		default:
-		}
+		opts = append(opts, melt.WithLayerRanges(ranges...))
 	}
-
-	for i := 0; i < cap(sem); i++ {
-		sem <- true
-		select {
-		case err := <-errc:
-			if err != nil {
-				if !sawError {
-					sawError = true
-				}
-				log.Println(err)
-			}
-		default:
+	switch melt.SELinuxPolicy(selinux) {
+	case melt.SELinuxPreserve, melt.SELinuxStrip:
+	case melt.SELinuxRelabel:
+		if selinuxContext == "" {
+			log.Fatal("-selinux=relabel needs -selinux-context.")
 		}
+	default:
+		log.Fatalf("Unsupported SELinux policy %q.", selinux)
+	}
+	opts = append(opts, melt.WithSELinux(melt.SELinuxPolicy(selinux), selinuxContext))
+	switch melt.CheckMode(verifyCaps) {
+	case melt.CheckOff, melt.CheckWarn, melt.CheckFail:
+	default:
+		log.Fatalf("Unsupported -verify-caps mode %q.", verifyCaps)
+	}
+	opts = append(opts, melt.WithCapabilityCheck(melt.CheckMode(verifyCaps)))
+	switch melt.CheckMode(verifyPermissions) {
+	case melt.CheckOff, melt.CheckWarn, melt.CheckFail:
+	default:
+		log.Fatalf("Unsupported -verify-permissions mode %q.", verifyPermissions)
+	}
+	opts = append(opts, melt.WithPermissionCheck(melt.CheckMode(verifyPermissions)))
+	switch melt.CheckMode(verifyMetadata) {
+	case melt.CheckOff, melt.CheckWarn, melt.CheckFail:
+	default:
+		log.Fatalf("Unsupported -verify-metadata mode %q.", verifyMetadata)
+	}
+	opts = append(opts, melt.WithMetadataCheck(melt.CheckMode(verifyMetadata)))
+	switch melt.CheckMode(verifySymlinks) {
+	case melt.CheckOff, melt.CheckWarn, melt.CheckFail:
+	default:
+		log.Fatalf("Unsupported -verify-symlinks mode %q.", verifySymlinks)
+	}
+	opts = append(opts, melt.WithSymlinkCheck(melt.CheckMode(verifySymlinks)))
+	switch melt.CasePolicy(caseCollisions) {
+	case melt.CaseOff, melt.CaseWarn, melt.CaseFail, melt.CaseRename:
+	default:
+		log.Fatalf("Unsupported -case-collisions policy %q.", caseCollisions)
+	}
+	opts = append(opts, melt.WithCaseCollisions(melt.CasePolicy(caseCollisions)))
+	if dereference {
+		var exclude []string
+		if dereferenceExclude != "" {
+			exclude = strings.Split(dereferenceExclude, ",")
+		}
+		opts = append(opts, melt.WithDereference(exclude...))
 	}
-	close(sem)
-	close(errc)
-	if sawError {
-		os.RemoveAll(tmpDir)
-		os.Exit(1)
+	if retries < 0 {
+		log.Fatal("-retries must not be negative.")
 	}
-
-	// sync + delete witheouts
-	var rootLayer string
-
-	isWhiteout, err := regexp.Compile(`^\.wh\.[[:alnum:]]+`)
-	if err != nil {
-		os.RemoveAll(tmpDir)
-		log.Fatal(err)
+	if retries > 0 {
+		opts = append(opts, melt.WithRetries(retries, retryDelay))
 	}
-
-	for i := 0; i < len(manifest.Manifest); i++ {
-		manfst := &manifest.Manifest[i]
-		if manfst.config == nil {
-			os.RemoveAll(tmpDir)
-			log.Fatalln("Corrupt image configuration file.")
-		}
-
-		rootLayer = ""
-		for j, hist := 0, 0; j < len(manfst.layers); j, hist = j+1, hist+1 {
-			layer := &manfst.layers[j]
-			// Find the first useable rootLayer for this image.
-			if rootLayer == "" && allLayers[*layer] != 2 {
-				rootLayer = (*layer)[:len(*layer)- /* .tar */ 4]
-				continue
-			}
-
-			// This layer will be melted into the current chosen
-			// rootLayer.
-			layerHash := (*layer)[:len(*layer)- /* .tar */ 4]
-			meltFrom := filepath.Join(tmpDir, layerHash)
-			meltInto := filepath.Join(tmpDir, rootLayer)
-
-			// melt
-			_, err := os.Stat(meltFrom)
-			if err == nil {
-				// rsync everything except whiteout files.
-				cmd := rsyncLayer(meltFrom, meltInto)
-				// log.Println(meltFrom, meltInto)
-				err = cmd.Run()
-				if err != nil {
-					os.RemoveAll(tmpDir)
-					log.Fatal(err)
-				}
-				// Delete whiteout files in the current layer
-				// and the corresponding file/dir in the
-				// rootLayer.
-				err = removeWhiteouts(meltFrom, meltInto, 20, isWhiteout)
-				if err != io.EOF {
-					os.RemoveAll(tmpDir)
-					log.Fatal(err)
-				}
-				// Delete melted layers.
-				err := os.RemoveAll(filepath.Join(tmpDir, layerHash[:len(layerHash)- /* /layer */ 6]))
-				if err != nil {
-					os.RemoveAll(tmpDir)
-					log.Fatal(err)
-				}
-			}
-
-			// The next layer cannot be melted into the current
-			// rootLayer.
-			if allLayers[*layer] == 2 {
-				rootLayer = ""
-			}
-
-			for ; (*manfst.config.history)[hist].EmptyLayer == true; hist++ {
-				// Keep all history entries that do not
-				// correspond to a layer in the tar archive.
+	if repair {
+		opts = append(opts, melt.WithRepair())
+	}
+	if removeMatching != "" {
+		patterns := strings.Split(removeMatching, ",")
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				log.Fatalf("Invalid -remove-matching pattern %q.", p)
 			}
-			// Delete corresponding history entry for this layer.
-			manfst.config.delHistoryElem(hist)
-			hist--
-
-			// Delete corresponding diff_ids entry for this layer.
-			manfst.config.rootfs.delRootfsElem(j)
-			// Delete corresponding layer entry.
-			manfst.delLayerElem(j)
-			j--
 		}
-		err = manfst.config.updateHistory()
+		opts = append(opts, melt.WithFileTransform(melt.RemoveMatching(patterns...)))
+	}
+	if prunePreset != "" {
+		filter, err := melt.PrunePreset(strings.Split(prunePreset, ",")...)
 		if err != nil {
-			os.RemoveAll(tmpDir)
 			log.Fatal(err)
 		}
-
-		err = manifest.updateLayers(*manfst)
-		if err != nil {
-			os.RemoveAll(tmpDir)
-			log.Fatal(err)
+		opts = append(opts, melt.WithFileTransform(filter))
+	}
+	if truncateLogs {
+		opts = append(opts, melt.WithFileTransform(melt.TruncateLogs()))
+	}
+	if stripBinaries {
+		if _, err := exec.LookPath("strip"); err != nil {
+			log.Fatal("-strip-binaries needs strip from binutils.")
 		}
+		opts = append(opts, melt.WithFileTransform(melt.StripBinaries()))
 	}
-	err = ioutil.WriteFile(filepath.Join(tmpDir, "manifest.json"), manifest.rawJSON, 0666)
-	if err != nil {
-		os.RemoveAll(tmpDir)
-		log.Fatal(err)
+	if strict {
+		opts = append(opts, melt.WithStrict())
 	}
-
-	// TODO: Rethink whether usage of a diffID map can be avoided.
-	var diffIDMutex = struct {
-		sync.Mutex
-		diffID map[string]string
-	}{diffID: make(map[string]string, len(allLayers))}
-
-	sem = make(chan bool, maxWorkers)
-	errc = make(chan error, maxWorkers)
-
-	for key := range allLayers {
-		l := filepath.Join(tmpDir, key)
-		_, err = os.Stat(l)
-		if os.IsNotExist(err) {
-			continue
+	if canonicalJSON {
+		opts = append(opts, melt.WithCanonicalJSON())
+	}
+	switch melt.JSONStyle(jsonStyle) {
+	case melt.JSONKeep, melt.JSONCompact, melt.JSONPretty:
+	default:
+		log.Fatalf("Unsupported -json-style %q.", jsonStyle)
+	}
+	opts = append(opts, melt.WithJSONStyle(melt.JSONStyle(jsonStyle)))
+	if tags != "" {
+		opts = append(opts, melt.WithTags(strings.Split(tags, ",")...))
+	}
+	if keepOriginal {
+		if melt.OutputFormat(outputFormat) != melt.FormatDockerArchive {
+			log.Fatal("-keep-original needs the docker-archive output format.")
 		}
-
-		err = os.Remove(l)
+		opts = append(opts, melt.WithKeepOriginal(meltedSuffix))
+	}
+	if sandbox {
+		opts = append(opts, melt.WithSandbox())
+	}
+	switch melt.Backend(backend) {
+	case melt.BackendAuto, melt.BackendRsync:
+	case melt.BackendGo, melt.BackendUmoci:
+		if sandbox {
+			log.Fatalf("-backend=%s cannot be combined with -sandbox.", backend)
+		}
+	default:
+		log.Fatalf("Unsupported merge backend %q.", backend)
+	}
+	opts = append(opts, melt.WithBackend(melt.Backend(backend)))
+	if breakHardlinks {
+		opts = append(opts, melt.WithBreakHardlinks())
+	}
+	if stripXattr != "" {
+		opts = append(opts, melt.WithStripXattrs(strings.Split(stripXattr, ",")...))
+	}
+	if clampMtime != "" {
+		t, err := parseCreated(clampMtime)
 		if err != nil {
-			os.RemoveAll(tmpDir)
 			log.Fatal(err)
 		}
-
-		dir := filepath.Join(tmpDir, key[:len(key)- /* .tar */ 4])
-
-		sem <- true
-		go func(l string, dir string, key string) {
-			defer func() { <-sem }()
-			checksum, err := tarski.CreateSHA256(l, dir, dir)
-			if err != nil {
-				errc <- err
-				return
-			}
-			diffIDMutex.Lock()
-			diffIDMutex.diffID[key] = "sha256:" + hex.EncodeToString(checksum)
-			diffIDMutex.Unlock()
-			err = os.RemoveAll(dir)
-			if err != nil {
-				errc <- err
-				return
-			}
-			errc <- nil
-		}(l, dir, key)
-
-		select {
-		case err := <-errc:
-			if err != nil {
-				log.Println(err)
-				sawError = true
-				break
-			}
-		default:
-		}
+		opts = append(opts, melt.WithClampMtime(t.UTC()))
 	}
-
-	for i := 0; i < cap(sem); i++ {
-		sem <- true
-		select {
-		case err := <-errc:
-			if err != nil {
-				if !sawError {
-					sawError = true
-				}
-				log.Println(err)
-			}
-		default:
-		}
+	if preserveAtime {
+		opts = append(opts, melt.WithPreserveAtime())
 	}
-	close(sem)
-	close(errc)
-	if sawError {
-		os.RemoveAll(tmpDir)
-		os.Exit(1)
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		log.Fatalf("Invalid -umask %q.", umask)
+	}
+	opts = append(opts, melt.WithUmask(int(mask)))
+	if testCmd != "" {
+		opts = append(opts, melt.WithTestCommand(testCmd))
 	}
 
-	for i := 0; i < len(manifest.Manifest); i++ {
-		m := &manifest.Manifest[i]
-		for j := 0; j < len(m.layers); j++ {
-			l := &m.layers[j]
-			m.config.rootfs.DiffIds[j] = diffIDMutex.diffID[*l]
-		}
-		err = m.config.updateRootfs()
+	if created != "" {
+		t, err := parseCreated(created)
 		if err != nil {
-			os.RemoveAll(tmpDir)
 			log.Fatal(err)
 		}
-		err = ioutil.WriteFile(filepath.Join(tmpDir, m.ConfigHash), m.config.rawJSON, 0666)
+		opts = append(opts, melt.WithCreated(t.UTC()))
+	}
+
+	var sizes *melt.SizeReport
+	if sizeReport {
+		opts = append(opts, melt.WithSizeReport(func(r melt.SizeReport) {
+			sizes = &r
+		}))
+	}
+
+	var stream *eventStream
+	if events != "" {
+		stream, err = openEvents(events)
 		if err != nil {
-			os.RemoveAll(tmpDir)
 			log.Fatal(err)
 		}
 	}
+	var exported string
+	opts = append(opts, melt.WithEvents(func(e melt.Event) {
+		if e.Type == melt.LayerExported {
+			exported = e.DiffID
+		}
+		term.event(e)
+		if stream != nil {
+			stream.event(e)
+		}
+	}))
 
-	err = tarski.Create(imageOut, tmpDir, tmpDir)
+	err = melt.New(opts...).Melt(image, imageOut)
+	term.finish(err)
+	if stream != nil {
+		stream.finish(err)
+	}
+	if err == melt.ErrSingleLayer || err == melt.ErrAllShared {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(0)
+	}
 	if err != nil {
-		os.RemoveAll(tmpDir)
 		log.Fatal(err)
 	}
+	for _, img := range loaded {
+		fmt.Println(img)
+	}
+	if exportLayer != "" {
+		fmt.Println(exported)
+	}
+	if sizes != nil {
+		printSizes(os.Stdout, *sizes)
+	}
 
-	err = os.RemoveAll(tmpDir)
-	if err != nil {
-		log.Println(err)
+	if reportDuplicates {
+		_, path := melt.ParseReference(imageOut)
+		dups, err := melt.Duplicates(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printDuplicates(os.Stdout, dups)
 	}
 }
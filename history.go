@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// The history subcommand shows which layer of the melted image every history
+// entry of the original image ends up in, so the provenance of a file can
+// still be traced after its layer has been melted away.
+
+var historyCmd = &command{
+	name:    "history",
+	summary: "Show which melted layer every original layer ends up in.",
+	usage:   "history [-plan default|shared] [-base image] input",
+	flags:   flag.NewFlagSet("history", flag.ExitOnError),
+}
+
+var historyPlan string
+var historyBase string
+
+func init() {
+	historyCmd.flags.StringVar(&historyPlan, "plan", "default", "How to melt archives with multiple images: default or shared.")
+	historyCmd.flags.StringVar(&historyBase, "base", "", "Keep the layers of this base image untouched.")
+	historyCmd.run = runHistory
+	commands = append(commands, historyCmd)
+}
+
+// shortID abbreviates layer paths and digests like docker does for IDs.
+func shortID(s string) string {
+	s = strings.TrimPrefix(s, "sha256:")
+	if len(s) > 12 {
+		return s[:12]
+	}
+	return s
+}
+
+func printHistory(w io.Writer, traces []melt.ImageTrace) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, t := range traces {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s\n", t.Name)
+		fmt.Fprintln(tw, "LAYER\tDIFF ID\tINTO\tREASON\tCREATED BY")
+		for _, e := range t.Entries {
+			layer, diffID, into := "-", "-", "-"
+			if e.Layer != "" {
+				layer, diffID, into = shortID(e.Layer), shortID(e.DiffID), shortID(e.Into)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layer, diffID, into, e.Reason, e.History.CreatedBy)
+		}
+	}
+	tw.Flush()
+}
+
+func runHistory(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], historyCmd.usage)
+	}
+	planner, ok := planners[historyPlan]
+	if !ok {
+		return fmt.Errorf("Unsupported plan %q.", historyPlan)
+	}
+
+	opts := []melt.Option{melt.WithPlanner(planner)}
+	if historyBase != "" {
+		opts = append(opts, melt.WithBase(historyBase))
+	}
+	traces, err := melt.New(opts...).Trace(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	printHistory(os.Stdout, traces)
+	return nil
+}
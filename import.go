@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"os"
+	"strings"
+)
+
+// The import subcommand turns the root filesystem of a container, as written
+// by docker export, into an image with a single layer. The configuration is
+// taken from an image configuration file, e.g. that of the image the
+// container was created from, and adjusted by flags.
+
+var importCmd = &command{
+	name:    "import",
+	summary: "Package a docker export tarball as a single layer image.",
+	usage:   "import -o output [-config config.json] [-tag name:tag] [-env key=value] [-cmd json] [-entrypoint json] rootfs.tar",
+	flags:   flag.NewFlagSet("import", flag.ExitOnError),
+}
+
+// listFlag collects the values of a flag given multiple times.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var importOut string
+var importConfig string
+var importTag string
+var importEnv listFlag
+var importCmdline string
+var importEntrypoint string
+var importWorkingDir string
+var importUser string
+var importArch string
+var importOS string
+var importCreated string
+
+func init() {
+	importCmd.flags.StringVar(&importOut, "o", "", "Output reference, like -o of a melt.")
+	importCmd.flags.StringVar(&importConfig, "config", "", "Image configuration file to take the runtime configuration, architecture and OS from.")
+	importCmd.flags.StringVar(&importTag, "tag", "", "Comma separated tags of the image.")
+	importCmd.flags.Var(&importEnv, "env", "Set the environment variable key=value. Can be given multiple times.")
+	importCmd.flags.StringVar(&importCmdline, "cmd", "", "Command of the image as a JSON array.")
+	importCmd.flags.StringVar(&importEntrypoint, "entrypoint", "", "Entrypoint of the image as a JSON array.")
+	importCmd.flags.StringVar(&importWorkingDir, "working-dir", "", "Working directory of the image.")
+	importCmd.flags.StringVar(&importUser, "user", "", "User the image runs as.")
+	importCmd.flags.StringVar(&importArch, "arch", "", "Architecture of the image. Defaults to that of -config or amd64.")
+	importCmd.flags.StringVar(&importOS, "os", "", "Operating system of the image. Defaults to that of -config or linux.")
+	importCmd.flags.StringVar(&importCreated, "created", "", "Creation time to record (RFC 3339 or seconds since the epoch).")
+	importCmd.run = runImport
+	commands = append(commands, importCmd)
+}
+
+// setEnv sets the variable of the key=value pair kv in env.
+func setEnv(env []string, kv string) []string {
+	key := kv
+	if i := strings.Index(kv, "="); i >= 0 {
+		key = kv[:i]
+	}
+	for i, e := range env {
+		if e == key || strings.HasPrefix(e, key+"=") {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
+
+func runImport(args []string) error {
+	if len(args) != 1 || importOut == "" {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], importCmd.usage)
+	}
+
+	var cfg melt.ImportConfig
+	if importConfig != "" {
+		var img melt.ImageConfig
+		err := img.Load(importConfig)
+		if err != nil {
+			return fmt.Errorf("Cannot read %s: %v", importConfig, err)
+		}
+		cfg.Config, cfg.Arch, cfg.OS = img.Config, img.Architecture, img.OS
+	}
+	if cfg.Config == nil {
+		cfg.Config = &melt.GenericConfig{Env: []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}}
+	}
+	for _, kv := range importEnv {
+		cfg.Config.Env = setEnv(cfg.Config.Env, kv)
+	}
+	if importCmdline != "" {
+		err := json.Unmarshal([]byte(importCmdline), &cfg.Config.Cmd)
+		if err != nil {
+			return errors.New("-cmd has to be a JSON array of strings.")
+		}
+	}
+	if importEntrypoint != "" {
+		err := json.Unmarshal([]byte(importEntrypoint), &cfg.Config.Entrypoint)
+		if err != nil {
+			return errors.New("-entrypoint has to be a JSON array of strings.")
+		}
+	}
+	if importWorkingDir != "" {
+		cfg.Config.WorkingDir = importWorkingDir
+	}
+	if importUser != "" {
+		cfg.Config.User = importUser
+	}
+	if importArch != "" {
+		cfg.Arch = importArch
+	}
+	if importOS != "" {
+		cfg.OS = importOS
+	}
+	if importTag != "" {
+		cfg.Tags = strings.Split(importTag, ",")
+	}
+	if importCreated != "" {
+		t, err := parseCreated(importCreated)
+		if err != nil {
+			return err
+		}
+		cfg.Created = t.UTC()
+	}
+	return melt.New().Import(context.Background(), args[0], importOut, cfg)
+}
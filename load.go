@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// -load and -import-containerd stream the melted image into the Docker daemon
+// or containerd instead of writing a tarball. On Unix the tarball is written to
+// a fifo which is read by the consumer, so it never hits the disk.
+
+// loadTransport implements the docker-load transport used for -load. The
+// reference is ignored.
+type loadTransport struct{}
+
+// containerdTransport implements the containerd-import transport used for
+// -import-containerd. The reference is the containerd namespace to import
+// into.
+type containerdTransport struct{}
+
+// loaded holds the IDs and tags of the images loaded by -load or
+// -import-containerd.
+var loaded []string
+
+func init() {
+	melt.RegisterTransport("docker-load", loadTransport{})
+	melt.RegisterTransport("containerd-import", containerdTransport{})
+}
+
+// imageIDs returns the ID followed by the tags of every image in dir.
+func imageIDs(dir string) ([]string, error) {
+	var manifest melt.RawManifest
+	err := manifest.Load(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, m := range manifest.Manifest {
+		// The ID of an image is the digest of its configuration.
+		buf, err := ioutil.ReadFile(filepath.Join(dir, m.ConfigHash))
+		if err != nil {
+			return nil, err
+		}
+		id := fmt.Sprintf("sha256:%x", sha256.Sum256(buf))
+		images = append(images, strings.Join(append([]string{id}, m.RepoTags...), " "))
+	}
+	return images, nil
+}
+
+// dockerClient returns an HTTP client talking to the daemon DOCKER_HOST
+// points to and the base URL to use with it.
+func dockerClient() (*http.Client, string, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		sock := strings.TrimPrefix(host, "unix://")
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}
+		return &http.Client{Transport: tr}, "http://docker", nil
+	case strings.HasPrefix(host, "tcp://"):
+		return http.DefaultClient, "http://" + strings.TrimPrefix(host, "tcp://"), nil
+	}
+	return nil, "", fmt.Errorf("Unsupported DOCKER_HOST %s.", host)
+}
+
+func (loadTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	return fmt.Errorf("docker-load can only be used as output.")
+}
+
+func (loadTransport) Pack(ctx context.Context, dir string, ref string) error {
+	client, base, err := dockerClient()
+	if err != nil {
+		return err
+	}
+	images, err := imageIDs(dir)
+	if err != nil {
+		return err
+	}
+
+	err = streamArchive(dir, func(r io.Reader) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/images/load?quiet=1", r)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-tar")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return readLoadResponse(resp)
+	})
+	if err != nil {
+		return err
+	}
+	loaded = images
+	return nil
+}
+
+// readLoadResponse checks the message stream returned by /images/load for
+// errors.
+func readLoadResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Docker daemon failed to load the image: %s: %s", resp.Status, strings.TrimSpace(string(buf)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			continue
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("Docker daemon failed to load the image: %s", msg.Error)
+		}
+	}
+	return scanner.Err()
+}
+
+func (containerdTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	return fmt.Errorf("containerd-import can only be used as output.")
+}
+
+// Pack imports the image with ctr which talks to the containerd instance
+// CONTAINERD_ADDRESS points to.
+func (containerdTransport) Pack(ctx context.Context, dir string, ref string) error {
+	images, err := imageIDs(dir)
+	if err != nil {
+		return err
+	}
+
+	err = streamArchive(dir, func(r io.Reader) error {
+		var out bytes.Buffer
+		cmd := exec.CommandContext(ctx, "ctr", "-n", ref, "images", "import", "-")
+		cmd.Stdin = r
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("Failed to import image into containerd namespace %s: %s: %s", ref, err, strings.TrimSpace(out.String()))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	loaded = images
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+
+package main
+
+import (
+	"github.com/brauner/tarski"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// streamArchive packs dir into a tarball and passes it to consume as it is
+// being written.
+func streamArchive(dir string, consume func(io.Reader) error) error {
+	fifoDir, err := ioutil.TempDir(filepath.Dir(dir), "go-docker-melt_load_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(fifoDir)
+	fifo := filepath.Join(fifoDir, "image.tar")
+	err = syscall.Mkfifo(fifo, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Opening the read end of a fifo blocks until there is a writer. Open
+	// it non-blocking and keep a write end open ourselves until the
+	// tarball is complete so the consumer does not see a premature EOF.
+	r, err := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	created := make(chan error, 1)
+	go func() {
+		err := tarski.Create(fifo, dir, dir)
+		w.Close()
+		created <- err
+	}()
+
+	// The consumer may give up without reading the whole tarball. Closing
+	// the read end makes sure the writer does not block forever.
+	errConsume := consume(r)
+	r.Close()
+	err = <-created
+	if errConsume != nil {
+		return errConsume
+	}
+	return err
+}
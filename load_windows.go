@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/brauner/tarski"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// streamArchive packs dir into a tarball and passes it to consume. Windows has
+// no fifos, so the tarball is written to a temporary file first.
+func streamArchive(dir string, consume func(io.Reader) error) error {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), "go-docker-melt_load_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	archive := filepath.Join(tmpDir, "image.tar")
+	err = tarski.Create(archive, dir, dir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return consume(f)
+}
@@ -0,0 +1,109 @@
+package melt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Every layer of an image has a diffID in the rootfs of its configuration
+// and a history entry that is not marked as empty_layer, all in the same
+// order. Melting relies on this to find the entries belonging to a layer.
+
+// WithRepair repairs images whose layers, diffIDs and history entries do not
+// line up instead of failing. DiffIDs are computed from the layers and history
+// entries are added or marked as empty_layer at the end to match the number of
+// layers.
+func WithRepair() Option {
+	return func(o *options) {
+		o.repair = true
+	}
+}
+
+// alignment returns the number of layers, diffIDs and history entries for
+// layers of an image.
+func alignment(mf *Manifest) (int, int, int) {
+	var history int
+	for _, h := range mf.config.History {
+		if !h.EmptyLayer {
+			history++
+		}
+	}
+	return len(mf.layers), len(mf.config.RootFS.DiffIDs), history
+}
+
+// alignImages checks that the layers, diffIDs and history entries of every
+// image line up and repairs them if repair is set.
+func (m *state) alignImages(repair bool) error {
+	for i := range m.manifest.Manifest {
+		mf := &m.manifest.Manifest[i]
+		if mf.config == nil {
+			return fmt.Errorf("Image %s has a corrupt image configuration file.", mf.Name())
+		}
+		layers, diffIDs, history := alignment(mf)
+		if layers == diffIDs && diffIDs == history {
+			continue
+		}
+		if !repair {
+			return fmt.Errorf("Image %s has %d layers, %d diffIDs and %d history entries for layers which do not line up.", mf.Name(), layers, diffIDs, history)
+		}
+		err := m.repairImage(mf)
+		if err != nil {
+			return err
+		}
+		m.warn(fmt.Sprintf("Repaired image %s which had %d layers, %d diffIDs and %d history entries for layers.", mf.Name(), layers, diffIDs, history))
+	}
+	return nil
+}
+
+// layerDiffID returns the diffID of the layer.tar file.
+func layerDiffID(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// repairImage makes the diffIDs and history entries of an image match its
+// layers.
+func (m *state) repairImage(mf *Manifest) error {
+	rootfs := &mf.config.RootFS
+	if len(rootfs.DiffIDs) != len(mf.layers) {
+		rootfs.DiffIDs = make([]digest.Digest, len(mf.layers))
+		for j, l := range mf.layers {
+			diffID, err := layerDiffID(filepath.Join(m.tmpDir, l))
+			if err != nil {
+				return err
+			}
+			rootfs.DiffIDs[j] = digest.Digest(diffID)
+		}
+	}
+
+	history := mf.config.History
+	_, _, n := alignment(mf)
+	for j := len(history) - 1; j >= 0 && n > len(mf.layers); j-- {
+		if !history[j].EmptyLayer {
+			history[j].EmptyLayer = true
+			n--
+		}
+	}
+	for ; n < len(mf.layers); n++ {
+		history = append(history, History{History: imagespec.History{
+			CreatedBy: "go-docker-melt: history entry added by repair",
+		}})
+	}
+	mf.config.History = history
+	return nil
+}
@@ -0,0 +1,117 @@
+package melt
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+)
+
+// Annotations describe an image the way OCI manifests do. docker save has no
+// place for them, so they are kept in the Annotations field of the entries of
+// manifest.json. Annotations of OCI inputs are read from their manifests and
+// the descriptors pointing to them.
+
+// WithAnnotations adds annotations to every melted image, replacing existing
+// annotations with the same keys.
+func WithAnnotations(annotations map[string]string) Option {
+	return func(o *options) {
+		if o.annotations == nil {
+			o.annotations = make(map[string]string)
+		}
+		for k, v := range annotations {
+			o.annotations[k] = v
+		}
+	}
+}
+
+// imageAnnotations merges the annotations of the descriptor of an image
+// manifest and of the manifest itself. The names of the image are left out,
+// they end up in RepoTags.
+func imageAnnotations(descriptor map[string]string, manifest map[string]string) map[string]string {
+	a := make(map[string]string)
+	for k, v := range descriptor {
+		if k != annotationImageName && k != annotationRefName {
+			a[k] = v
+		}
+	}
+	for k, v := range manifest {
+		a[k] = v
+	}
+	if len(a) == 0 {
+		return nil
+	}
+	return a
+}
+
+// passAnnotations adds the annotations of the images of an OCI image layout
+// to the entries of the manifest.json stored next to it that refer to the same
+// configuration.
+func passAnnotations(manifestFile string, images []ociImage) error {
+	byConfig := make(map[string]map[string]string)
+	for _, img := range images {
+		if img.annotations == nil {
+			continue
+		}
+		config, err := blobPath(img.manifest.Config.Digest)
+		if err != nil {
+			return err
+		}
+		byConfig[config] = img.annotations
+	}
+	if len(byConfig) == 0 {
+		return nil
+	}
+
+	buf, err := readMetadata(manifestFile, MaxManifestSize)
+	if err != nil {
+		return err
+	}
+	var r RawManifest
+	err = r.Parse(buf)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i, mf := range r.Manifest {
+		a, ok := byConfig[mf.ConfigHash]
+		if !ok {
+			continue
+		}
+		err = r.mergeAnnotations(i, a)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return ioutil.WriteFile(manifestFile, r.rawJSON, 0666)
+}
+
+// mergeAnnotations adds annotations to the Annotations field of the image at
+// pos.
+func (r *RawManifest) mergeAnnotations(pos int, annotations map[string]string) error {
+	var entries []map[string]json.RawMessage
+	err := json.Unmarshal(r.rawJSON, &entries)
+	if err != nil {
+		return err
+	}
+	if pos >= len(entries) || entries[pos] == nil {
+		return errors.New("Corrupt manifest file.")
+	}
+	merged := make(map[string]string)
+	if raw, ok := entries[pos]["Annotations"]; ok {
+		err = json.Unmarshal(raw, &merged)
+		if err != nil {
+			return errors.New("Corrupt manifest file.")
+		}
+		if merged == nil {
+			merged = make(map[string]string)
+		}
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	return r.setField(pos, "Annotations", merged)
+}
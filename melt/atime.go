@@ -0,0 +1,113 @@
+package melt
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WithPreserveAtime carries the access times of files through melting. They
+// are taken from the PAX headers of the source layers, restored on the
+// unpacked files before they are packed and written into the PAX headers of
+// the melted layers. It is off by default since every melted layer is written
+// once more. With WithClampMtime access times are clamped as well.
+func WithPreserveAtime() Option {
+	return func(o *options) {
+		o.preserveAtime = true
+	}
+}
+
+// atimeClamp returns the time access times are clamped to or the zero time.
+func (m *state) atimeClamp() time.Time {
+	if m.opts.clamp {
+		return m.opts.clampMtime
+	}
+	return time.Time{}
+}
+
+// wantAtime returns the access time meta asks for, clamped to clamp unless it
+// is the zero time.
+func wantAtime(meta fileMeta, clamp time.Time) time.Time {
+	if !clamp.IsZero() && meta.atime.After(clamp) {
+		return clamp
+	}
+	return meta.atime
+}
+
+// restoreAtimes sets the access times of dir and everything below it to the
+// ones recorded in exp without touching their modification times. Files
+// without a recorded access time are left alone.
+func restoreAtimes(dir string, exp map[string]fileMeta, clamp time.Time) error {
+	return walkTree(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		meta, ok := exp[filepath.ToSlash(rel)]
+		if !ok || meta.atime.IsZero() {
+			return nil
+		}
+		return latime(p, wantAtime(meta, clamp))
+	})
+}
+
+// writeAtimes rewrites the layer tarball file with the access times recorded
+// in exp in its PAX headers and returns its new checksum.
+func writeAtimes(file string, exp map[string]fileMeta, clamp time.Time) ([]byte, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	tmp := file + ".atime"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	h := sha256.New()
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(io.MultiWriter(out, h))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		meta, ok := exp[path.Clean(strings.TrimLeft(hdr.Name, "/"))]
+		if ok && !meta.atime.IsZero() && hdr.Typeflag != tar.TypeLink {
+			hdr.AccessTime = wantAtime(meta, clamp)
+			hdr.Format = tar.FormatPAX
+		}
+		err = tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	err = tw.Close()
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), os.Rename(tmp, file)
+}
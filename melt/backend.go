@@ -0,0 +1,220 @@
+package melt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Backend selects how the files of a layer are merged into the layer it is
+// melted into.
+type Backend string
+
+const (
+	// BackendAuto uses rsync if it is installed and the go backend
+	// otherwise. With WithSandbox it always uses rsync.
+	BackendAuto Backend = "auto"
+	// BackendRsync runs rsync for every merged layer.
+	BackendRsync Backend = "rsync"
+	// BackendGo merges layers in process by renaming their files, which
+	// needs no external tools and copies no data. It cannot run in the
+	// sandbox of WithSandbox.
+	BackendGo Backend = "go"
+	// BackendUmoci merges layers with the layer extraction of the umoci
+	// library, a second implementation of the image specification to
+	// cross-check the other backends against. It is only available on
+	// Linux and cannot run in the sandbox of WithSandbox.
+	BackendUmoci Backend = "umoci"
+)
+
+// WithBackend sets how layers are merged. It defaults to BackendAuto.
+func WithBackend(b Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
+// errLabelsLost is returned by merge backends that merged all files but could
+// not set their SELinux labels.
+var errLabelsLost = errors.New("SELinux labels could not be preserved.")
+
+// mergeBackend merges unpacked layers. Whiteouts and entries changing their
+// type are applied to into before merge is called, so merge only has to move
+// everything except whiteout files from from into into, replacing files of
+// the same path and updating the metadata of directories. from is removed by
+// the caller afterwards.
+type mergeBackend interface {
+	merge(m *state, from string, into string) error
+}
+
+// mergeBackends are the backends WithBackend can choose from. Backends only
+// available on some systems add themselves.
+var mergeBackends = map[Backend]mergeBackend{
+	BackendRsync: rsyncBackend{},
+	BackendGo:    goBackend{},
+}
+
+// selectBackend returns the backend the options ask for.
+func selectBackend(opts *options) (Backend, error) {
+	switch opts.backend {
+	case "", BackendAuto:
+		if _, err := exec.LookPath("rsync"); err != nil && !opts.sandbox {
+			return BackendGo, nil
+		}
+		return BackendRsync, nil
+	case BackendGo, BackendUmoci:
+		if opts.sandbox {
+			return "", fmt.Errorf("The %s backend cannot run in the sandbox.", opts.backend)
+		}
+		if mergeBackends[opts.backend] == nil {
+			return "", fmt.Errorf("The %s backend is not available on this system.", opts.backend)
+		}
+	case BackendRsync:
+	default:
+		return "", fmt.Errorf("Unknown merge backend %s.", opts.backend)
+	}
+	return opts.backend, nil
+}
+
+// rsyncBackend merges layers with rsync.
+type rsyncBackend struct{}
+
+func (rsyncBackend) merge(m *state, from string, into string) error {
+	cmd := rsyncLayer(m.ctx, from, into)
+	err := m.sandbox(cmd)
+	if err != nil {
+		return err
+	}
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		m.opts.logger.Debug("rsync", "from", from, "to", into, "output", string(out))
+	}
+	if err != nil && selinuxOnlyFailure(err, out) {
+		return errLabelsLost
+	}
+	if err != nil {
+		return fmt.Errorf("rsync %s: %v: %s", from, err, out)
+	}
+	return nil
+}
+
+// goBackend merges layers in process. Files are renamed into place, so they
+// keep all their metadata and hardlinks between files of the same layer are
+// kept. Directories are created or updated to the owner, mode, extended
+// attributes and modification time they have in from, like rsync -a does.
+type goBackend struct{}
+
+func (goBackend) merge(m *state, from string, into string) error {
+	var dirs []string
+	err := walkTree(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(into, rel)
+		if !info.IsDir() {
+			return os.Rename(path, target)
+		}
+		dirs = append(dirs, rel)
+		err = os.Mkdir(target, 0700)
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directories are updated children first, so that moving their
+	// children does not change their times again.
+	lost := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		src, dst := filepath.Join(from, dirs[i]), filepath.Join(into, dirs[i])
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		labels, err := copyDirMeta(dst, src, info)
+		if err != nil {
+			return err
+		}
+		lost = lost || labels
+	}
+	if lost {
+		return errLabelsLost
+	}
+	return nil
+}
+
+// copyDirMeta gives the directory dst the owner, mode, extended attributes
+// and modification time of the directory src described by info. It reports
+// whether the SELinux label could not be set, which is not an error.
+func copyDirMeta(dst string, src string, info os.FileInfo) (bool, error) {
+	if uid, gid, ok := fileOwner(info); ok {
+		err := os.Lchown(dst, uid, gid)
+		if err != nil {
+			return false, err
+		}
+	}
+	err := os.Chmod(dst, info.Mode())
+	if err != nil {
+		return false, err
+	}
+	lost := false
+	if xattrSupported {
+		names, err := llistxattr(src)
+		if err != nil {
+			return false, err
+		}
+		keep := make(map[string]bool)
+		for _, name := range names {
+			keep[name] = true
+			v, err := lgetxattr(src, name)
+			if err != nil {
+				return false, err
+			}
+			err = lsetxattr(dst, name, v)
+			if err != nil && name == selinuxXattr {
+				lost = true
+				err = nil
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+		old, err := llistxattr(dst)
+		if err != nil {
+			return false, err
+		}
+		for _, name := range old {
+			if keep[name] {
+				continue
+			}
+			err = lremovexattr(dst, name)
+			if err != nil && name == selinuxXattr {
+				lost = true
+				err = nil
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return lost, lutimes(dst, info.ModTime())
+}
@@ -0,0 +1,148 @@
+package melt
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/opencontainers/umoci/oci/layer"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	mergeBackends[BackendUmoci] = umociBackend{}
+}
+
+// umociBackend merges layers with the layer extraction of umoci. The files of
+// from are streamed as a layer tarball into umoci, which applies it to into
+// like it unpacks the layers of an image into a runtime bundle. Hardlinks
+// between files of from are kept as hardlinks.
+type umociBackend struct{}
+
+func (umociBackend) merge(m *state, from string, into string) error {
+	info, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := m.streamLayerTree(from, w)
+		w.CloseWithError(err)
+		done <- err
+	}()
+	opts := &layer.UnpackOptions{
+		MapOptions: layer.MapOptions{Rootless: os.Geteuid() != 0},
+	}
+	err = layer.UnpackLayer(into, r, opts)
+	r.Close()
+	if werr := <-done; err == nil && werr != nil && werr != io.ErrClosedPipe {
+		err = werr
+	}
+	if err != nil {
+		return fmt.Errorf("umoci %s: %v", from, err)
+	}
+	// umoci does not touch the root of the layer.
+	lost, err := copyDirMeta(into, from, info)
+	if err != nil {
+		return err
+	}
+	if lost {
+		return errLabelsLost
+	}
+	return nil
+}
+
+// streamLayerTree writes the files of the unpacked layer dir to w as a layer
+// tarball, leaving out whiteout files and sockets, which layers cannot hold.
+func (m *state) streamLayerTree(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	links := make(map[inode]string)
+	err := walkTree(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		target := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.Format = tar.FormatPAX
+		if ino, nlink := fileInode(info); nlink > 1 && info.Mode().IsRegular() {
+			if first, ok := links[ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[ino] = name
+			}
+		}
+		if xattrSupported {
+			names, err := llistxattr(p)
+			if err != nil {
+				return err
+			}
+			for _, n := range names {
+				v, err := lgetxattr(p, n)
+				if err != nil {
+					return err
+				}
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = make(map[string]string)
+				}
+				hdr.PAXRecords[xattrRecord+n] = string(v)
+			}
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,37 @@
+package melt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Whiteouts are removed from the layer they were melted into. A hostile layer
+// could place a symlink on the way to a whiteout target that points outside of
+// the layer, so the target is resolved without leaving it.
+
+func escapeError(rel string) error {
+	return fmt.Errorf("Whiteout for %s points outside of the layer.", rel)
+}
+
+// removeBeneathPath removes rel from root after checking that its parent
+// resolves to a directory inside of root. It is used where openat2(2) is not
+// available and is racy against concurrent changes to root.
+func removeBeneathPath(root string, rel string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Dir(rel)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if parent != realRoot && !strings.HasPrefix(parent, realRoot+string(filepath.Separator)) {
+		return escapeError(rel)
+	}
+	return os.RemoveAll(filepath.Join(parent, filepath.Base(rel)))
+}
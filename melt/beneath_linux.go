@@ -0,0 +1,137 @@
+package melt
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// beneath confines path resolution to the directory it starts at. Absolute
+// symlinks and .. leaving it as well as magic links in /proc fail.
+const beneath = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS
+
+// removeBeneath removes rel and everything below it from root. Every path is
+// resolved with openat2(2) relative to a directory fd, so nothing outside of
+// root can be removed. Kernels before 5.6 lack openat2(2) and fall back to
+// removeBeneathPath.
+func removeBeneath(root string, rel string) error {
+	rootfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootfd)
+
+	parent, name := filepath.Split(rel)
+	if parent == "" {
+		parent = "."
+	}
+	dirfd, err := unix.Openat2(rootfd, parent, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: beneath,
+	})
+	switch err {
+	case nil:
+	case unix.ENOSYS, unix.EPERM:
+		// Seccomp profiles unaware of openat2(2) often fail it
+		// with EPERM instead of ENOSYS.
+		return removeBeneathPath(root, rel)
+	case unix.ENOENT:
+		return nil
+	case unix.EXDEV:
+		return escapeError(rel)
+	default:
+		return &os.PathError{Op: "openat2", Path: filepath.Join(root, parent), Err: err}
+	}
+	defer unix.Close(dirfd)
+	return removeAllAt(dirfd, name)
+}
+
+// removeAllAt removes name and everything below it from the directory dirfd
+// without following symlinks. Directories still to be emptied are kept on a
+// stack of paths relative to dirfd instead of recursing into them, so only one
+// of them is open at a time and deep trees exhaust neither the stack nor the
+// file descriptors.
+func removeAllAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	switch err {
+	case nil, unix.ENOENT:
+		return nil
+	case unix.EISDIR:
+	default:
+		return &os.PathError{Op: "unlinkat", Path: name, Err: err}
+	}
+
+	stack := []string{name}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		subdirs, err := emptyDirAt(dirfd, p)
+		if err != nil {
+			return err
+		}
+		if len(subdirs) > 0 {
+			// p is removed once it is visited again with all
+			// its subdirectories gone.
+			stack = append(stack, subdirs...)
+			continue
+		}
+		stack = stack[:len(stack)-1]
+
+		parentfd := dirfd
+		parent, base := path.Split(p)
+		if parent != "" {
+			parentfd, err = openDirAt(dirfd, parent)
+			if err != nil {
+				return err
+			}
+		}
+		err = unix.Unlinkat(parentfd, base, unix.AT_REMOVEDIR)
+		if parentfd != dirfd {
+			unix.Close(parentfd)
+		}
+		if err != nil && err != unix.ENOENT {
+			return &os.PathError{Op: "unlinkat", Path: p, Err: err}
+		}
+	}
+	return nil
+}
+
+// openDirAt opens the directory p relative to dirfd. No symlink is followed
+// and p cannot leave dirfd.
+func openDirAt(dirfd int, p string) (int, error) {
+	fd, err := unix.Openat2(dirfd, p, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Resolve: beneath | unix.RESOLVE_NO_SYMLINKS,
+	})
+	if err != nil {
+		return -1, &os.PathError{Op: "openat2", Path: p, Err: err}
+	}
+	return fd, nil
+}
+
+// emptyDirAt removes everything but directories from the directory p
+// relative to dirfd and returns the paths of the directories it holds.
+func emptyDirAt(dirfd int, p string) ([]string, error) {
+	fd, err := openDirAt(dirfd, p)
+	if err != nil {
+		return nil, err
+	}
+	dir := os.NewFile(uintptr(fd), p)
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var subdirs []string
+	for _, n := range names {
+		err = unix.Unlinkat(fd, n, 0)
+		switch err {
+		case nil, unix.ENOENT:
+		case unix.EISDIR:
+			subdirs = append(subdirs, path.Join(p, n))
+		default:
+			return nil, &os.PathError{Op: "unlinkat", Path: path.Join(p, n), Err: err}
+		}
+	}
+	return subdirs, nil
+}
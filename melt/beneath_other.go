@@ -0,0 +1,8 @@
+//go:build !linux
+
+package melt
+
+// removeBeneath removes rel and everything below it from root.
+func removeBeneath(root string, rel string) error {
+	return removeBeneathPath(root, rel)
+}
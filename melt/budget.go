@@ -0,0 +1,91 @@
+package melt
+
+import (
+	"sync"
+)
+
+// WithMemoryBudget limits the combined size of the layers the workers
+// unpack, prepare and pack at the same time to bytes, so that many workers on
+// a machine with many cores do not exhaust its memory. A layer larger than the
+// budget is processed on its own. The size of a melted layer is the size of
+// the layers melted into it. Zero, the default, only limits the number of
+// workers.
+func WithMemoryBudget(bytes int64) Option {
+	return func(o *options) {
+		o.memoryBudget = bytes
+	}
+}
+
+// budget is a semaphore weighted by bytes. Waiters are served in order so
+// that large layers are not starved by small ones.
+type budget struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	total int64
+	free  int64
+	// next and serving implement a ticket lock.
+	next    uint64
+	serving uint64
+}
+
+func newBudget(total int64) *budget {
+	b := &budget{total: total, free: total}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// acquire blocks until n bytes are available and takes them. It returns the
+// number of bytes taken, which is capped at the total.
+func (b *budget) acquire(n int64) int64 {
+	if n > b.total {
+		n = b.total
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ticket := b.next
+	b.next++
+	for ticket != b.serving || b.free < n {
+		b.cond.Wait()
+	}
+	b.serving++
+	b.free -= n
+	b.cond.Broadcast()
+	return n
+}
+
+func (b *budget) release(n int64) {
+	b.mutex.Lock()
+	b.free += n
+	b.mutex.Unlock()
+	b.cond.Broadcast()
+}
+
+// budgeted returns a job running fn once size bytes of the memory budget are
+// available.
+func (m *state) budgeted(size int64, fn func() error) func() error {
+	if m.opts.memoryBudget <= 0 {
+		return fn
+	}
+	return func() error {
+		m.budgetOnce.Do(func() {
+			m.budget = newBudget(m.opts.memoryBudget)
+		})
+		n := m.budget.acquire(size)
+		defer m.budget.release(n)
+		return fn()
+	}
+}
+
+// meltedSize returns the combined size of the layers melted into the root
+// layer.
+func (m *state) meltedSize(root string) int64 {
+	sources := m.sources[root]
+	if len(sources) == 0 {
+		return m.sizes[root]
+	}
+	var size int64
+	for _, l := range sources {
+		size += m.sizes[l]
+	}
+	return size
+}
@@ -0,0 +1,279 @@
+package melt
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The runtime bundle output is a directory that runc, crun and other OCI
+// runtimes run directly: the root filesystem of the melted image in rootfs/
+// and a config.json generated from its configuration. The config.json follows
+// the one runc spec generates, only the process is taken from the image.
+
+// FormatRuntimeBundle writes an OCI runtime bundle for the melted image into
+// the output directory.
+const FormatRuntimeBundle OutputFormat = "runtime-bundle"
+
+const ociRuntimeVersion = "1.0.2"
+
+type bundleSpec struct {
+	OCIVersion string        `json:"ociVersion"`
+	Process    bundleProcess `json:"process"`
+	Root       bundleRoot    `json:"root"`
+	Hostname   string        `json:"hostname,omitempty"`
+	Mounts     []bundleMount `json:"mounts"`
+	Linux      bundleLinux   `json:"linux"`
+}
+
+type bundleProcess struct {
+	Terminal        bool               `json:"terminal"`
+	User            bundleUser         `json:"user"`
+	Args            []string           `json:"args"`
+	Env             []string           `json:"env,omitempty"`
+	Cwd             string             `json:"cwd"`
+	Capabilities    bundleCapabilities `json:"capabilities"`
+	Rlimits         []bundleRlimit     `json:"rlimits"`
+	NoNewPrivileges bool               `json:"noNewPrivileges"`
+}
+
+type bundleUser struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+type bundleCapabilities struct {
+	Bounding  []string `json:"bounding"`
+	Effective []string `json:"effective"`
+	Permitted []string `json:"permitted"`
+	Ambient   []string `json:"ambient"`
+}
+
+type bundleRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type bundleRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type bundleMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type bundleNamespace struct {
+	Type string `json:"type"`
+}
+
+type bundleLinux struct {
+	Namespaces    []bundleNamespace `json:"namespaces"`
+	MaskedPaths   []string          `json:"maskedPaths"`
+	ReadonlyPaths []string          `json:"readonlyPaths"`
+}
+
+// bundleCaps are the capabilities runc spec grants.
+var bundleCaps = []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_BIND_SERVICE"}
+
+// bundleConfig returns the runtime configuration of an image with the
+// configuration cfg and its root filesystem in rootfs.
+func bundleConfig(cfg *GenericConfig, rootfs string) (*bundleSpec, error) {
+	if cfg == nil {
+		cfg = &GenericConfig{}
+	}
+	args := append(append([]string{}, cfg.Entrypoint...), cfg.Cmd...)
+	if len(args) == 0 {
+		return nil, errors.New("The image has neither an entrypoint nor a command to run.")
+	}
+	user, err := lookupUser(rootfs, cfg.User)
+	if err != nil {
+		return nil, err
+	}
+	cwd := cfg.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+	env := cfg.Env
+	if !hasPath(env) {
+		env = append([]string{defaultPath}, env...)
+	}
+	hostname := cfg.Hostname
+	if hostname == "" {
+		hostname = "melted"
+	}
+	return &bundleSpec{
+		OCIVersion: ociRuntimeVersion,
+		Process: bundleProcess{
+			User: user,
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+			Capabilities: bundleCapabilities{
+				Bounding:  bundleCaps,
+				Effective: bundleCaps,
+				Permitted: bundleCaps,
+				Ambient:   bundleCaps,
+			},
+			Rlimits:         []bundleRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Root:     bundleRoot{Path: "rootfs"},
+		Hostname: hostname,
+		Mounts: []bundleMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Linux: bundleLinux{
+			Namespaces: []bundleNamespace{{"pid"}, {"network"}, {"ipc"}, {"uts"}, {"mount"}, {"cgroup"}},
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys",
+				"/proc/latency_stats", "/proc/timer_list", "/proc/timer_stats",
+				"/proc/sched_debug", "/sys/firmware", "/proc/scsi",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+			},
+		},
+	}, nil
+}
+
+// hasPath reports whether env sets PATH.
+func hasPath(env []string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupEntry returns the fields of the entry of the colon separated database
+// file, like /etc/passwd, whose name or ID is key.
+func lookupEntry(file string, key string) ([]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), ":")
+		if len(fields) >= 3 && (fields[0] == key || fields[2] == key) {
+			return fields, nil
+		}
+	}
+	return nil, s.Err()
+}
+
+// lookupUser resolves the user of an image configuration, user, uid,
+// user:group or uid:gid, in the passwd and group files of rootfs. Numeric IDs
+// do not need an entry.
+func lookupUser(rootfs string, spec string) (bundleUser, error) {
+	var u bundleUser
+	if spec == "" {
+		return u, nil
+	}
+	name, group := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+	entry, err := lookupEntry(filepath.Join(rootfs, "etc", "passwd"), name)
+	if err != nil {
+		return u, err
+	}
+	switch {
+	case entry != nil && len(entry) >= 4:
+		uid, err1 := strconv.ParseUint(entry[2], 10, 32)
+		gid, err2 := strconv.ParseUint(entry[3], 10, 32)
+		if err1 != nil || err2 != nil {
+			return u, fmt.Errorf("Invalid passwd entry for user %s.", name)
+		}
+		u.UID, u.GID = uint32(uid), uint32(gid)
+	default:
+		uid, err := strconv.ParseUint(name, 10, 32)
+		if err != nil {
+			return u, fmt.Errorf("Unknown user %s.", name)
+		}
+		u.UID = uint32(uid)
+	}
+	if group == "" {
+		return u, nil
+	}
+	entry, err = lookupEntry(filepath.Join(rootfs, "etc", "group"), group)
+	if err != nil {
+		return u, err
+	}
+	gid := group
+	if entry != nil {
+		gid = entry[2]
+	}
+	n, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return u, fmt.Errorf("Unknown group %s.", group)
+	}
+	u.GID = uint32(n)
+	return u, nil
+}
+
+// writeBundle writes an OCI runtime bundle for the melted image into the
+// directory output, which has to be empty or missing. This only works for a
+// single image which was melted into a single uncompressed layer.
+func (m *state) writeBundle(output string) error {
+	mf, err := m.singleLayerImage()
+	if err != nil {
+		return err
+	}
+	if m.compresses(CompressLayers) {
+		return fmt.Errorf("The %s output format needs uncompressed layers.", FormatRuntimeBundle)
+	}
+	err = os.MkdirAll(output, 0755)
+	if err != nil {
+		return err
+	}
+	err = IsEmptyDir(output)
+	if err == nil {
+		return fmt.Errorf("Directory %s is not empty.", output)
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	rootfs := filepath.Join(output, "rootfs")
+	err = os.Mkdir(rootfs, 0755)
+	if err != nil {
+		return err
+	}
+	err = extractTar(filepath.Join(m.tmpDir, mf.layers[0]), rootfs)
+	if err != nil {
+		return err
+	}
+	spec, err := bundleConfig(mf.config.Config, rootfs)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(output, "config.json"), append(buf, '\n'), 0644)
+}
@@ -0,0 +1,165 @@
+package melt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// WithCanonicalJSON writes manifest.json and the image configurations the way
+// docker save does instead of patching the changed fields into the original
+// files. Configurations are compact with sorted top-level keys, manifest.json
+// is compact with the fields in the order Docker writes them and ends with a
+// newline. Fields unknown to go-docker-melt are preserved.
+func WithCanonicalJSON() Option {
+	return func(o *options) {
+		o.canonical = true
+	}
+}
+
+// JSONStyle selects how manifest.json and the image configurations are
+// formatted.
+type JSONStyle string
+
+const (
+	// JSONKeep keeps the formatting of the original files.
+	JSONKeep JSONStyle = ""
+	// JSONCompact removes all insignificant whitespace.
+	JSONCompact JSONStyle = "compact"
+	// JSONPretty indents the files with tabs for humans to read.
+	JSONPretty JSONStyle = "pretty"
+)
+
+// WithJSONStyle sets how manifest.json and the image configurations are
+// formatted. It applies after WithCanonicalJSON. Image configurations are
+// named after the digest of their formatted content.
+func WithJSONStyle(s JSONStyle) Option {
+	return func(o *options) {
+		o.jsonStyle = s
+	}
+}
+
+// formatJSON formats the metadata file buf according to the JSON style.
+func (m *state) formatJSON(buf []byte) ([]byte, error) {
+	var b bytes.Buffer
+	var err error
+	switch m.opts.jsonStyle {
+	case JSONCompact:
+		err = json.Compact(&b, buf)
+	case JSONPretty:
+		err = json.Indent(&b, bytes.TrimSpace(buf), "", "\t")
+		b.WriteByte('\n')
+	default:
+		return buf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// manifestOrder is the order of the fields of a manifest.json entry written
+// by docker save. Other fields follow sorted by name.
+var manifestOrder = []string{"Config", "RepoTags", "Layers", "Parent", "LayerSources"}
+
+// canonicalJSON encodes the image configuration from its decoded history,
+// rootfs and creation time and the remaining fields of the original.
+func (img *ImageConfig) canonicalJSON() ([]byte, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(img.rawJSON, &fields)
+	if err != nil {
+		return nil, err
+	}
+	set := func(key string, v interface{}) error {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fields[key] = buf
+		return nil
+	}
+	err = set("history", img.History)
+	if err != nil {
+		return nil, err
+	}
+	err = set("rootfs", img.RootFS)
+	if err != nil {
+		return nil, err
+	}
+	if img.Created != nil {
+		err = set("created", img.Created)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Maps are encoded with sorted keys just like Docker encodes
+	// configurations.
+	return json.Marshal(fields)
+}
+
+// canonicalJSON encodes manifest.json from the decoded layers and tags of
+// every image and the remaining fields of the original.
+func (r *RawManifest) canonicalJSON() ([]byte, error) {
+	var entries []map[string]json.RawMessage
+	err := json.Unmarshal(r.rawJSON, &entries)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != len(r.Manifest) {
+		return nil, errors.New("Corrupt manifest file.")
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('[')
+	for i, e := range entries {
+		mf := &r.Manifest[i]
+		for key, v := range map[string]interface{}{"Config": mf.ConfigHash, "RepoTags": mf.RepoTags, "Layers": mf.layers} {
+			e[key], err = json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var keys []string
+		known := make(map[string]bool)
+		for _, k := range manifestOrder {
+			known[k] = true
+			if _, ok := e[k]; ok {
+				keys = append(keys, k)
+			}
+		}
+		var rest []string
+		for k := range e {
+			if !known[k] {
+				rest = append(rest, k)
+			}
+		}
+		sort.Strings(rest)
+		keys = append(keys, rest...)
+
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('{')
+		for j, k := range keys {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			name, err := json.Marshal(k)
+			if err != nil {
+				return nil, err
+			}
+			value, err := json.Marshal(e[k])
+			if err != nil {
+				return nil, err
+			}
+			b.Write(name)
+			b.WriteByte(':')
+			b.Write(value)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteString("]\n")
+	return b.Bytes(), nil
+}
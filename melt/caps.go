@@ -0,0 +1,128 @@
+package melt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// CheckMode selects what happens when a verification finds a problem.
+type CheckMode string
+
+const (
+	// CheckOff skips the verification.
+	CheckOff CheckMode = "off"
+	// CheckWarn emits a warning for every problem.
+	CheckWarn CheckMode = "warn"
+	// CheckFail fails the melt.
+	CheckFail CheckMode = "fail"
+)
+
+const capabilityXattr = "security.capability"
+
+// WithCapabilityCheck sets how file capabilities lost while melting are
+// reported. It defaults to CheckWarn, WithStrict turns it into CheckFail.
+func WithCapabilityCheck(mode CheckMode) Option {
+	return func(o *options) {
+		o.capsCheck = mode
+	}
+}
+
+// capability returns the security.capability xattr of path or nil if it has
+// none.
+func capability(path string) ([]byte, error) {
+	v, err := lgetxattr(path, capabilityXattr)
+	if pe, ok := err.(*os.PathError); ok {
+		switch pe.Err {
+		case syscall.ENODATA, syscall.ENOTSUP:
+			return nil, nil
+		}
+	}
+	return v, err
+}
+
+// recordCapabilities records the capabilities of all files in the layer
+// unpacked in from as expected after it is melted into the layer unpacked in
+// into. The first time into is seen its own files are recorded as well. Files
+// of later layers replace the expectations of earlier ones.
+func (m *state) recordCapabilities(into string, from string) error {
+	if m.opts.capsCheck == CheckOff {
+		return nil
+	}
+	if m.caps == nil {
+		m.caps = make(map[string]map[string][]byte)
+	}
+	exp, ok := m.caps[into]
+	if !ok {
+		exp = make(map[string][]byte)
+		m.caps[into] = exp
+		err := recordDir(exp, into)
+		if err != nil {
+			return err
+		}
+	}
+	return recordDir(exp, from)
+}
+
+func recordDir(exp map[string][]byte, dir string) error {
+	return walkTree(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		v, err := capability(path)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			delete(exp, rel)
+		} else {
+			exp[rel] = v
+		}
+		return nil
+	})
+}
+
+// verifyCapabilities checks that every file of a melted layer carries the
+// capabilities it had in the topmost source layer containing it. Files that
+// were removed by whiteouts are skipped.
+func (m *state) verifyCapabilities() error {
+	var lost []string
+	for dir, exp := range m.caps {
+		for rel, want := range exp {
+			path := filepath.Join(dir, rel)
+			_, err := os.Lstat(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			have, err := capability(path)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(have, want) {
+				lost = append(lost, rel)
+			}
+		}
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+
+	sort.Strings(lost)
+	if m.opts.capsCheck == CheckFail || m.opts.strict {
+		return fmt.Errorf("File capabilities were lost while melting: %v", lost)
+	}
+	for _, rel := range lost {
+		m.warn(fmt.Sprintf("File capabilities of %s were lost while melting.", rel))
+	}
+	return nil
+}
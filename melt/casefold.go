@@ -0,0 +1,216 @@
+package melt
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CasePolicy selects how paths of an image that differ only by case are
+// treated. Extracting such an image on a case-insensitive file system silently
+// merges them into one.
+type CasePolicy string
+
+const (
+	// CaseOff skips the check.
+	CaseOff CasePolicy = "off"
+	// CaseWarn emits a warning for every group of colliding paths.
+	CaseWarn CasePolicy = "warn"
+	// CaseFail fails the melt.
+	CaseFail CasePolicy = "fail"
+	// CaseRename keeps the first path of every group in byte order and
+	// appends ~1, ~2 and so on to the others. Only paths in melted layers
+	// can be renamed, the others are reported as with CaseWarn.
+	CaseRename CasePolicy = "rename"
+)
+
+// WithCaseCollisions sets how paths that differ only by case are treated. It
+// defaults to CaseWarn.
+func WithCaseCollisions(p CasePolicy) Option {
+	return func(o *options) {
+		o.casePolicy = p
+	}
+}
+
+// rootEntry describes a path of the root file system of an image.
+type rootEntry struct {
+	// dir is the directory of the melted layer the path comes from or
+	// empty if its layer is not unpacked.
+	dir string
+	// link is the target of symlinks.
+	link string
+}
+
+// layerPaths returns every path in layer. Melted layers are still unpacked,
+// the paths of all other layers are read from their layer.tar.
+func (m *state) layerPaths(layer string) ([]overlayEntry[rootEntry], error) {
+	var entries []overlayEntry[rootEntry]
+	dir := filepath.Join(m.tmpDir, unpackDir(layer))
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		err := walkTree(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+			e := rootEntry{dir: dir}
+			if info.Mode()&os.ModeSymlink != 0 {
+				e.link, err = os.Readlink(p)
+				if err != nil {
+					return err
+				}
+			}
+			entries = append(entries, overlayEntry[rootEntry]{name: filepath.ToSlash(rel), dir: info.IsDir(), value: e})
+			return nil
+		})
+		return entries, err
+	}
+
+	f, err := os.Open(filepath.Join(m.tmpDir, layer))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Go's reader folds GNU long names and PAX records into the
+		// headers they belong to but returns global PAX headers as
+		// entries of their own.
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name != "" {
+			e := rootEntry{}
+			if hdr.Typeflag == tar.TypeSymlink {
+				e.link = hdr.Linkname
+			}
+			entries = append(entries, overlayEntry[rootEntry]{name: name, dir: hdr.Typeflag == tar.TypeDir, value: e})
+		}
+	}
+}
+
+// imagePaths returns every path of the root file system of an image.
+func (m *state) imagePaths(layers []string) (map[string]rootEntry, error) {
+	root := newOverlay[rootEntry]()
+	for _, l := range layers {
+		entries, err := m.layerPaths(l)
+		if err != nil {
+			return nil, err
+		}
+		root.apply(entries)
+	}
+	return root.files, nil
+}
+
+// caseCollisions returns the groups of paths in files that differ only by
+// case. Paths below colliding directories are covered by the group of the
+// directory.
+func caseCollisions(files map[string]rootEntry) [][]string {
+	groups := make(map[string][]string)
+	for p := range files {
+		k := strings.ToLower(p)
+		groups[k] = append(groups[k], p)
+	}
+	var collisions [][]string
+	for k, paths := range groups {
+		if len(paths) < 2 {
+			continue
+		}
+		covered := false
+		for parent := path.Dir(k); parent != "."; parent = path.Dir(parent) {
+			if len(groups[parent]) > 1 {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		sort.Strings(paths)
+		collisions = append(collisions, paths)
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i][0] < collisions[j][0]
+	})
+	return collisions
+}
+
+// checkCaseCollisions looks for paths differing only by case in the root file
+// system of every image and handles them according to the case policy.
+func (m *state) checkCaseCollisions() error {
+	if m.opts.casePolicy == CaseOff {
+		return nil
+	}
+	renamed := make(map[string]bool)
+	var failed []string
+	for _, mf := range m.manifest.Manifest {
+		files, err := m.imagePaths(mf.layers)
+		if err != nil {
+			return err
+		}
+		for _, paths := range caseCollisions(files) {
+			if m.opts.casePolicy == CaseRename {
+				paths, err = m.renameCollisions(paths, files, renamed)
+				if err != nil {
+					return err
+				}
+				if len(paths) < 2 {
+					continue
+				}
+			}
+			msg := fmt.Sprintf("Paths differ only by case in image %s: %s", mf.Name(), strings.Join(paths, ", "))
+			if m.opts.casePolicy == CaseFail {
+				failed = append(failed, msg)
+				continue
+			}
+			m.warn(msg)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// renameCollisions renames all but the first of paths if they are part of a
+// melted layer. It returns the paths that still collide.
+func (m *state) renameCollisions(paths []string, files map[string]rootEntry, renamed map[string]bool) ([]string, error) {
+	left := []string{paths[0]}
+	for i, p := range paths[1:] {
+		dir := files[p].dir
+		if dir == "" {
+			left = append(left, p)
+			continue
+		}
+		from := filepath.Join(dir, p)
+		to := fmt.Sprintf("%s~%d", from, i+1)
+		if renamed[from] {
+			continue
+		}
+		err := os.Rename(from, to)
+		if err != nil {
+			return nil, err
+		}
+		renamed[from] = true
+		m.opts.logger.Info("renamed colliding path", "from", p, "to", fmt.Sprintf("%s~%d", p, i+1))
+	}
+	return left, nil
+}
@@ -0,0 +1,276 @@
+package melt
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Finding is a problem Check found in an archive.
+type Finding struct {
+	// Image and Layer are empty for problems of the archive as a whole.
+	Image   string
+	Layer   string
+	Message string
+	// Error is set for problems that keep the archive from being loaded
+	// or melted correctly. Other findings are warnings.
+	Error bool
+}
+
+// Check validates the structure of the docker save archive or OCI image
+// layout referenced by input without melting it. It verifies the digests of
+// blobs and configurations, that every referenced file exists, that layers,
+// diffIDs and history line up, that every layer is a tarball matching its
+// diffID that can be applied and that whiteouts make sense. The input passes
+// if none of the returned findings is an error. An error is only returned if
+// the input cannot be read at all.
+func (ml *Melter) Check(ctx context.Context, input string) ([]Finding, error) {
+	m, err := ml.newState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.cleanup()
+
+	err = m.unpackImageRetry(input, m.tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	return m.check()
+}
+
+// hexDigest matches the hex encoding of a sha256 digest.
+var hexDigest = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// fileDigest returns the hex encoded sha256 digest of file.
+func fileDigest(file string) (string, error) {
+	d, err := layerDiffID(file)
+	return strings.TrimPrefix(d, "sha256:"), err
+}
+
+// checker collects the findings of a check.
+type checker struct {
+	findings []Finding
+}
+
+func (c *checker) add(image string, layer string, isError bool, format string, args ...interface{}) {
+	c.findings = append(c.findings, Finding{Image: image, Layer: layer, Message: fmt.Sprintf(format, args...), Error: isError})
+}
+
+func (m *state) check() ([]Finding, error) {
+	var c checker
+
+	// Blobs of an OCI image layout are named after their digest. They
+	// are verified before layers get decompressed.
+	blobs := filepath.Join(m.tmpDir, "blobs", "sha256")
+	files, err := os.ReadDir(blobs)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.Type().IsRegular() || !hexDigest.MatchString(f.Name()) {
+			continue
+		}
+		d, err := fileDigest(filepath.Join(blobs, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if d != f.Name() {
+			c.add("", "", true, "Blob blobs/sha256/%s has digest sha256:%s.", f.Name(), d)
+		}
+	}
+
+	err = m.convertOCILayout()
+	if err == nil {
+		err = m.manifest.Load(filepath.Join(m.tmpDir, "manifest.json"))
+	}
+	if err != nil {
+		c.add("", "", true, "%v", err)
+		return c.findings, nil
+	}
+	if len(m.manifest.Manifest) == 0 {
+		c.add("", "", true, "The archive contains no images.")
+	}
+
+	layers := make(map[string]*layerCheck)
+	for i := range m.manifest.Manifest {
+		if err := m.ctx.Err(); err != nil {
+			return nil, err
+		}
+		m.checkImage(&c, &m.manifest.Manifest[i], layers)
+	}
+	return c.findings, nil
+}
+
+// layerCheck holds what checking a layer found out about it.
+type layerCheck struct {
+	ok      bool
+	diffID  string
+	entries []*tar.Header
+}
+
+// checkLayer verifies that layer is a tarball that can be applied and returns
+// its entries.
+func (m *state) checkLayer(c *checker, image string, layer string) *layerCheck {
+	lc := &layerCheck{}
+	err := m.materialize(layer)
+	if err == nil {
+		err = m.decompressLayer(layer)
+	}
+	if err != nil {
+		c.add(image, layer, true, "%v", err)
+		return lc
+	}
+	file := filepath.Join(m.tmpDir, layer)
+	lc.diffID, err = layerDiffID(file)
+	if err != nil {
+		c.add(image, layer, true, "%v", err)
+		return lc
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		c.add(image, layer, true, "%v", err)
+		return lc
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.add(image, layer, true, "The layer is not a valid tarball: %v", err)
+			return lc
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		clean := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if escapes(clean) {
+			c.add(image, layer, true, "Entry %s escapes the root filesystem.", hdr.Name)
+			continue
+		}
+		if !materializable(hdr.Typeflag) {
+			c.add(image, layer, false, "Entry %s has type %q, which cannot be extracted.", hdr.Name, hdr.Typeflag)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			target := path.Clean(strings.TrimLeft(hdr.Linkname, "/"))
+			if escapes(target) {
+				c.add(image, layer, true, "Hardlink %s points outside the root filesystem.", hdr.Name)
+			}
+		}
+		hdr.Name = clean
+		lc.entries = append(lc.entries, hdr)
+	}
+	lc.ok = true
+	return lc
+}
+
+// checkImage verifies the configuration of mf and its layers. The result of
+// checking a layer is kept in layers since layers are shared between images.
+func (m *state) checkImage(c *checker, mf *Manifest, layers map[string]*layerCheck) {
+	name := mf.Name()
+	if mf.ConfigHash == "" {
+		c.add(name, "", true, "The image has no configuration.")
+		return
+	}
+	err := m.materialize(mf.ConfigHash)
+	var config ImageConfig
+	if err == nil {
+		err = config.Load(filepath.Join(m.tmpDir, mf.ConfigHash))
+	}
+	if err != nil {
+		c.add(name, "", true, "Cannot read configuration %s: %v", mf.ConfigHash, err)
+		return
+	}
+	mf.config = &config
+	want := strings.TrimPrefix(strings.TrimSuffix(path.Base(mf.ConfigHash), ".json"), "sha256:")
+	if hexDigest.MatchString(want) {
+		d, err := fileDigest(filepath.Join(m.tmpDir, mf.ConfigHash))
+		if err != nil {
+			c.add(name, "", true, "%v", err)
+		} else if d != want {
+			c.add(name, "", true, "Configuration %s has digest sha256:%s.", mf.ConfigHash, d)
+		}
+	}
+	nl, nd, nh := alignment(mf)
+	if nl != nd || (nh != nl && len(config.History) > 0) {
+		c.add(name, "", true, "%d layers, %d diffIDs and %d history entries for layers do not line up.", nl, nd, nh)
+	}
+
+	// present holds the paths of the root filesystem built by the
+	// layers checked so far.
+	present := make(map[string]bool)
+	for j, l := range mf.layers {
+		lc, ok := layers[l]
+		if !ok {
+			lc = m.checkLayer(c, name, l)
+			layers[l] = lc
+		}
+		if !lc.ok {
+			continue
+		}
+		if j < nd && string(config.RootFS.DiffIDs[j]) != lc.diffID {
+			c.add(name, l, true, "The layer has diffID %s but the configuration expects %s.", lc.diffID, config.RootFS.DiffIDs[j])
+		}
+		checkWhiteouts(c, name, l, lc.entries, present, j == 0)
+	}
+}
+
+// checkWhiteouts checks that the whiteouts of a layer remove something from
+// the layers below it, whose paths are in present, and applies the layer to
+// present.
+func checkWhiteouts(c *checker, image string, layer string, entries []*tar.Header, present map[string]bool, bottom bool) {
+	added := make(map[string]bool, len(entries))
+	for _, hdr := range entries {
+		if !strings.HasPrefix(path.Base(hdr.Name), ".wh.") {
+			added[hdr.Name] = true
+		}
+	}
+	for _, hdr := range entries {
+		dir, base := path.Split(hdr.Name)
+		if !strings.HasPrefix(base, ".wh.") {
+			continue
+		}
+		if base == ".wh..wh..opq" {
+			prefix := dir
+			for p := range present {
+				if strings.HasPrefix(p, prefix) {
+					delete(present, p)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh..wh.") {
+			c.add(image, layer, false, "Entry %s is an AUFS metadata file.", hdr.Name)
+			continue
+		}
+		target := path.Join(dir, strings.TrimPrefix(base, ".wh."))
+		if added[target] {
+			c.add(image, layer, false, "%s is both removed and added by the layer.", target)
+		}
+		removed := present[target]
+		delete(present, target)
+		for p := range present {
+			if strings.HasPrefix(p, target+"/") {
+				delete(present, p)
+				removed = true
+			}
+		}
+		if bottom {
+			c.add(image, layer, false, "Whiteout %s in the bottom layer has nothing to remove.", hdr.Name)
+		} else if !removed {
+			c.add(image, layer, false, "Whiteout %s removes nothing.", hdr.Name)
+		}
+	}
+	for name := range added {
+		present[name] = true
+	}
+}
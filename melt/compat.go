@@ -0,0 +1,295 @@
+package melt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Archives written by tools other than docker save differ in a few ways:
+//
+//   - kaniko and other tools based on go-containerregistry store gzip
+//     compressed layers and name the configuration after its digest.
+//   - buildx with --output type=docker adds an OCI image layout, index.json
+//     and the manifests in blobs/, next to manifest.json.
+//   - buildx with --output type=oci only writes the OCI image layout.
+//
+// The functions below turn all of them into a plain docker save archive
+// before anything is melted.
+
+// Annotations of the images in OCI image layouts.
+const (
+	annotationImageName     = "io.containerd.image.name"
+	annotationRefName       = "org.opencontainers.image.ref.name"
+	annotationReferenceType = "vnd.docker.reference.type"
+)
+
+// blobPath returns the path of the blob with the given digest in an OCI image
+// layout.
+func blobPath(digest v1.Hash) (string, error) {
+	if digest.Algorithm == "" || digest.Hex == "" {
+		return "", fmt.Errorf("Invalid digest %q in OCI image layout.", digest.String())
+	}
+	return cleanMember(path.Join("blobs", digest.Algorithm, digest.Hex))
+}
+
+// ociImage is an image found in an OCI image layout.
+type ociImage struct {
+	name        string
+	manifest    v1.Manifest
+	annotations map[string]string
+}
+
+// readOCILayout returns the images of the OCI image layout in dir and the
+// blobs holding indexes and manifests.
+func readOCILayout(dir string) ([]ociImage, []string, error) {
+	var images []ociImage
+	var meta []string
+	var walk func(file string, name string, depth int) error
+	walk = func(file string, name string, depth int) error {
+		if depth > 4 {
+			return fmt.Errorf("Image indexes in %s are nested too deeply.", file)
+		}
+		buf, err := readMetadata(filepath.Join(dir, file), MaxManifestSize)
+		if err != nil {
+			return err
+		}
+		var index v1.IndexManifest
+		err = json.Unmarshal(buf, &index)
+		if err != nil {
+			return fmt.Errorf("Corrupt OCI image index %s: %v", file, err)
+		}
+		for _, d := range index.Manifests {
+			// buildx stores attestations as manifests of
+			// their own.
+			if d.Annotations[annotationReferenceType] != "" {
+				continue
+			}
+			n := name
+			if v := d.Annotations[annotationImageName]; v != "" {
+				n = v
+			} else if v := d.Annotations[annotationRefName]; n == "" && strings.ContainsAny(v, ":/") {
+				n = v
+			}
+			blob, err := blobPath(d.Digest)
+			if err != nil {
+				return err
+			}
+			meta = append(meta, blob)
+			switch d.MediaType {
+			case types.OCIImageIndex, types.DockerManifestList:
+				err = walk(blob, n, depth+1)
+				if err != nil {
+					return err
+				}
+			case types.OCIManifestSchema1, types.DockerManifestSchema2:
+				buf, err := readMetadata(filepath.Join(dir, blob), MaxManifestSize)
+				if err != nil {
+					return err
+				}
+				img := ociImage{name: n}
+				err = json.Unmarshal(buf, &img.manifest)
+				if err != nil {
+					return fmt.Errorf("Corrupt OCI image manifest %s: %v", blob, err)
+				}
+				img.annotations = imageAnnotations(d.Annotations, img.manifest.Annotations)
+				images = append(images, img)
+			default:
+				return fmt.Errorf("Unsupported media type %s in OCI image layout.", d.MediaType)
+			}
+		}
+		return nil
+	}
+	err := walk("index.json", "", 0)
+	return images, meta, err
+}
+
+// convertOCILayout writes manifest.json for an archive holding only an OCI
+// image layout and removes the layout's index and manifests, which do not
+// describe the melted images, from any archive that has one.
+func (m *state) convertOCILayout() error {
+	_, err := os.Stat(filepath.Join(m.tmpDir, "index.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	images, meta, err := readOCILayout(m.tmpDir)
+	if err != nil {
+		return err
+	}
+
+	manifestFile := filepath.Join(m.tmpDir, "manifest.json")
+	_, err = os.Stat(manifestFile)
+	if os.IsNotExist(err) {
+		type entry struct {
+			Config      string
+			RepoTags    []string `json:",omitempty"`
+			Layers      []string
+			Annotations map[string]string `json:",omitempty"`
+		}
+		entries := make([]entry, 0, len(images))
+		tagged := make(map[string]bool)
+		for _, img := range images {
+			var e entry
+			e.Config, err = blobPath(img.manifest.Config.Digest)
+			if err != nil {
+				return err
+			}
+			for _, l := range img.manifest.Layers {
+				blob, err := blobPath(l.Digest)
+				if err != nil {
+					return err
+				}
+				e.Layers = append(e.Layers, blob)
+			}
+			// A tag can only refer to one image, the others
+			// of a multi-platform image stay untagged.
+			if img.name != "" && !tagged[img.name] {
+				e.RepoTags = []string{img.name}
+				tagged[img.name] = true
+			} else if img.name != "" {
+				m.warn(fmt.Sprintf("Image %s has more than one platform, only the first one is tagged.", img.name))
+			}
+			e.Annotations = img.annotations
+			entries = append(entries, e)
+		}
+		buf, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(manifestFile, buf, 0666)
+		if err != nil {
+			return err
+		}
+		m.opts.logger.Info("converted OCI image layout", "images", len(entries))
+	} else if err != nil {
+		return err
+	} else {
+		err = passAnnotations(manifestFile, images)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range append(meta, "index.json", "oci-layout") {
+		err = os.Remove(filepath.Join(m.tmpDir, f))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Magic numbers of the compression formats layers are stored in.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressLayer replaces the layer by its uncompressed tarball if it is
+// compressed. The name is kept since docker load detects compression by
+// content.
+func (m *state) decompressLayer(layer string) error {
+	p := filepath.Join(m.tmpDir, layer)
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	magic = magic[:n]
+	if bytes.HasPrefix(magic, zstdMagic) {
+		return fmt.Errorf("Layer %s is compressed with zstd, which is not supported.", layer)
+	}
+	if !bytes.HasPrefix(magic, gzipMagic) {
+		return nil
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("Layer %s: %v", layer, err)
+	}
+	out, err := ioutil.TempFile(filepath.Dir(p), ".go-docker-melt_")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, zr)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("Layer %s: %v", layer, err)
+	}
+	m.opts.logger.Debug("decompressed layer", "layer", layer)
+	return os.Rename(out.Name(), p)
+}
+
+// pruneLayerSources drops the entries of the LayerSources field of the image
+// at pos whose diffIDs are no longer part of the image. docker save records
+// foreign layers there; a foreign layer that was melted is stored in the
+// archive like any other layer.
+func (r *RawManifest) pruneLayerSources(pos int, diffIDs []string) error {
+	var entries []map[string]json.RawMessage
+	err := json.Unmarshal(r.rawJSON, &entries)
+	if err != nil {
+		return err
+	}
+	if pos >= len(entries) || entries[pos] == nil {
+		return errors.New("Corrupt manifest file.")
+	}
+	raw, ok := entries[pos]["LayerSources"]
+	if !ok {
+		return nil
+	}
+	var sources map[string]json.RawMessage
+	err = json.Unmarshal(raw, &sources)
+	if err != nil || sources == nil {
+		return err
+	}
+	keep := make(map[string]bool, len(diffIDs))
+	for _, d := range diffIDs {
+		keep[d] = true
+	}
+	pruned := false
+	for d := range sources {
+		if !keep[d] {
+			delete(sources, d)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	if len(sources) == 0 {
+		delete(entries[pos], "LayerSources")
+	} else {
+		entries[pos]["LayerSources"], err = json.Marshal(sources)
+		if err != nil {
+			return err
+		}
+	}
+	r.rawJSON, err = json.Marshal(entries)
+	return err
+}
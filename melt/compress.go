@@ -0,0 +1,90 @@
+package melt
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Compression selects which outputs are written gzip compressed. docker load
+// detects compression by content, so compressed layers keep their names.
+type Compression string
+
+const (
+	// CompressNone writes layers and the archive uncompressed like docker
+	// save does.
+	CompressNone Compression = ""
+	// CompressLayers compresses melted layers.
+	CompressLayers Compression = "layers"
+	// CompressArchive compresses the docker-archive output as a whole.
+	CompressArchive Compression = "archive"
+	// CompressAll compresses melted layers and the archive.
+	CompressAll Compression = "all"
+)
+
+// WithCompression compresses the outputs selected by c at the given gzip
+// level, from gzip.BestSpeed to gzip.BestCompression. The level is also used
+// for the compressed sizes of WithSizeReport. zstd is not supported.
+func WithCompression(c Compression, level int) Option {
+	return func(o *options) {
+		o.compression = c
+		o.compressionLevel = level
+	}
+}
+
+// compresses reports whether the outputs selected by c are compressed.
+func (m *state) compresses(c Compression) bool {
+	return m.opts.compression == c || m.opts.compression == CompressAll
+}
+
+// gzipTo compresses everything read from r into w.
+func gzipTo(w io.Writer, r io.Reader, level int) error {
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(zw, r)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// gzipFile compresses file into dst, which may be file itself.
+func gzipFile(file string, dst string, level int) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(dst), ".go-docker-melt_")
+	if err != nil {
+		return err
+	}
+	err = gzipTo(out, in, level)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("Compressing %s: %v", file, err)
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// packCompressed writes the image in tmpDir to the docker-archive path as a
+// gzip compressed tarball.
+func (m *state) packCompressed(path string) error {
+	archive := filepath.Join(m.workDir, archiveFile)
+	defer os.Remove(archive)
+	err := packImage(m.ctx, m.tmpDir, "docker-archive:"+archive)
+	if err != nil {
+		return err
+	}
+	return gzipFile(archive, path, m.opts.compressionLevel)
+}
@@ -0,0 +1,141 @@
+package melt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is the number of symlinks followed while resolving a path before
+// it is considered a loop. It matches the limit of Linux.
+const maxSymlinks = 40
+
+var errSymlinkLoop = errors.New("too many levels of symbolic links")
+
+// WithDereference replaces the symlinks in melted layers by copies of the
+// files they point to. Symlinks are resolved within the layer with absolute
+// targets relative to its root. Symlinks whose path or one of its parents
+// matches one of the exclude patterns are kept, as are symlinks to
+// directories and symlinks whose target is not part of the layer.
+func WithDereference(exclude ...string) Option {
+	return func(o *options) {
+		o.dereference = true
+		o.dereferenceExclude = append(o.dereferenceExclude, exclude...)
+	}
+}
+
+// resolveIn resolves rel within the root file system root and returns the
+// resolved path relative to root. Neither absolute targets nor .. can leave
+// root.
+func resolveIn(root string, rel string) (string, error) {
+	return resolveWith(rel, func(p string) (string, bool, error) {
+		fi, err := os.Lstat(filepath.Join(root, p))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return "", false, err
+		}
+		target, err := os.Readlink(filepath.Join(root, p))
+		return target, true, err
+	})
+}
+
+// resolveWith resolves rel like resolveIn in the root file system in which
+// lookup returns the target of the symlink p, reports whether p is a symlink
+// and fails if p does not exist.
+func resolveWith(rel string, lookup func(p string) (string, bool, error)) (string, error) {
+	links := 0
+	resolved := ""
+	rest := strings.Split(rel, "/")
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			if resolved == "." || resolved == "/" {
+				resolved = ""
+			}
+			continue
+		}
+		next := path.Join(resolved, c)
+		target, link, err := lookup(next)
+		if err != nil {
+			return "", err
+		}
+		if !link {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", errSymlinkLoop
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
+
+// excluded reports whether rel or one of its parents matches a pattern.
+func excluded(rel string, patterns []string) bool {
+	for p := rel; p != "." && p != "/"; p = filepath.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dereference replaces the symlinks below dir by copies of their targets.
+func (m *state) dereference(dir string) error {
+	var files int
+	err := walkTree(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if excluded(rel, m.opts.dereferenceExclude) {
+			return nil
+		}
+		target, err := resolveIn(dir, rel)
+		if err != nil {
+			if os.IsNotExist(err) || err == errSymlinkLoop {
+				return m.degrade(fmt.Sprintf("Cannot dereference %s: %v.", rel, err))
+			}
+			return err
+		}
+		src := filepath.Join(dir, target)
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return m.degrade(fmt.Sprintf("Cannot dereference %s: %s is not a regular file.", rel, target))
+		}
+		err = replaceWithCopy(p, src, fi)
+		if err != nil {
+			return err
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.opts.logger.Debug("dereferenced symlinks", "layer", dir, "files", files)
+	return nil
+}
@@ -0,0 +1,110 @@
+package melt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WithExpectedDigest makes the melt fail before anything is melted unless its
+// input is what digest, like sha256:abc..., names: either the docker save
+// tarball itself or the configuration of its only image. A tarball is hashed
+// while it is copied into the work directory and only the copy is extracted,
+// so it cannot be swapped in between. If the digest names the configuration,
+// every layer is checked against the diffID the configuration records for it.
+func WithExpectedDigest(digest string) Option {
+	return func(o *options) {
+		o.expectDigest = digest
+	}
+}
+
+// isDigest reports whether s is a sha256 digest with its algorithm.
+func isDigest(s string) bool {
+	return strings.HasPrefix(s, "sha256:") && hexDigest.MatchString(strings.TrimPrefix(s, "sha256:"))
+}
+
+// unpackInput unpacks the image input into tmpDir. Tarballs are hashed on the
+// way if their digest is expected and signatures are checked if a signature
+// policy is set.
+func (m *state) unpackInput(input string) error {
+	if m.opts.signatures != nil {
+		return m.unpackSigned(input)
+	}
+	if name, ref := ParseReference(input); name == "docker-archive" && m.opts.expectDigest != "" {
+		return m.unpackVerified(ref)
+	}
+	return m.unpackImageRetry(input, m.tmpDir)
+}
+
+// unpackVerified copies the docker save tarball file into the work directory,
+// hashing it on the way, and extracts the copy.
+func (m *state) unpackVerified(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	archive := filepath.Join(m.workDir, streamFile)
+	err = m.spool(f, archive)
+	if err != nil {
+		return err
+	}
+	err = extractTar(archive, m.tmpDir)
+	if err != nil {
+		return err
+	}
+	return os.Remove(archive)
+}
+
+// verifyInput checks the unpacked input against WithExpectedDigest unless
+// the tarball it was read from matched already. It runs once the
+// configurations are loaded and the layers decompressed.
+func (m *state) verifyInput() error {
+	want := m.opts.expectDigest
+	if want == "" || m.inputDigest == want {
+		return nil
+	}
+	if m.inputDigest != "" && len(m.manifest.Manifest) != 1 {
+		return fmt.Errorf("The input has digest %s instead of %s.", m.inputDigest, want)
+	}
+	if len(m.manifest.Manifest) != 1 {
+		return fmt.Errorf("The input holds %d images but the digest %s can only verify the configuration of one.", len(m.manifest.Manifest), want)
+	}
+	mf := m.manifest.Manifest[0]
+	if mf.config == nil {
+		return fmt.Errorf("Image %s has no configuration to verify against %s.", mf.Name(), want)
+	}
+	got, err := layerDiffID(filepath.Join(m.tmpDir, mf.ConfigHash))
+	if err != nil {
+		return err
+	}
+	if got != want {
+		if m.inputDigest != "" {
+			return fmt.Errorf("The input has digest %s and its configuration %s instead of %s.", m.inputDigest, got, want)
+		}
+		return fmt.Errorf("The configuration of %s has digest %s instead of %s.", mf.Name(), got, want)
+	}
+
+	// The configuration only vouches for the layers through their
+	// diffIDs.
+	diffIDs := mf.config.RootFS.DiffIDs
+	if len(diffIDs) != len(mf.layers) {
+		return fmt.Errorf("Image %s has %d layers but its configuration %d diffIDs.", mf.Name(), len(mf.layers), len(diffIDs))
+	}
+	jobs := make([]func() error, 0, len(mf.layers))
+	for i, l := range mf.layers {
+		l, expected := l, diffIDs[i]
+		jobs = append(jobs, func() error {
+			got, err := layerDiffID(filepath.Join(m.tmpDir, l))
+			if err != nil {
+				return err
+			}
+			if got != string(expected) {
+				return fmt.Errorf("Layer %s has diffID %s but the configuration expects %s.", l, got, expected)
+			}
+			return nil
+		})
+	}
+	return m.runWorkers(jobs)
+}
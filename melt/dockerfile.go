@@ -0,0 +1,183 @@
+package melt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OutputFormat selects what a melt produces.
+type OutputFormat string
+
+const (
+	// FormatDockerArchive stores the melted image through the transport
+	// of the output reference.
+	FormatDockerArchive OutputFormat = "docker-archive"
+	// FormatDockerfile writes the root filesystem of the melted image as
+	// rootfs.tar into the output directory together with a Dockerfile
+	// that rebuilds the image from it.
+	FormatDockerfile OutputFormat = "dockerfile"
+	// FormatLayer writes the single layer of the melted image to the
+	// output path, for tools that take a root filesystem tarball.
+	FormatLayer OutputFormat = "layer"
+)
+
+// dockerfileQuoter escapes the characters that keep their meaning inside the
+// double quotes of a Dockerfile instruction.
+var dockerfileQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+
+// quote formats s as a double quoted word of a Dockerfile instruction.
+// Unlike Go string literals, Dockerfiles know no escapes besides those of the
+// backslash, the double quote and the dollar sign of variable expansion.
+func quote(s string) string {
+	return `"` + dockerfileQuoter.Replace(s) + `"`
+}
+
+// jsonArray formats a Dockerfile instruction argument in exec form.
+func jsonArray(args []string) string {
+	buf, _ := json.Marshal(args)
+	return string(buf)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dockerfile generates a Dockerfile that adds rootfs.tar to an empty image
+// and restores the runtime configuration of cfg.
+func dockerfile(cfg *GenericConfig) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "FROM scratch\n")
+	fmt.Fprintf(&b, "ADD rootfs.tar /\n")
+	if cfg == nil {
+		return b.Bytes()
+	}
+
+	for _, env := range cfg.Env {
+		k, v := env, ""
+		if i := strings.IndexByte(env, '='); i >= 0 {
+			k, v = env[:i], env[i+1:]
+		}
+		fmt.Fprintf(&b, "ENV %s=%s\n", k, quote(v))
+	}
+
+	var labels []string
+	for k := range cfg.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, k := range labels {
+		fmt.Fprintf(&b, "LABEL %s=%s\n", quote(k), quote(cfg.Labels[k]))
+	}
+
+	for _, port := range sortedKeys(cfg.ExposedPorts) {
+		fmt.Fprintf(&b, "EXPOSE %s\n", port)
+	}
+	if len(cfg.Volumes) > 0 {
+		fmt.Fprintf(&b, "VOLUME %s\n", jsonArray(sortedKeys(cfg.Volumes)))
+	}
+	if cfg.User != "" {
+		fmt.Fprintf(&b, "USER %s\n", cfg.User)
+	}
+	if cfg.WorkingDir != "" {
+		fmt.Fprintf(&b, "WORKDIR %s\n", cfg.WorkingDir)
+	}
+	if cfg.StopSignal != "" {
+		fmt.Fprintf(&b, "STOPSIGNAL %s\n", cfg.StopSignal)
+	}
+	for _, trigger := range cfg.OnBuild {
+		fmt.Fprintf(&b, "ONBUILD %s\n", trigger)
+	}
+	// ENTRYPOINT resets CMD so it has to come first.
+	if len(cfg.Entrypoint) > 0 {
+		fmt.Fprintf(&b, "ENTRYPOINT %s\n", jsonArray(cfg.Entrypoint))
+	}
+	if len(cfg.Cmd) > 0 {
+		fmt.Fprintf(&b, "CMD %s\n", jsonArray(cfg.Cmd))
+	}
+	return b.Bytes()
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// singleLayerImage returns the image of output formats that need a single
+// image melted into a single layer.
+func (m *state) singleLayerImage() (*Manifest, error) {
+	if len(m.manifest.Manifest) != 1 {
+		return nil, fmt.Errorf("The %s output format needs an input with a single image.", m.opts.format)
+	}
+	mf := &m.manifest.Manifest[0]
+	if len(mf.layers) != 1 {
+		return nil, fmt.Errorf("The %s output format needs an image melted into a single layer.", m.opts.format)
+	}
+	return mf, nil
+}
+
+// writeLayer writes the layer of the melted image to the file output and
+// reports it with a LayerExported event.
+func (m *state) writeLayer(output string) error {
+	mf, err := m.singleLayerImage()
+	if err != nil {
+		return err
+	}
+	err = copyFile(filepath.Join(m.tmpDir, mf.layers[0]), output)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	diffID := mf.config.RootFS.DiffIDs[0]
+	m.opts.logger.Info("exported layer", "file", output, "diffID", diffID)
+	m.emit(Event{Type: LayerExported, Layer: output, Bytes: fi.Size(), DiffID: string(diffID)})
+	return nil
+}
+
+// writeDockerfile writes rootfs.tar and a Dockerfile for the melted image into
+// the directory output. This only works for a single image which was melted
+// into a single layer.
+func (m *state) writeDockerfile(output string) error {
+	mf, err := m.singleLayerImage()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(output, 0755)
+	if err != nil {
+		return err
+	}
+	err = copyFile(filepath.Join(m.tmpDir, mf.layers[0]), filepath.Join(output, "rootfs.tar"))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(output, "Dockerfile"), dockerfile(mf.config.Config), 0644)
+}
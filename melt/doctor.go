@@ -0,0 +1,159 @@
+package melt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Diagnosis is the outcome of checking one requirement of melts on the host.
+type Diagnosis struct {
+	// Check names what was checked.
+	Check string
+	// OK is set if the requirement is met. Detail tells what was found.
+	OK     bool
+	Detail string
+	// Affects lists the features that do not work unless the requirement
+	// is met. It is empty if melting does not work at all without it.
+	Affects string
+}
+
+// tools are the external commands melts may run, with the arguments that
+// print their version and the features needing them.
+var tools = []struct {
+	name    string
+	args    []string
+	affects string
+}{
+	{"rsync", []string{"--version"}, "-backend=rsync, -sandbox, -test-cmd"},
+	{"cp", nil, "the dir: transport"},
+	{"skopeo", []string{"--version"}, "docker://, oci: and the other skopeo transports, -verify-signature, stats -remote"},
+	{"ctr", []string{"--version"}, "-import-containerd"},
+	{"aws", []string{"--version"}, "the s3:// transport"},
+	{"gcloud", []string{"version"}, "the gs:// transport"},
+	{"ssh", []string{"-V"}, "the ssh:// transport"},
+	{"cosign", []string{"version"}, "-verify-signature cosign, -sign-key"},
+	{"notation", []string{"version"}, "-verify-signature notation"},
+}
+
+// toolTimeout bounds how long a tool may take to print its version.
+const toolTimeout = 10 * time.Second
+
+// Diagnose checks the tools and kernel features melts rely on and the
+// temporary directory tmpDir, the system one if it is empty. need is the
+// number of bytes the melts to run need in tmpDir, or 0 if unknown.
+func Diagnose(ctx context.Context, tmpDir string, need uint64) []Diagnosis {
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	var ds []Diagnosis
+	for _, t := range tools {
+		ds = append(ds, diagnoseTool(ctx, t.name, t.args, t.affects))
+	}
+	if b, err := selectBackend(&options{}); err == nil {
+		ds = append(ds, Diagnosis{Check: "backend", OK: true, Detail: fmt.Sprintf("-backend=auto merges layers with %s", b)})
+	}
+	ds = append(ds, Diagnosis{Check: "tar", OK: true, Detail: "archives are read and written in process, no tar command is needed"})
+
+	d := Diagnosis{Check: "root", Affects: "preserving owners, device files and file capabilities in melted layers"}
+	switch uid := os.Geteuid(); {
+	case uid == 0:
+		d.OK, d.Detail = true, "running as root"
+	case uid < 0:
+		d.Detail = "file owners are not supported on " + runtime.GOOS
+	default:
+		d.Detail = fmt.Sprintf("running as uid %d", uid)
+	}
+	ds = append(ds, d)
+
+	d = Diagnosis{Check: "overlay", Affects: "-test-cmd", OK: true, Detail: "overlay mounts are supported"}
+	if err := overlaySupported(); err != nil {
+		d.OK, d.Detail = false, err.Error()
+	}
+	ds = append(ds, d)
+
+	d = Diagnosis{Check: "landlock", Affects: "-sandbox"}
+	if abi, err := landlockABI(); err != nil {
+		d.Detail = err.Error()
+	} else {
+		d.OK, d.Detail = true, fmt.Sprintf("ABI version %d", abi)
+	}
+	ds = append(ds, d)
+
+	ds = append(ds, diagnoseXattrs(tmpDir))
+
+	d = Diagnosis{Check: "free space", Detail: tmpDir}
+	free, err := freeSpace(tmpDir)
+	switch {
+	case err != nil:
+		d.OK, d.Detail = need == 0, err.Error()
+	case need > free:
+		d.Detail = fmt.Sprintf("%d bytes free in %s, about %d needed", free, tmpDir, need)
+	default:
+		d.OK, d.Detail = true, fmt.Sprintf("%d bytes free in %s", free, tmpDir)
+	}
+	ds = append(ds, d)
+	return ds
+}
+
+// diagnoseTool checks whether the command name can be found and asks it for
+// its version with args.
+func diagnoseTool(ctx context.Context, name string, args []string, affects string) Diagnosis {
+	d := Diagnosis{Check: name, Affects: affects}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		d.Detail = "not found in $PATH"
+		return d
+	}
+	d.OK, d.Detail = true, path
+	if args == nil {
+		return d
+	}
+	ctx, cancel := context.WithTimeout(ctx, toolTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, args...).CombinedOutput()
+	if err != nil {
+		d.OK = false
+		d.Detail = fmt.Sprintf("%s: %v", path, err)
+		return d
+	}
+	if version := strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]); version != "" {
+		d.Detail += ": " + version
+	}
+	return d
+}
+
+// diagnoseXattrs checks whether extended attributes can be set on files in
+// dir, where melted layers are assembled.
+func diagnoseXattrs(dir string) Diagnosis {
+	d := Diagnosis{Check: "xattrs", Affects: "extended attributes, file capabilities and SELinux labels in melted layers"}
+	if !xattrSupported {
+		d.Detail = "extended attributes are not supported on " + runtime.GOOS
+		return d
+	}
+	f, err := ioutil.TempFile(dir, ".go-docker-melt-doctor-")
+	if err != nil {
+		d.Detail = err.Error()
+		return d
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	namespaces := []string{"user"}
+	if os.Geteuid() == 0 {
+		namespaces = append(namespaces, "trusted")
+	}
+	for _, ns := range namespaces {
+		err = lsetxattr(f.Name(), ns+".go-docker-melt", []byte("1"))
+		if err != nil {
+			d.Detail = fmt.Sprintf("cannot set %s.* attributes in %s: %v", ns, dir, err)
+			return d
+		}
+	}
+	d.OK, d.Detail = true, fmt.Sprintf("%s.* attributes can be set in %s", strings.Join(namespaces, ".*, "), dir)
+	return d
+}
@@ -0,0 +1,102 @@
+package melt
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// FileRef names a file in a layer.
+type FileRef struct {
+	Layer string
+	Path  string
+}
+
+// Duplicate describes a file content that is stored in more than one layer.
+type Duplicate struct {
+	Digest string
+	Size   int64
+	Files  []FileRef
+	// Wasted is the number of bytes that would be saved by storing the
+	// content in a single layer.
+	Wasted int64
+}
+
+// Duplicates reports regular files with identical content that appear in
+// more than one layer of the docker save tarball archive. The result is
+// sorted by the number of wasted bytes, largest first. Files that are
+// duplicated within a single layer are not reported since they cannot be
+// deduplicated by melting.
+func Duplicates(archive string) ([]Duplicate, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files := make(map[string][]FileRef)
+	sizes := make(map[string]int64)
+	outer := tar.NewReader(f)
+	for {
+		hdr, err := outer.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(hdr.Name, "/layer.tar") {
+			continue
+		}
+
+		inner := tar.NewReader(outer)
+		for {
+			ihdr, err := inner.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if ihdr.Typeflag != tar.TypeReg || ihdr.Size == 0 {
+				continue
+			}
+			h := sha256.New()
+			_, err = io.Copy(h, inner)
+			if err != nil {
+				return nil, err
+			}
+			digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+			files[digest] = append(files[digest], FileRef{Layer: hdr.Name, Path: ihdr.Name})
+			sizes[digest] = ihdr.Size
+		}
+	}
+
+	var dups []Duplicate
+	for digest, refs := range files {
+		layers := make(map[string]bool)
+		for _, ref := range refs {
+			layers[ref.Layer] = true
+		}
+		if len(layers) < 2 {
+			continue
+		}
+		dups = append(dups, Duplicate{
+			Digest: digest,
+			Size:   sizes[digest],
+			Files:  refs,
+			Wasted: sizes[digest] * int64(len(layers)-1),
+		})
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		if dups[i].Wasted != dups[j].Wasted {
+			return dups[i].Wasted > dups[j].Wasted
+		}
+		return dups[i].Digest < dups[j].Digest
+	})
+	return dups, nil
+}
@@ -0,0 +1,87 @@
+package melt
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// IsEmptyTar reports whether the tarball file has no entries. A file without
+// any content counts as empty as well.
+func IsEmptyTar(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = tar.NewReader(f).Next()
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// dropEmptyLayers removes layers without any entries, as some tools create
+// them for commits that only change the configuration. They are removed from
+// the layers and diffIDs of every image and their history entries are turned
+// into empty_layer entries, so they are neither unpacked nor melted.
+func (m *state) dropEmptyLayers() error {
+	empty := make(map[string]bool)
+	for i := range m.manifest.Manifest {
+		mf := &m.manifest.Manifest[i]
+		if mf.config == nil {
+			continue
+		}
+		history := mf.config.History
+		hist := 0
+		for j := 0; j < len(mf.layers); j++ {
+			l := mf.layers[j]
+			isEmpty, ok := empty[l]
+			if !ok {
+				var err error
+				isEmpty, err = IsEmptyTar(filepath.Join(m.tmpDir, l))
+				if err != nil {
+					return err
+				}
+				empty[l] = isEmpty
+			}
+			// Find the history entry of the layer.
+			for hist < len(history) && history[hist].EmptyLayer {
+				hist++
+			}
+			if !isEmpty {
+				hist++
+				continue
+			}
+			if hist >= len(history) || j >= len(mf.config.RootFS.DiffIDs) {
+				return errors.New("Corrupt image configuration file.")
+			}
+			history[hist].EmptyLayer = true
+			hist++
+			mf.config.delRootfsElem(j)
+			mf.delLayerElem(j)
+			j--
+		}
+	}
+
+	for l, isEmpty := range empty {
+		if !isEmpty {
+			continue
+		}
+		if m.opts.keepOriginal {
+			err := m.saveOriginal(l)
+			if err != nil {
+				return err
+			}
+		}
+		err := m.removeLayer(l)
+		if err != nil {
+			return err
+		}
+		m.opts.logger.Info("dropped empty layer", "layer", l)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package melt
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WithStrict fails the melt on problems that are otherwise worked around with
+// a warning, for users who value fidelity over best-effort output: layer
+// entries that cannot be extracted, lost file capabilities, SELinux labels
+// or other metadata, symlinks WithDereference cannot resolve, files
+// WithSELinux cannot relabel and leftover layer files that cannot be removed.
+func WithStrict() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// degrade reports a problem that was worked around with a warning, or returns
+// it as an error in strict mode.
+func (m *state) degrade(msg string) error {
+	if m.opts.strict {
+		return errors.New(msg)
+	}
+	m.warn(msg)
+	return nil
+}
+
+// materializable reports whether entries of type flag can be extracted. Go's
+// reader already folds long names and local PAX records into the entries they
+// belong to and expands sparse files. Contiguous files are regular files to
+// everything but a few historic systems.
+func materializable(flag byte) bool {
+	switch flag {
+	case tar.TypeReg, tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock,
+		tar.TypeDir, tar.TypeFifo, tar.TypeGNUSparse, tar.TypeCont:
+		return true
+	}
+	return false
+}
+
+// unsupportedEntries returns the entries of the tarball file that cannot be
+// extracted and whether the tarball has to be rewritten before tarski
+// extracts it, which files every entry type it does not know as a regular
+// file. Global PAX headers, written by GNU tar and git archive, only carry
+// defaults for the entries after them and are dropped without a report,
+// contiguous files are turned into regular files. It fails for entries that
+// would be extracted outside of the layer.
+func unsupportedEntries(file string) ([]string, bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	var bad []string
+	rewrite := false
+	guard := newEntryGuard()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return bad, rewrite || len(bad) > 0, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			rewrite = true
+			continue
+		}
+		if hdr.Typeflag == tar.TypeCont {
+			rewrite = true
+		}
+		err = guard.check(hdr)
+		if err != nil {
+			return nil, false, err
+		}
+		if !materializable(hdr.Typeflag) {
+			bad = append(bad, fmt.Sprintf("%s (type %q)", hdr.Name, hdr.Typeflag))
+		}
+	}
+}
+
+// dropUnsupported removes the entries that cannot be extracted from the
+// tarball of layer so they are not turned into bogus regular files. They are
+// reported with a warning or fail the melt in strict mode. Global PAX headers
+// are removed and contiguous files rewritten as regular files silently.
+func (m *state) dropUnsupported(layer string) error {
+	file := filepath.Join(m.tmpDir, layer)
+	bad, rewrite, err := unsupportedEntries(file)
+	if err != nil {
+		return fmt.Errorf("Layer %s: %v", layer, err)
+	}
+	if !rewrite {
+		return nil
+	}
+	if len(bad) > 0 && m.opts.strict {
+		return fmt.Errorf("Layer %s has entries that cannot be extracted: %s.", layer, strings.Join(bad, ", "))
+	}
+	for _, b := range bad {
+		m.warn(fmt.Sprintf("Skipping %s in layer %s: entry type cannot be extracted", b, layer))
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := file + ".filtered"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if !materializable(hdr.Typeflag) {
+			continue
+		}
+		// The reader returns sparse files expanded.
+		if hdr.Typeflag == tar.TypeGNUSparse || hdr.Typeflag == tar.TypeCont {
+			hdr.Typeflag = tar.TypeReg
+		}
+		for k := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "GNU.sparse.") {
+				delete(hdr.PAXRecords, k)
+			}
+		}
+		err = tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	err = tw.Close()
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,104 @@
+package melt
+
+// Phase names a step of a melt.
+type Phase string
+
+const (
+	// PhaseExtract extracts the docker save tarball.
+	PhaseExtract Phase = "extract"
+	// PhaseUnpack unpacks the layer.tar of every layer.
+	PhaseUnpack Phase = "unpack"
+	// PhaseMerge melts layers into their root layers.
+	PhaseMerge Phase = "merge"
+	// PhaseHash packs the melted layers and computes their diffIDs.
+	PhaseHash Phase = "hash"
+	// PhaseWrite writes the updated metadata and the output tarball.
+	PhaseWrite Phase = "write"
+)
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+const (
+	// PhaseStarted is sent when a new phase begins. Phase is set.
+	PhaseStarted EventType = iota
+	// LayerExtracted is sent when a layer.tar was unpacked. Layer and
+	// Bytes, the size of the layer.tar, are set.
+	LayerExtracted
+	// LayerMerged is sent when a layer was melted into its root layer.
+	// Layer and Bytes, the size of its layer.tar, are set.
+	LayerMerged
+	// LayerHashed is sent when a layer was packed. Layer, Bytes, the size
+	// of the new layer.tar, and DiffID are set.
+	LayerHashed
+	// Warning is sent for errors that do not abort the melt. Message is
+	// set.
+	Warning
+	// LayerExported is sent when the FormatLayer output was written. Layer
+	// is the output path, Bytes its size and DiffID that of the layer.
+	LayerExported
+	// LayerPushed is sent for every layer of an image pushed through
+	// skopeo. Layer, Bytes, the size of its layer.tar, and DiffID are set.
+	// Message is "reused" if the destination had the layer already and
+	// "uploaded" otherwise.
+	LayerPushed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PhaseStarted:
+		return "phase-started"
+	case LayerExtracted:
+		return "layer-extracted"
+	case LayerMerged:
+		return "layer-merged"
+	case LayerHashed:
+		return "layer-hashed"
+	case Warning:
+		return "warning"
+	case LayerExported:
+		return "layer-exported"
+	case LayerPushed:
+		return "layer-pushed"
+	}
+	return "unknown"
+}
+
+// Event reports the progress of a melt.
+type Event struct {
+	Type    EventType
+	Phase   Phase
+	Layer   string
+	Bytes   int64
+	DiffID  string
+	Message string
+}
+
+func (m *state) emit(e Event) {
+	if m.opts.events == nil {
+		return
+	}
+	m.eventMutex.Lock()
+	defer m.eventMutex.Unlock()
+	m.opts.events(e)
+}
+
+// phase announces the start of phase p. It returns the error of the context
+// of the melt if it is done.
+func (m *state) phase(p Phase) error {
+	err := m.ctx.Err()
+	if err != nil {
+		return err
+	}
+	m.opts.logger.Debug("phase started", "phase", p)
+	m.work.Phase = p
+	m.writeState()
+	m.emit(Event{Type: PhaseStarted, Phase: p})
+	return nil
+}
+
+// warn logs a problem that does not abort the melt.
+func (m *state) warn(msg string) {
+	m.opts.logger.Warn(msg)
+	m.emit(Event{Type: Warning, Message: msg})
+}
@@ -0,0 +1,110 @@
+package melt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Extracting and packing a layer keeps a handful of descriptors open, a few
+// more while rsync or the sandbox run. fdsPerWorker is a generous estimate of
+// them and fdReserve is left for everything else the process has open.
+const (
+	fdsPerWorker = 16
+	fdReserve    = 64
+)
+
+// A step that runs out of file descriptors is retried up to fdRetries times
+// after waiting fdRetryDelay, doubled on every retry, to give the other
+// workers time to finish.
+const (
+	fdRetries    = 8
+	fdRetryDelay = 100 * time.Millisecond
+)
+
+// workerLimit bounds the number of jobs runWorkers runs at the same time. It
+// starts at the configured number of workers and is lowered whenever a job
+// runs out of file descriptors.
+type workerLimit struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newWorkerLimit(n int) *workerLimit {
+	l := &workerLimit{limit: n}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// acquire blocks until fewer jobs than the limit are running and counts
+// another one.
+func (l *workerLimit) acquire() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+func (l *workerLimit) release() {
+	l.mutex.Lock()
+	l.active--
+	l.mutex.Unlock()
+	l.cond.Broadcast()
+}
+
+// lower halves the number of running jobs and makes it the new limit unless
+// that is not lower. It returns the new limit, or 0 if it was not lowered.
+func (l *workerLimit) lower() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	n := l.active / 2
+	if n < 1 {
+		n = 1
+	}
+	if n >= l.limit {
+		return 0
+	}
+	l.limit = n
+	return n
+}
+
+// isFDExhausted reports whether err is caused by running out of file
+// descriptors. External commands only report it in their output.
+func isFDExhausted(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) && (errno == syscall.EMFILE || errno == syscall.ENFILE) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "too many open files")
+}
+
+// fdWorkers returns the number of workers the file descriptor limit of the
+// process allows, at most n. The soft limit is raised to the hard one first.
+func fdWorkers(opts *options) int {
+	limit := raiseFileLimit()
+	if limit == 0 || limit >= fdReserve+uint64(opts.workers)*fdsPerWorker {
+		return opts.workers
+	}
+	n := 1
+	if limit > fdReserve+fdsPerWorker {
+		n = int((limit - fdReserve) / fdsPerWorker)
+	}
+	opts.logger.Info(fmt.Sprintf("limiting the workers to %d for %d file descriptors", n, limit))
+	return n
+}
+
+// throttle lowers the number of workers after a step ran out of file
+// descriptors.
+func (m *state) throttle(what string, err error) {
+	n := m.workers.lower()
+	if n > 0 {
+		m.warn(fmt.Sprintf("%s ran out of file descriptors, lowering the number of workers to %d: %v", what, n, err))
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package melt
+
+import (
+	"syscall"
+)
+
+// raiseFileLimit raises the soft limit of open file descriptors to the hard
+// limit and returns the resulting soft limit. Recent Go runtimes already do
+// so at startup, but the limit may have been lowered since.
+func raiseFileLimit() uint64 {
+	var lim syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
+	if err != nil {
+		return 0
+	}
+	if lim.Cur < lim.Max {
+		raised := lim
+		raised.Cur = raised.Max
+		if syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised) == nil {
+			return uint64(raised.Cur)
+		}
+	}
+	return uint64(lim.Cur)
+}
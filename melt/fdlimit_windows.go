@@ -0,0 +1,7 @@
+package melt
+
+// raiseFileLimit returns 0 as Windows has no limit of open file descriptors
+// worth tracking.
+func raiseFileLimit() uint64 {
+	return 0
+}
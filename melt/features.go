@@ -0,0 +1,45 @@
+package melt
+
+import (
+	"sort"
+)
+
+// Features describes what this build of the package supports. Which of them
+// work also depends on the host, which Diagnose checks.
+type Features struct {
+	// Transports are the names of the registered transports.
+	Transports []string `json:"transports"`
+	// Backends are the backends WithBackend can select.
+	Backends []Backend `json:"backends"`
+	// Compression lists the formats WithCompression can write.
+	Compression []string `json:"compression"`
+	// Xattrs is set if extended attributes, and with them file
+	// capabilities and SELinux labels, are carried into melted layers.
+	Xattrs bool `json:"xattrs"`
+	// Sandbox and TestCommand are set if WithSandbox and WithTestCommand
+	// are supported.
+	Sandbox     bool `json:"sandbox"`
+	TestCommand bool `json:"test_command"`
+}
+
+// SupportedFeatures returns the features of this build.
+func SupportedFeatures() Features {
+	f := Features{
+		Backends:    []Backend{BackendAuto},
+		Compression: []string{"gzip"},
+		Xattrs:      xattrSupported,
+		Sandbox:     sandboxSupported,
+		TestCommand: smokeSupported,
+	}
+	transportsMutex.Lock()
+	for name := range transports {
+		f.Transports = append(f.Transports, name)
+	}
+	transportsMutex.Unlock()
+	sort.Strings(f.Transports)
+	for b := range mergeBackends {
+		f.Backends = append(f.Backends, b)
+	}
+	sort.Slice(f.Backends[1:], func(i, j int) bool { return f.Backends[i+1] < f.Backends[j+1] })
+	return f
+}
@@ -0,0 +1,140 @@
+package melt
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// The filters below are ready-made FileTransform values for the most common
+// ways of squeezing melted layers further.
+
+// RemoveMatching drops every file whose path or base name matches one of the
+// path.Match patterns, e.g. *.pyc or usr/share/doc/*. A dropped directory
+// takes everything below it along.
+func RemoveMatching(patterns ...string) FileTransform {
+	return func(name string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return nil, nil, nil
+			}
+			if ok, _ := path.Match(p, path.Base(name)); ok {
+				return nil, nil, nil
+			}
+		}
+		return hdr, nil, nil
+	}
+}
+
+// TruncateLogs empties regular files ending in .log and regular files below
+// var/log. They are truncated rather than removed because daemons often
+// expect their log files to exist.
+func TruncateLogs() FileTransform {
+	return func(name string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			return hdr, nil, nil
+		}
+		if strings.HasSuffix(name, ".log") || strings.HasPrefix(name, "var/log/") {
+			return hdr, strings.NewReader(""), nil
+		}
+		return hdr, nil, nil
+	}
+}
+
+// elfMagic starts every ELF file.
+var elfMagic = []byte("\x7fELF")
+
+// StripBinaries removes the symbols not needed for relocation from ELF
+// binaries and libraries with strip --strip-unneeded. Files strip fails on,
+// e.g. ones of an architecture it does not know, are kept as they are. The
+// binaries are copied to the default temporary directory for stripping.
+func StripBinaries() FileTransform {
+	return func(name string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+		if hdr.Typeflag != tar.TypeReg || hdr.Size < int64(len(elfMagic)) {
+			return hdr, nil, nil
+		}
+		magic := make([]byte, len(elfMagic))
+		_, err := io.ReadFull(r, magic)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(magic, elfMagic) {
+			return hdr, nil, nil
+		}
+
+		f, err := ioutil.TempFile("", "go-docker-melt_strip_")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = io.Copy(f, io.MultiReader(bytes.NewReader(magic), r))
+		if err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		stripped := f.Name() + ".stripped"
+		defer os.Remove(stripped)
+		err = exec.Command("strip", "--strip-unneeded", "-o", stripped, f.Name()).Run()
+		if err != nil {
+			return hdr, nil, nil
+		}
+		content, err := ioutil.ReadFile(stripped)
+		if err != nil {
+			return nil, nil, err
+		}
+		if int64(len(content)) >= hdr.Size {
+			return hdr, nil, nil
+		}
+		return hdr, bytes.NewReader(content), nil
+	}
+}
+
+// PrunePresets maps the names of package managers and build tools to the
+// patterns of their caches. The caches are rebuilt on demand, so removing them
+// is safe. Directories the tools expect to exist are kept.
+var PrunePresets = map[string][]string{
+	"apt": {
+		"var/cache/apt/*.bin",
+		"var/cache/apt/archives/*.deb",
+		"var/lib/apt/lists/*_*",
+	},
+	"dnf": {"var/cache/dnf/*"},
+	"yum": {"var/cache/yum/*"},
+	"apk": {"var/cache/apk/*"},
+	"pip": {
+		"root/.cache/pip",
+		"home/*/.cache/pip",
+	},
+	"npm": {
+		"root/.npm/_cacache",
+		"home/*/.npm/_cacache",
+	},
+	"gradle": {
+		"root/.gradle/caches",
+		"home/*/.gradle/caches",
+	},
+}
+
+// PrunePreset returns a filter removing the caches of the presets with the
+// given names from PrunePresets.
+func PrunePreset(names ...string) (FileTransform, error) {
+	var patterns []string
+	for _, name := range names {
+		p, ok := PrunePresets[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown prune preset %q.", name)
+		}
+		patterns = append(patterns, p...)
+	}
+	return RemoveMatching(patterns...), nil
+}
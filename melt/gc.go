@@ -0,0 +1,65 @@
+package melt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CollectWorkDirs removes the temporary work directories below dir that no
+// melt owns anymore, like those left behind by a crashed process, and returns
+// their paths. A work directory is only removed once neither it nor its state
+// file changed for retention, so that melts that have just started or do not
+// lock their work directory, as on Windows, are not removed from under them.
+// Work directories set with WithWorkDir are never removed.
+func CollectWorkDirs(dir string, retention time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), workDirPrefix) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if time.Since(lastChange(path)) < retention || isOwned(path) {
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// lastChange returns when the work directory dir or its state file were
+// modified last.
+func lastChange(dir string) time.Time {
+	var last time.Time
+	for _, p := range []string{dir, filepath.Join(dir, stateFile)} {
+		fi, err := os.Stat(p)
+		if err == nil && fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last
+}
+
+// isOwned reports whether a running melt holds the lock on the work directory
+// dir. Work directories that cannot be checked are treated as owned.
+func isOwned(dir string) bool {
+	f, err := os.OpenFile(filepath.Join(dir, ownerFile), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	ok, err := tryLock(f)
+	return err != nil || !ok
+}
@@ -0,0 +1,120 @@
+package melt
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WithBreakHardlinks replaces all but one path of every group of hardlinked
+// files in melted layers by an independent copy. The number of copies and the
+// bytes they add are logged.
+func WithBreakHardlinks() Option {
+	return func(o *options) {
+		o.breakHardlinks = true
+	}
+}
+
+// replaceWithCopy replaces path by a copy of the regular file src described by
+// info with the same content, ownership, mode, extended attributes and times.
+func replaceWithCopy(path string, src string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(path), ".melt-copy-")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Changing the owner clears the setuid and setgid bits and file
+	// capabilities, so it has to come first.
+	if uid, gid, ok := fileOwner(info); ok {
+		err = os.Lchown(tmp, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Chmod(tmp, info.Mode())
+	if err != nil {
+		return err
+	}
+	names, err := llistxattr(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		v, err := lgetxattr(src, name)
+		if err != nil {
+			return err
+		}
+		err = lsetxattr(tmp, name, v)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// breakHardlinks copies every hardlink below dir except the first path seen
+// of each file.
+func (m *state) breakHardlinks(dir string) error {
+	seen := make(map[inode]bool)
+	var files int
+	var bytes int64
+	err := walkTree(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		id, nlink := fileInode(info)
+		if nlink < 2 {
+			return nil
+		}
+		if !seen[id] {
+			seen[id] = true
+			return nil
+		}
+		err = replaceWithCopy(path, path, info)
+		if err != nil {
+			return err
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	m.linksMutex.Lock()
+	m.brokenLinks += files
+	m.brokenBytes += bytes
+	m.linksMutex.Unlock()
+	return err
+}
+
+// reportBrokenLinks logs how many hardlinks were copied and what it cost.
+func (m *state) reportBrokenLinks() {
+	if !m.opts.breakHardlinks {
+		return
+	}
+	m.opts.logger.Info("broke hardlinks", "files", m.brokenLinks, "bytes", m.brokenBytes)
+}
@@ -0,0 +1,203 @@
+package melt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A docker save tarball served over HTTP is downloaded with HTTPConnections
+// connections in chunks of HTTPChunkSize bytes if the server supports range
+// requests. A chunk whose connection breaks is resumed where it stopped up to
+// HTTPAttempts times.
+var (
+	HTTPConnections       = 4
+	HTTPChunkSize   int64 = 64 << 20
+	HTTPAttempts          = 5
+)
+
+// httpDelay is the delay before the first attempt to resume a chunk. It
+// doubles with every further attempt.
+const httpDelay = time.Second
+
+// httpTransport reads docker save tarballs from HTTP servers, addressed by
+// their URL. Writing to them is not supported as there is no common way to
+// upload to a web server.
+type httpTransport struct {
+	scheme string
+}
+
+func (t httpTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	archive, err := tempArchive(dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	err = download(ctx, t.scheme+":"+ref, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return extractTar(archive, dir)
+}
+
+func (t httpTransport) Pack(ctx context.Context, dir string, ref string) error {
+	return fmt.Errorf("Images cannot be written to %s:%s.", t.scheme, ref)
+}
+
+// download writes the file at url to f, in parallel chunks if the server
+// supports range requests.
+func download(ctx context.Context, url string, f *os.File) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return &transientError{fmt.Errorf("Failed to download %s: %v", url, err)}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return httpError(url, resp)
+	}
+	size := resp.ContentLength
+	// Chunks are only fetched from the same version of the file.
+	etag := resp.Header.Get("ETag")
+	if resp.Header.Get("Accept-Ranges") != "bytes" || size <= 0 {
+		return fetch(ctx, url, "", f, 0, -1)
+	}
+
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := make(chan int64)
+	for i := 0; i < HTTPConnections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range chunks {
+				end := start + HTTPChunkSize - 1
+				if end >= size {
+					end = size - 1
+				}
+				err := fetch(ctx, url, etag, f, start, end)
+				if err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+	for start := int64(0); start < size && ctx.Err() == nil; start += HTTPChunkSize {
+		chunks <- start
+	}
+	close(chunks)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// fetch writes the bytes from start to end of the file at url to the same
+// offsets of f, resuming after broken connections. An end of -1 fetches the
+// whole file, which can only be resumed if the server supports range
+// requests.
+func fetch(ctx context.Context, url string, etag string, f *os.File, start int64, end int64) error {
+	pos := start
+	delay := httpDelay
+	for attempt := 1; ; attempt++ {
+		err := fetchRange(ctx, url, etag, f, start, end, &pos)
+		var te *transientError
+		if err == nil || attempt >= HTTPAttempts || !errors.As(err, &te) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// fetchRange fetches the bytes from *pos to end once, advancing *pos by the
+// bytes written.
+func fetchRange(ctx context.Context, url string, etag string, f *os.File, start int64, end int64, pos *int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	ranged := end >= 0 || *pos > 0
+	if ranged {
+		r := "bytes=" + strconv.FormatInt(*pos, 10) + "-"
+		if end >= 0 {
+			r += strconv.FormatInt(end, 10)
+		}
+		req.Header.Set("Range", r)
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return &transientError{fmt.Errorf("Failed to download %s: %v", url, err)}
+	}
+	defer resp.Body.Close()
+	if ranged && resp.StatusCode != http.StatusPartialContent || !ranged && resp.StatusCode != http.StatusOK {
+		return httpError(url, resp)
+	}
+	n, err := io.Copy(io.NewOffsetWriter(f, *pos), resp.Body)
+	*pos += n
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Broken connections are resumed only where ranges are
+		// supported.
+		if resp.Header.Get("Accept-Ranges") == "bytes" || ranged {
+			err = &transientError{err}
+		}
+		return fmt.Errorf("Failed to download %s: %w", url, err)
+	}
+	if end >= 0 && *pos != end+1 {
+		return &transientError{fmt.Errorf("Failed to download %s: got %d of %d bytes from offset %d.", url, *pos-start, end+1-start, start)}
+	}
+	return nil
+}
+
+// httpError describes the unexpected response resp to a request for url.
+// Server errors are worth retrying.
+func httpError(url string, resp *http.Response) error {
+	err := fmt.Errorf("Failed to download %s: %s", url, resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return &transientError{err}
+	}
+	return err
+}
+
+func init() {
+	RegisterTransport("http", httpTransport{"http"})
+	RegisterTransport("https", httpTransport{"https"})
+}
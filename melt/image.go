@@ -0,0 +1,440 @@
+package melt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Image configurations and manifest.json files are read into memory as a
+// whole. Their size is limited so that a hostile or broken archive cannot
+// exhaust it. Programs that need to process larger files can raise the limits.
+var (
+	MaxConfigSize   int64 = 32 << 20
+	MaxManifestSize int64 = 16 << 20
+)
+
+// readMetadata reads file which may be at most limit bytes large. It returns
+// nil for an empty file.
+func readMetadata(file string, limit int64) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := fi.Size()
+	if size > limit {
+		return nil, fmt.Errorf("%s is %d bytes large, more than the limit of %d bytes.", file, size, limit)
+	}
+	if !(size > 0) {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	_, err = io.ReadFull(f, buf)
+	if err != nil {
+		return nil, err
+	}
+	err = checkJSONDepth(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return buf, nil
+}
+
+// GenericConfig is the container configuration stored in the config and
+// container_config fields of an image configuration, with the fields Docker
+// writes there.
+type GenericConfig = v1.Config
+
+// History is an entry of the history of an image.
+type History struct {
+	imagespec.History
+	// extra holds the fields of the entry that History does not know, so
+	// that fields added to the image specification or by other tools
+	// survive melting.
+	extra map[string]json.RawMessage
+}
+
+// historyFields are the JSON names of the fields of History.
+var historyFields = []string{"created", "author", "created_by", "comment", "empty_layer"}
+
+func (h *History) UnmarshalJSON(buf []byte) error {
+	type plain History
+	err := json.Unmarshal(buf, (*plain)(h))
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(buf, &fields)
+	if err != nil {
+		return err
+	}
+	for _, k := range historyFields {
+		delete(fields, k)
+	}
+	h.extra = nil
+	if len(fields) > 0 {
+		h.extra = fields
+	}
+	return nil
+}
+
+// MarshalJSON encodes the known fields in the order Docker uses followed by
+// the unknown ones sorted by name.
+func (h History) MarshalJSON() ([]byte, error) {
+	type plain History
+	buf, err := json.Marshal(plain(h))
+	if err != nil || len(h.extra) == 0 {
+		return buf, err
+	}
+	keys := make([]string, 0, len(h.extra))
+	for k := range h.extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	b.Write(buf[:len(buf)-1])
+	for i, k := range keys {
+		if i > 0 || len(buf) > 2 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(h.extra[k])
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Rootfs lists the diffIDs of the layers of an image.
+type Rootfs = imagespec.RootFS
+
+// ImageConfig is an image configuration as written by docker save: the OCI
+// image configuration with the container configuration of Docker and the
+// fields only Docker writes.
+type ImageConfig struct {
+	imagespec.Image
+	Config          *GenericConfig `json:"config,omitempty"`
+	Container       string         `json:"container,omitempty"`
+	ContainerConfig *GenericConfig `json:"container_config,omitempty"`
+	DockerVersion   string         `json:"docker_version,omitempty"`
+	History         []History      `json:"history,omitempty"`
+	rawJSON         []byte
+}
+
+// Load reads and decodes the image configuration stored in file.
+func (img *ImageConfig) Load(file string) error {
+	buf, err := readMetadata(file, MaxConfigSize)
+	if err != nil {
+		return err
+	}
+	if buf == nil {
+		return errors.New("Corrupt image configuration.")
+	}
+	return img.Parse(buf)
+}
+
+// Parse decodes the image configuration held in buf.
+func (img *ImageConfig) Parse(buf []byte) error {
+	err := json.Unmarshal(buf, &img)
+	if err != nil {
+		return err
+	}
+	img.rawJSON = buf
+
+	// Both fields are required, only their presence is checked here.
+	var required struct {
+		History *json.RawMessage `json:"history"`
+		RootFS  *json.RawMessage `json:"rootfs"`
+	}
+	err = json.Unmarshal(buf, &required)
+	if err != nil {
+		return err
+	}
+	if required.History == nil || required.RootFS == nil {
+		return errors.New("Corrupt image configuration.")
+	}
+	if len(img.History) > MaxLayers || len(img.RootFS.DiffIDs) > MaxLayers {
+		return fmt.Errorf("Image configuration has more than %d layers or history entries.", MaxLayers)
+	}
+	for _, d := range img.RootFS.DiffIDs {
+		if d.Validate() != nil || d.Algorithm() != digest.SHA256 {
+			return fmt.Errorf("Invalid diffID %q in image configuration.", d)
+		}
+	}
+
+	return nil
+}
+
+// diffIDs returns the diffIDs of the layers of the image.
+func (img *ImageConfig) diffIDs() []string {
+	ids := make([]string, len(img.RootFS.DiffIDs))
+	for i, d := range img.RootFS.DiffIDs {
+		ids[i] = string(d)
+	}
+	return ids
+}
+
+func (img *ImageConfig) updateHistory() error {
+	var err error
+	img.rawJSON, err = setJSONField(img.rawJSON, "history", img.History)
+	return err
+}
+
+func (img *ImageConfig) updateRootfs() error {
+	var err error
+	img.rawJSON, err = setJSONField(img.rawJSON, "rootfs", img.RootFS)
+	return err
+}
+
+// release drops the raw JSON of the configuration once it has been written.
+// Only the decoded fields stay available.
+func (img *ImageConfig) release() {
+	img.rawJSON = nil
+}
+
+// updateCreated sets the top-level created field of the image configuration.
+// The field is optional, configurations without it get it added.
+func (img *ImageConfig) updateCreated(created time.Time) error {
+	var err error
+	img.rawJSON, err = setJSONField(img.rawJSON, "created", created)
+	if err != nil {
+		return err
+	}
+	img.Created = &created
+	return nil
+}
+
+func (img *ImageConfig) delHistoryElem(pos int) {
+	img.History = append(img.History[:pos], img.History[pos+1:]...)
+}
+
+func (img *ImageConfig) delRootfsElem(pos int) {
+	img.RootFS.DiffIDs = append(img.RootFS.DiffIDs[:pos], img.RootFS.DiffIDs[pos+1:]...)
+}
+
+// annotateHistoryElem appends note to the comment of the history entry at
+// pos.
+func (img *ImageConfig) annotateHistoryElem(pos int, note string) {
+	h := &img.History[pos]
+	if h.Comment != "" {
+		note = h.Comment + "; " + note
+	}
+	h.Comment = note
+}
+
+// The reference for manifests can be found at:
+// https://github.com/docker/distribution/blob/master/docs/spec/manifest-v2-2.md
+// However, we do not need to support this currently since docker save only
+// exports in the format outlined in this struct.
+type Manifest struct {
+	ConfigHash string `json:"Config,omitempty"`
+	config     *ImageConfig
+	RepoTags   []string `json:"RepoTags,omitempty"`
+	layers     []string
+	RawLayers  *json.RawMessage `json:"Layers,omitempty"`
+	Parent     string           `json:",omitempty"`
+}
+
+// Layers returns the paths of the layers of the image in the archive.
+func (m *Manifest) Layers() []string {
+	return m.layers
+}
+
+// cleanMember returns the canonical form of the name of a member of an
+// archive, without ./ prefixes, duplicate slashes and the like. Names leaving
+// the archive are rejected.
+func cleanMember(name string) (string, error) {
+	clean := path.Clean(strings.TrimLeft(name, "/"))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path %q in manifest file.", name)
+	}
+	return clean, nil
+}
+
+// ownDir returns the directory of the archive only holding the files of
+// layer, like its json and VERSION files, or the empty string if its tarball
+// is stored next to other files as in blobs/sha256.
+func ownDir(layer string) string {
+	if path.Base(layer) == "layer.tar" {
+		return path.Dir(layer)
+	}
+	return ""
+}
+
+// unpackDir returns the directory layer is unpacked into next to its tarball.
+func unpackDir(layer string) string {
+	if strings.HasSuffix(layer, ".tar") {
+		return strings.TrimSuffix(layer, ".tar")
+	}
+	return layer + ".dir"
+}
+
+// Name returns the tags of the image or the digest of its configuration if it
+// is untagged.
+func (m *Manifest) Name() string {
+	if len(m.RepoTags) > 0 {
+		return strings.Join(m.RepoTags, ", ")
+	}
+	return "sha256:" + strings.TrimSuffix(m.ConfigHash, ".json")
+}
+
+func (m *Manifest) delLayerElem(pos int) {
+	m.layers = append(m.layers[:pos], m.layers[pos+1:]...)
+}
+
+type RawManifest struct {
+	Manifest []Manifest
+	rawJSON  []byte // holds raw manifest.json file
+}
+
+// updateLayers records the layers of the image at pos in manifest.json.
+func (r *RawManifest) updateLayers(pos int) error {
+	return r.setField(pos, "Layers", r.Manifest[pos].layers)
+}
+
+// setField sets the field key of the image at pos to the JSON encoding of v.
+// Fields that are missing in the original are added.
+func (r *RawManifest) setField(pos int, key string, v interface{}) error {
+	var err error
+	r.rawJSON, err = setJSONElementField(r.rawJSON, pos, key, v)
+	return err
+}
+
+// mergeDuplicates merges entries referring to the same configuration and
+// layers into the first of them, which gets the tags of all of them. It
+// reports whether any entries were merged.
+func (r *RawManifest) mergeDuplicates() (bool, error) {
+	var entries []map[string]json.RawMessage
+	err := json.Unmarshal(r.rawJSON, &entries)
+	if err != nil {
+		return false, err
+	}
+	if len(entries) != len(r.Manifest) {
+		return false, errors.New("Corrupt manifest file.")
+	}
+
+	first := make(map[string]int)
+	var kept []map[string]json.RawMessage
+	var tags [][]string
+	merged := false
+	for i, mf := range r.Manifest {
+		key := mf.ConfigHash + "\x00" + strings.Join(mf.layers, "\x00")
+		j, ok := first[key]
+		if !ok {
+			first[key] = len(kept)
+			kept = append(kept, entries[i])
+			tags = append(tags, mf.RepoTags)
+			continue
+		}
+		merged = true
+		for _, t := range mf.RepoTags {
+			dup := false
+			for _, have := range tags[j] {
+				dup = dup || have == t
+			}
+			if !dup {
+				tags[j] = append(tags[j], t)
+			}
+		}
+		kept[j]["RepoTags"], err = json.Marshal(tags[j])
+		if err != nil {
+			return false, err
+		}
+	}
+	if !merged {
+		return false, nil
+	}
+
+	buf, err := json.Marshal(kept)
+	if err != nil {
+		return false, err
+	}
+	r.Manifest = nil
+	return true, r.Parse(buf)
+}
+
+// Load reads and decodes the manifest.json file stored in file.
+func (r *RawManifest) Load(file string) error {
+	buf, err := readMetadata(file, MaxManifestSize)
+	if err != nil || buf == nil {
+		return err
+	}
+	return r.Parse(buf)
+}
+
+// Parse decodes the manifest.json file held in buf.
+func (r *RawManifest) Parse(buf []byte) error {
+	err := json.Unmarshal(buf, &r.Manifest)
+	if err != nil {
+		return err
+	}
+	if len(r.Manifest) > MaxImages {
+		return fmt.Errorf("Manifest file lists more than %d images.", MaxImages)
+	}
+
+	for i := 0; i < len(r.Manifest); i++ {
+		manfst := &r.Manifest[i]
+		if manfst.RawLayers == nil {
+			return errors.New("Corrupt manifest file.")
+		}
+		err = json.Unmarshal(*manfst.RawLayers, &manfst.layers)
+		if err != nil {
+			return err
+		}
+		if len(manfst.layers) > MaxLayers {
+			return fmt.Errorf("Manifest file lists more than %d layers for an image.", MaxLayers)
+		}
+		for j, l := range manfst.layers {
+			manfst.layers[j], err = cleanMember(l)
+			if err != nil {
+				return err
+			}
+		}
+		if manfst.ConfigHash != "" {
+			manfst.ConfigHash, err = cleanMember(manfst.ConfigHash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	r.rawJSON = buf
+	return nil
+}
+
+// LayerJSON is the per layer configuration file of the legacy archive format.
+// It is only written, for images that are imported or generated and for the
+// top layers the repositories file refers to. Melting ignores it.
+type LayerJSON struct {
+	Id              string         `json:"id,omitempty"`
+	Parent          string         `json:"parent,omitempty"`
+	Created         string         `json:"created,omitempty"`
+	Container       string         `json:"container,omitempty"`
+	ContainerConfig *GenericConfig `json:"container_config,omitempty"`
+	DockerVersion   string         `json:"docker_version,omitempty"`
+	Config          *GenericConfig `json:"config,omitempty"`
+	Arch            string         `json:"architecture,omitempty"`
+	OS              string         `json:"os,omitempty"`
+	rawJSON         []byte
+}
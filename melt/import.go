@@ -0,0 +1,214 @@
+package melt
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dockerenv is the marker file docker puts into the root of every container.
+const dockerenv = ".dockerenv"
+
+// ImportConfig describes the image Import builds around a root filesystem.
+type ImportConfig struct {
+	// Config is the runtime configuration of the image. If it is nil the
+	// image only gets the PATH docker sets for containers.
+	Config *GenericConfig
+	// Arch and OS default to amd64 and linux.
+	Arch string
+	OS   string
+	// Tags are the name:tag references of the image.
+	Tags []string
+	// Created is recorded as the creation time of the image. It defaults
+	// to the current time.
+	Created time.Time
+}
+
+// Import packages the root filesystem tarball rootfs, like the output of
+// docker export, as an image with a single layer and stores it as output.
+// rootfs may be gzip compressed. The .dockerenv file docker adds to every
+// container is dropped.
+func (ml *Melter) Import(ctx context.Context, rootfs string, output string, cfg ImportConfig) error {
+	m, err := ml.newState(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.cleanup()
+	m.work.Input, m.work.Output = rootfs, output
+	err = m.importRootfs(rootfs, cfg)
+	if err == nil {
+		err = m.writeOutput(output)
+	}
+	m.finishState(err)
+	return err
+}
+
+// copyRootfs copies the entries of the root filesystem tarball rootfs to the
+// layer tarball file and returns the diffID of the layer.
+func copyRootfs(rootfs string, file string) (string, error) {
+	in, err := os.Open(rootfs)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	var r io.Reader = bufio.NewReader(in)
+	magic, _ := r.(*bufio.Reader).Peek(len(gzipMagic))
+	if bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	out, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	h := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(out, h))
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if path.Clean(strings.TrimLeft(hdr.Name, "/")) == dockerenv {
+			continue
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return "", err
+	}
+	err = out.Close()
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// importRootfs writes an image holding the root filesystem tarball rootfs as
+// its only layer into tmpDir.
+func (m *state) importRootfs(rootfs string, cfg ImportConfig) error {
+	err := m.phase(PhaseExtract)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(m.tmpDir, "layer.tar")
+	diffID, err := copyRootfs(rootfs, tmp)
+	if err != nil {
+		return err
+	}
+	if cfg.Created.IsZero() {
+		cfg.Created = time.Now().UTC()
+	}
+	created := cfg.Created.Truncate(time.Second)
+	if cfg.Arch == "" {
+		cfg.Arch = "amd64"
+	}
+	if cfg.OS == "" {
+		cfg.OS = "linux"
+	}
+	if cfg.Config == nil {
+		cfg.Config = &GenericConfig{Env: []string{defaultPath}}
+	}
+
+	err = m.phase(PhaseWrite)
+	if err != nil {
+		return err
+	}
+	id := strings.TrimPrefix(diffID, "sha256:")
+	err = os.Mkdir(filepath.Join(m.tmpDir, id), 0755)
+	if err != nil {
+		return err
+	}
+	layer := path.Join(id, "layer.tar")
+	err = os.Rename(tmp, filepath.Join(m.tmpDir, layer))
+	if err != nil {
+		return err
+	}
+	layerJSON, err := json.Marshal(LayerJSON{Id: id, Created: created.Format(time.RFC3339), Arch: cfg.Arch, OS: cfg.OS})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(m.tmpDir, id, "json"), layerJSON, 0666)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(m.tmpDir, id, "VERSION"), []byte("1.0"), 0666)
+	if err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(ImageConfig{
+		Image: imagespec.Image{
+			Created:  &created,
+			Platform: imagespec.Platform{Architecture: cfg.Arch, OS: cfg.OS},
+			RootFS:   Rootfs{Type: "layers", DiffIDs: []digest.Digest{digest.Digest(diffID)}},
+		},
+		Config: cfg.Config,
+		History: []History{{History: imagespec.History{
+			Created:   &created,
+			CreatedBy: "go-docker-melt: imported " + filepath.Base(rootfs),
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+	config, err = m.formatJSON(config)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(config)
+	configHash := hex.EncodeToString(sum[:]) + ".json"
+	err = ioutil.WriteFile(filepath.Join(m.tmpDir, configHash), config, 0666)
+	if err != nil {
+		return err
+	}
+
+	rawLayers, err := json.Marshal([]string{layer})
+	if err != nil {
+		return err
+	}
+	manifest, err := json.Marshal([]Manifest{{
+		ConfigHash: configHash,
+		RepoTags:   cfg.Tags,
+		RawLayers:  (*json.RawMessage)(&rawLayers),
+	}})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(m.tmpDir, "manifest.json"), manifest, 0666)
+	if err != nil {
+		return err
+	}
+	return writeRepositories(m.tmpDir)
+}
@@ -0,0 +1,141 @@
+package melt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// manifest.json and the image configurations are edited where they are
+// stored: only the fields a melt changes are encoded anew, everything else,
+// including fields go-docker-melt does not know, the order of the fields and
+// the formatting, is kept byte for byte. Images the melt does not change thus
+// keep the digest of their configuration.
+
+// jsonSpan is the position of a value in a JSON document.
+type jsonSpan struct {
+	start int
+	end   int
+}
+
+// objectFields returns the positions of the values of the fields of the JSON
+// object buf by their key.
+func objectFields(buf []byte) (map[string]jsonSpan, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, errors.New("Not a JSON object.")
+	}
+	fields := make(map[string]jsonSpan)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, errors.New("Not a JSON object.")
+		}
+		start := valueStart(buf, int(dec.InputOffset()))
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = jsonSpan{start, int(dec.InputOffset())}
+	}
+	return fields, nil
+}
+
+// arrayElements returns the positions of the elements of the JSON array buf.
+func arrayElements(buf []byte) ([]jsonSpan, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('[') {
+		return nil, errors.New("Not a JSON array.")
+	}
+	var elems []jsonSpan
+	for dec.More() {
+		start := valueStart(buf, int(dec.InputOffset()))
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, jsonSpan{start, int(dec.InputOffset())})
+	}
+	return elems, nil
+}
+
+// valueStart skips the whitespace and separators in front of the value
+// following offset.
+func valueStart(buf []byte, offset int) int {
+	for offset < len(buf) {
+		switch buf[offset] {
+		case ' ', '\t', '\r', '\n', ':', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// splice replaces the span s of buf by repl.
+func splice(buf []byte, s jsonSpan, repl []byte) []byte {
+	out := make([]byte, 0, len(buf)-(s.end-s.start)+len(repl))
+	out = append(out, buf[:s.start]...)
+	out = append(out, repl...)
+	return append(out, buf[s.end:]...)
+}
+
+// setJSONField sets the field key of the JSON object buf to the JSON encoding
+// of v. Objects without the field get it added as their last field.
+func setJSONField(buf []byte, key string, v interface{}) ([]byte, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := objectFields(buf)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := fields[key]; ok {
+		return splice(buf, s, value), nil
+	}
+	name, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	var field []byte
+	if len(fields) > 0 {
+		field = append(field, ',')
+	}
+	field = append(append(append(field, name...), ':'), value...)
+	end := bytes.LastIndexByte(buf, '}')
+	return splice(buf, jsonSpan{end, end}, field), nil
+}
+
+// setJSONElementField sets the field key of the object at pos of the JSON
+// array buf to the JSON encoding of v.
+func setJSONElementField(buf []byte, pos int, key string, v interface{}) ([]byte, error) {
+	elems, err := arrayElements(buf)
+	if err != nil {
+		return nil, err
+	}
+	if pos >= len(elems) {
+		return nil, errors.New("Corrupt manifest file.")
+	}
+	s := elems[pos]
+	elem, err := setJSONField(buf[s.start:s.end], key, v)
+	if err != nil {
+		return nil, err
+	}
+	return splice(buf, s, elem), nil
+}
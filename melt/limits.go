@@ -0,0 +1,143 @@
+package melt
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/brauner/tarski"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Archives come from untrusted sources. Besides the size of their metadata
+// files, the nesting of their JSON and the number of images and layers they
+// describe are limited, and every tarball is checked for entries that would
+// end up outside the directory it is extracted to before it is extracted.
+// Programs that need to process larger images can raise the limits.
+var (
+	MaxJSONDepth = 64
+	MaxImages    = 1024
+	// MaxLayers limits the layers, diffIDs and history entries of an
+	// image.
+	MaxLayers = 4096
+)
+
+// checkJSONDepth fails if the JSON document buf nests objects and arrays
+// more than MaxJSONDepth levels deep.
+func checkJSONDepth(buf []byte) error {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range buf {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+			if depth > MaxJSONDepth {
+				return fmt.Errorf("JSON nested more than %d levels deep.", MaxJSONDepth)
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// escapes reports whether the cleaned relative path p leaves its root.
+func escapes(p string) bool {
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+// entryGuard finds the entries of a tarball that would be extracted outside
+// of its root: entries whose names or hardlink targets leave it and entries or
+// hardlink targets below a symlink of the same tarball, which the extraction
+// would follow. Hardlinks to such symlinks are rejected as well.
+type entryGuard struct {
+	symlinks map[string]bool
+}
+
+func newEntryGuard() *entryGuard {
+	return &entryGuard{symlinks: make(map[string]bool)}
+}
+
+// symlinkAbove returns the symlink of the tarball the cleaned relative path p
+// is below or the empty string if there is none.
+func (g *entryGuard) symlinkAbove(p string) string {
+	for parent := path.Dir(p); parent != "."; parent = path.Dir(parent) {
+		if g.symlinks[parent] {
+			return parent
+		}
+	}
+	return ""
+}
+
+func (g *entryGuard) check(hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+	name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+	if escapes(name) {
+		return fmt.Errorf("Entry %s escapes the root filesystem.", hdr.Name)
+	}
+	if parent := g.symlinkAbove(name); parent != "" {
+		return fmt.Errorf("Entry %s is below the symlink %s.", hdr.Name, parent)
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		target := path.Clean(strings.TrimLeft(hdr.Linkname, "/"))
+		if escapes(target) {
+			return fmt.Errorf("Hardlink %s points outside the root filesystem.", hdr.Name)
+		}
+		if parent := g.symlinkAbove(target); parent != "" {
+			return fmt.Errorf("Hardlink %s points below the symlink %s.", hdr.Name, parent)
+		}
+		if g.symlinks[target] {
+			return fmt.Errorf("Hardlink %s points to the symlink %s.", hdr.Name, target)
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		g.symlinks[name] = true
+	} else {
+		delete(g.symlinks, name)
+	}
+	return nil
+}
+
+// checkTar fails if the tarball file has entries that would be extracted
+// outside of the directory it is extracted to.
+func checkTar(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	guard := newEntryGuard()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		err = guard.check(hdr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+}
+
+// extractTar checks the tarball file and extracts it to dir.
+func extractTar(file string, dir string) error {
+	err := checkTar(file)
+	if err != nil {
+		return err
+	}
+	return tarski.Extract(file, dir)
+}
@@ -0,0 +1,79 @@
+package melt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrLocked is returned when another melt is writing to the same output.
+var ErrLocked = errors.New("Another melt is running with the same output.")
+
+// outputPath returns the path output is written to or the empty string if it
+// is not written to the file system.
+func (ml *Melter) outputPath(output string) string {
+	if ml.opts.format != FormatDockerArchive && ml.opts.format != FormatOCI {
+		return output
+	}
+	name, ref := ParseReference(output)
+	switch name {
+	case "docker-archive", "dir", "oci-archive":
+		return ref
+	case "oci":
+		return strings.SplitN(ref, ":", 2)[0]
+	}
+	return ""
+}
+
+// lockOutput takes an advisory lock on the output of a melt so that a second
+// melt writing to it fails with ErrLocked instead of clobbering it. The lock is
+// held on a file next to the output which is removed by the returned function.
+func (ml *Melter) lockOutput(output string) (func(), error) {
+	path := ml.outputPath(output)
+	if path == "" {
+		return func() {}, nil
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	lock := path + ".lock"
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_RDWR, 0644)
+		if os.IsNotExist(err) {
+			// The directory of the output does not exist
+			// yet, so nobody else can be writing to it.
+			return func() {}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ok, err := tryLock(f)
+		if err != nil || !ok {
+			f.Close()
+			if err == nil {
+				err = ErrLocked
+			}
+			return nil, err
+		}
+
+		// The previous holder removes the lock file when it is done.
+		// If that happened between opening and locking it, try again
+		// with a new one.
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := os.Stat(lock)
+		if err != nil || !os.SameFile(locked, current) {
+			f.Close()
+			continue
+		}
+		return func() {
+			os.Remove(lock)
+			f.Close()
+		}, nil
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package melt
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock(2) on f without waiting. It reports false
+// if somebody else holds it.
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+	return true, nil
+}
@@ -0,0 +1,11 @@
+package melt
+
+import (
+	"os"
+)
+
+// tryLock does not lock on Windows. Concurrent melts writing to the same
+// output are not detected there.
+func tryLock(f *os.File) (bool, error) {
+	return true, nil
+}
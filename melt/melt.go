@@ -0,0 +1,1386 @@
+// Package melt merges the layers of Docker images. It takes a tar file
+// produced by docker save as input and produces a tar file that can be
+// imported with docker load.
+//
+// When the input only contains a single image all of its layers are melted
+// into a single layer. If the input contains multiple images the number of
+// layers is minimized. Sequences of shared layers and sequences of unique
+// layers are melted but unique layers are never melted into shared layers.
+package melt
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/brauner/tarski"
+	digest "github.com/opencontainers/go-digest"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Version is recorded in the history annotations. It is meant to be set at
+// build time via -ldflags "-X github.com/brauner/go-docker-melt/melt.Version=...".
+var Version = "devel"
+
+// ErrSingleLayer is returned when the input has no more than one layer.
+var ErrSingleLayer = errors.New("Image does only have one layer. There is nothing to be done.")
+
+// ErrAllShared is returned when all layers of a multi-image input are shared
+// among its images.
+var ErrAllShared = errors.New("All layers are shared among images. There is nothing to be done.")
+
+// options controls how an image is melted. It is filled in by New from the
+// defaults and the given Option values.
+type options struct {
+	tmpDir  string
+	workers int
+	// memoryBudget limits the bytes of layers processed concurrently.
+	memoryBudget int64
+	noAnnotate   bool
+	invocation   string
+	created      time.Time
+	events       func(Event)
+	logger       *slog.Logger
+	format       OutputFormat
+	planner      Planner
+	base         string
+	clamp        bool
+	clampMtime   time.Time
+	// stripXattrs holds the patterns of the xattrs removed from melted
+	// layers.
+	stripXattrs    []string
+	selinux        SELinuxPolicy
+	selinuxContext string
+	capsCheck      CheckMode
+	permCheck      CheckMode
+	metaCheck      CheckMode
+	linkCheck      CheckMode
+	preserveAtime  bool
+	umask          int
+	workDir        string
+	testCmd        string
+	expectDigest   string
+	signatures     *SignaturePolicy
+	signing        *SigningPolicy
+	baseRootfs     string
+	retries        int
+	retryDelay     time.Duration
+	breakHardlinks bool
+	dereference    bool
+	// dereferenceExclude holds the patterns of the symlinks that are kept
+	// by dereference.
+	dereferenceExclude []string
+	casePolicy         CasePolicy
+	sandbox            bool
+	backend            Backend
+	keepOriginal       bool
+	meltedSuffix       string
+	sizeReport         func(SizeReport)
+	tags               []string
+	canonical          bool
+	strict             bool
+	repair             bool
+	jsonStyle          JSONStyle
+	transforms         []FileTransform
+	ranges             []LayerRange
+	minLayerSize       int64
+	annotations        map[string]string
+	compression        Compression
+	compressionLevel   int
+	verifyReproducible bool
+	previous           string
+}
+
+// Option configures a Melter.
+type Option func(*options)
+
+// WithTmpDir sets the directory the temporary work directory is created in.
+// It defaults to the system temporary directory.
+func WithTmpDir(dir string) Option {
+	return func(o *options) {
+		o.tmpDir = dir
+	}
+}
+
+// WithWorkers sets the number of layers that are unpacked and packed
+// concurrently. It defaults to the number of CPUs.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+// WithoutAnnotation disables the note recorded in the comment of every
+// history entry that layers were melted into.
+func WithoutAnnotation() Option {
+	return func(o *options) {
+		o.noAnnotate = true
+	}
+}
+
+// WithInvocation describes the options the melt was invoked with. It is
+// included in the history annotation.
+func WithInvocation(invocation string) Option {
+	return func(o *options) {
+		o.invocation = invocation
+	}
+}
+
+// WithCreated sets the creation time recorded for the image and for the
+// history entries that layers were melted into.
+func WithCreated(t time.Time) Option {
+	return func(o *options) {
+		o.created = t
+	}
+}
+
+// WithTags sets the tags of the melted image, replacing the original ones.
+// This also names untagged images. The input has to contain a single image.
+func WithTags(tags ...string) Option {
+	return func(o *options) {
+		o.tags = tags
+	}
+}
+
+// WithEvents sets a callback that is called for every progress event. Events
+// are delivered one at a time but possibly from different goroutines.
+func WithEvents(fn func(Event)) Option {
+	return func(o *options) {
+		o.events = fn
+	}
+}
+
+// WithLogger sets the handler melt logs are written to. By default logs go to
+// the default slog logger which writes through the log package.
+func WithLogger(h slog.Handler) Option {
+	return func(o *options) {
+		o.logger = slog.New(h)
+	}
+}
+
+// WithOutputFormat sets what a melt produces. It defaults to
+// FormatDockerArchive.
+func WithOutputFormat(f OutputFormat) Option {
+	return func(o *options) {
+		o.format = f
+	}
+}
+
+// Melter melts images. A Melter can be used for multiple melts, also
+// concurrently.
+type Melter struct {
+	opts options
+}
+
+// New returns a Melter configured by opts.
+func New(opts ...Option) *Melter {
+	ml := &Melter{
+		opts: options{
+			workers:          runtime.NumCPU(),
+			logger:           slog.Default(),
+			format:           FormatDockerArchive,
+			planner:          DefaultPlanner,
+			selinux:          SELinuxPreserve,
+			capsCheck:        CheckWarn,
+			permCheck:        CheckWarn,
+			metaCheck:        CheckWarn,
+			linkCheck:        CheckOff,
+			casePolicy:       CaseWarn,
+			compressionLevel: gzip.DefaultCompression,
+		},
+	}
+	for _, opt := range opts {
+		opt(&ml.opts)
+	}
+	if ml.opts.selinux == SELinuxStrip {
+		ml.opts.stripXattrs = append(ml.opts.stripXattrs, selinuxXattr)
+	}
+	return ml
+}
+
+func rsyncLayer(ctx context.Context, from string, to string) *exec.Cmd {
+	fromexcl := from + "/./"
+	flags := "-aXhsrpR"
+	if !xattrSupported {
+		// Not every rsync outside of Linux knows -X.
+		flags = "-ahsrpR"
+	}
+	return exec.CommandContext(ctx, "rsync", flags, "--numeric-ids",
+		"--remove-source-files", "--exclude=.wh.*", fromexcl, to)
+}
+
+func IsEmptyDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	return err
+}
+
+// state holds the state of a single melt.
+type state struct {
+	ctx     context.Context
+	opts    *options
+	workDir string
+	// keepWork keeps the work directory after the melt.
+	keepWork bool
+	// owner holds the lock on the work directory.
+	owner    *os.File
+	work     WorkState
+	tmpDir   string
+	manifest RawManifest
+	configs  []ImageConfig
+	// original holds the original manifest.json with WithKeepOriginal.
+	original []byte
+
+	// inputDigest is the digest of the tarball the input was read from,
+	// if it was spooled into the work directory. outputDigest is the
+	// digest of the manifest of the melted image if the transport of the
+	// output reports it.
+	inputDigest  string
+	outputDigest string
+
+	// The allLayers hashmap holds all layers for all images in the tar
+	// archive without duplicates. If the int it indicates is set to 1 the
+	// layer is shared at least among two layers. If it is set to 0 the
+	// layer is unique.
+	allLayers map[string]int
+
+	// plan records which layers are melted into which root layers.
+	plan Plan
+	// untouched holds the layers nothing is melted into. They are neither
+	// unpacked nor repacked and keep their diffID.
+	untouched  map[string]bool
+	origDiffID map[string]string
+	// base holds the layers belonging to the base image.
+	base map[string]bool
+	// sourceKey maps every root layer other layers are melted into to the
+	// key of its sources. With WithPrevious reuse holds the root layers
+	// whose melted layer is taken from the previous output and
+	// reusedSources the layers melted into them.
+	sourceKey     map[string]string
+	reuse         map[string]previousLayer
+	reusedSources map[string]bool
+
+	// meltedAt, if set, is recorded as the time of the melt instead of
+	// the current time.
+	meltedAt time.Time
+
+	// Number of files each xattr was stripped from.
+	strippedMutex sync.Mutex
+	stripped      map[string]int
+
+	// caps maps the directory of every layer that other layers are melted
+	// into to the capabilities its files are expected to have afterwards.
+	caps map[string]map[string][]byte
+
+	// For the metadata check the entries of every layer before it was
+	// unpacked, the layers melted into every root layer and the paths
+	// each kind of metadata was lost for.
+	metaMutex sync.Mutex
+	entries   map[string][]overlayEntry[fileMeta]
+	sources   map[string][]string
+	lost      map[string]map[string]bool
+
+	// budget limits the bytes the workers process at the same time with
+	// WithMemoryBudget.
+	budgetOnce sync.Once
+	budget     *budget
+
+	// workers limits the jobs running at the same time. It is lowered
+	// when they run out of file descriptors.
+	workers *workerLimit
+	// backend merges the layers. backendName is the Backend it was
+	// selected by.
+	backend     mergeBackend
+	backendName Backend
+
+	// Number of hardlinks replaced by copies and the bytes they added.
+	linksMutex  sync.Mutex
+	brokenLinks int
+	brokenBytes int64
+
+	// Size of the layer.tar of each layer before it was unpacked.
+	sizes map[string]int64
+
+	// For WithSizeReport the layers of every image before melting and the
+	// sizes of the layers after melting. The compressed sizes are only
+	// measured for the report.
+	origLayers    [][]string
+	sizesMutex    sync.Mutex
+	meltedSizes   map[string]int64
+	gzSizes       map[string]int64
+	meltedGzSizes map[string]int64
+
+	// TODO: Rethink whether usage of a diffID map can be avoided.
+	diffIDMutex sync.Mutex
+	diffID      map[string]string
+
+	eventMutex sync.Mutex
+}
+
+// Melt melts the layers of the images in the docker save tarball input and
+// writes the result to output using the default options.
+func Melt(input string, output string) error {
+	return New().Melt(input, output)
+}
+
+// Melt melts the layers of the images in input and writes the result to
+// output. Both are transport references as understood by ParseReference,
+// unless a different output format was selected. If there is nothing to be
+// done, ErrSingleLayer or ErrAllShared is returned and output is not created.
+// If another melt is writing to the same output path, ErrLocked is returned.
+func (ml *Melter) Melt(input string, output string) error {
+	return ml.MeltContext(context.Background(), input, output)
+}
+
+// MeltContext is like Melt but stops melting as soon as possible once ctx is
+// done. In that case the error of ctx is returned.
+func (ml *Melter) MeltContext(ctx context.Context, input string, output string) error {
+	unlock, err := ml.lockOutput(output)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	m, err := ml.newState(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.cleanup()
+	err = m.melt(input, output)
+	m.finishState(err)
+	return err
+}
+
+// newState creates the state of a melt with a work directory of its own. It
+// has to be cleaned up once the melt is done.
+func (ml *Melter) newState(ctx context.Context) (*state, error) {
+	return newState(ctx, &ml.opts)
+}
+
+func newState(ctx context.Context, opts *options) (*state, error) {
+	if opts.expectDigest != "" && !isDigest(opts.expectDigest) {
+		return nil, fmt.Errorf("Invalid digest %s.", opts.expectDigest)
+	}
+	if opts.previous != "" && len(opts.transforms) > 0 {
+		return nil, errors.New("File transforms cannot be combined with a previous output.")
+	}
+	backend, err := selectBackend(opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.logger.Debug("merge backend", "backend", backend)
+	workDir, keep, err := makeWorkDir(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := lockWorkDir(workDir)
+	if err != nil {
+		if !keep {
+			os.RemoveAll(workDir)
+		}
+		return nil, err
+	}
+
+	// The image is unpacked into a subdirectory so that transports and
+	// base images have room for their temporary files next to it.
+	tmpDir := filepath.Join(workDir, imageDir)
+	err = os.Mkdir(tmpDir, 0755)
+	if err != nil {
+		owner.Close()
+		if !keep {
+			os.RemoveAll(workDir)
+		}
+		return nil, err
+	}
+	return &state{ctx: ctx, opts: opts, workDir: workDir, keepWork: keep, owner: owner, tmpDir: tmpDir, workers: newWorkerLimit(fdWorkers(opts)), backend: mergeBackends[backend], backendName: backend}, nil
+}
+
+// cleanup removes the work directory unless it has to be kept.
+func (m *state) cleanup() {
+	m.owner.Close()
+	if m.keepWork {
+		m.opts.logger.Info("kept work directory", "dir", m.workDir)
+		return
+	}
+	err := os.RemoveAll(m.workDir)
+	if err != nil {
+		m.opts.logger.Error("failed to remove work directory", "dir", m.workDir, "err", err)
+	}
+}
+
+func (m *state) melt(input string, output string) error {
+	m.work.Input, m.work.Output = input, output
+	err := m.phase(PhaseExtract)
+	if err != nil {
+		return err
+	}
+	err = m.unpackInput(input)
+	if err != nil {
+		return err
+	}
+	return m.meltUnpacked(output)
+}
+
+// meltUnpacked melts the image unpacked into tmpDir and writes it to output.
+func (m *state) meltUnpacked(output string) error {
+	err := m.checkSigning(output)
+	if err != nil {
+		return err
+	}
+	if m.opts.format == FormatOCI {
+		_, _, err = ociOutput(output)
+		if err != nil {
+			return err
+		}
+	}
+	if m.opts.verifyReproducible {
+		err = m.verifyReproducible()
+	} else {
+		err = m.build()
+	}
+	if err != nil {
+		return err
+	}
+	switch m.opts.format {
+	case FormatDockerfile:
+		return m.writeDockerfile(output)
+	case FormatLayer:
+		return m.writeLayer(output)
+	case FormatRuntimeBundle:
+		return m.writeBundle(output)
+	case FormatOCI:
+		err = m.writeOCI(output)
+		if err != nil {
+			return err
+		}
+		m.reportSizes()
+		return nil
+	}
+	err = m.writeOutput(output)
+	if err != nil {
+		return err
+	}
+	err = m.sign(output)
+	if err != nil {
+		return err
+	}
+	m.reportSizes()
+	return nil
+}
+
+// writeOutput stores the image in tmpDir as output.
+func (m *state) writeOutput(output string) error {
+	return m.retry("Writing "+output, func() error {
+		name, ref := ParseReference(output)
+		if name == "docker-archive" && m.compresses(CompressArchive) {
+			return m.packCompressed(ref)
+		}
+		if p, ok := lookupTransport(name).(pusher); ok {
+			r, err := p.push(m.ctx, m.tmpDir, ref)
+			if err != nil {
+				return err
+			}
+			m.outputDigest = r.digest
+			m.reportPush(r)
+			return nil
+		}
+		return packImage(m.ctx, m.tmpDir, output)
+	})
+}
+
+// build melts the image unpacked into tmpDir in place.
+func (m *state) build() error {
+	err := m.load()
+	if err != nil {
+		return err
+	}
+
+	err = m.classifyLayers()
+	if err != nil {
+		return err
+	}
+
+	err = m.planLayers()
+	if err != nil {
+		return err
+	}
+
+	err = m.phase(PhaseUnpack)
+	if err != nil {
+		return err
+	}
+	err = m.unpackLayers()
+	if err != nil {
+		return err
+	}
+
+	err = m.phase(PhaseMerge)
+	if err != nil {
+		return err
+	}
+	err = m.mergeLayers()
+	if err != nil {
+		return err
+	}
+	err = m.alignImages(false)
+	if err != nil {
+		return err
+	}
+	err = m.verifyCapabilities()
+	if err != nil {
+		return err
+	}
+	err = m.checkCaseCollisions()
+	if err != nil {
+		return err
+	}
+	err = m.checkSymlinks()
+	if err != nil {
+		return err
+	}
+
+	err = m.phase(PhaseHash)
+	if err != nil {
+		return err
+	}
+	err = m.hashLayers()
+	if err != nil {
+		return err
+	}
+	err = m.reportLostMetadata()
+	if err != nil {
+		return err
+	}
+
+	err = m.phase(PhaseWrite)
+	if err != nil {
+		return err
+	}
+	err = m.writeConfigs()
+	if err != nil {
+		return err
+	}
+	return m.writeManifest()
+}
+
+// load reads manifest.json and the image configurations it references, checks
+// that they line up and drops empty layers.
+func (m *state) load() error {
+	err := m.convertOCILayout()
+	if err != nil {
+		return err
+	}
+	err = m.manifest.Load(filepath.Join(m.tmpDir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	if m.opts.keepOriginal {
+		m.original = m.manifest.rawJSON
+	}
+	// Some tools save every tag of an image as an entry of its own. Those
+	// are melted once and written as a single entry with all tags.
+	merged, err := m.manifest.mergeDuplicates()
+	if err != nil {
+		return err
+	}
+	if merged {
+		m.opts.logger.Info("merged manifest entries sharing their image", "images", len(m.manifest.Manifest))
+	}
+	if m.opts.tags != nil && len(m.manifest.Manifest) != 1 {
+		return errors.New("Tags can only be set for an input with a single image.")
+	}
+
+	decompressed := make(map[string]bool)
+	for _, mf := range m.manifest.Manifest {
+		for _, l := range mf.layers {
+			if decompressed[l] {
+				continue
+			}
+			err = m.materialize(l)
+			if err != nil {
+				return err
+			}
+			err = m.decompressLayer(l)
+			if err != nil {
+				return err
+			}
+			decompressed[l] = true
+		}
+	}
+
+	m.configs = make([]ImageConfig, len(m.manifest.Manifest))
+	for i, val := range m.manifest.Manifest {
+		conf := val.ConfigHash
+		if conf == "" {
+			continue
+		}
+		err = m.materialize(conf)
+		if err != nil {
+			return err
+		}
+		err = m.configs[i].Load(filepath.Join(m.tmpDir, conf))
+		if err != nil {
+			return err
+		}
+		m.manifest.Manifest[i].config = &m.configs[i]
+	}
+	err = m.verifyInput()
+	if err != nil {
+		return err
+	}
+	err = m.alignImages(m.opts.repair)
+	if err != nil {
+		return err
+	}
+	err = m.addBaseRootfs()
+	if err != nil {
+		return err
+	}
+	return m.dropEmptyLayers()
+}
+
+// classifyLayers fills in allLayers and checks whether it is worth doing any
+// work at all.
+func (m *state) classifyLayers() error {
+	numManifest := len(m.manifest.Manifest)
+	var numLayers int
+	for _, val := range m.manifest.Manifest {
+		numLayers += len(val.layers)
+	}
+
+	if numLayers <= 1 {
+		return ErrSingleLayer
+	}
+
+	// Let m be the runtime of the outer loop, n the runtime of the inner
+	// loop. Then adding all keys has complexity O(m*n).
+	m.allLayers = make(map[string]int, numLayers)
+	for _, val := range m.manifest.Manifest {
+		for _, lay := range val.layers {
+			if ret, ok := m.allLayers[lay]; !ok {
+				m.allLayers[lay] = 0 // unique layer
+			} else if ret == 0 { // only set it when it isn't already set
+				m.allLayers[lay]++ // shared layer
+			}
+		}
+	}
+
+	// The next checks only make sense when we found multiple config objects
+	// in the manifest.json file. Otherwise this is pointless work.
+	if numManifest > 1 {
+		var uniqueLayers int
+		for _, val := range m.allLayers {
+			if val == 0 {
+				uniqueLayers++
+			}
+		}
+		if uniqueLayers == 0 {
+			return ErrAllShared
+		}
+	}
+	return nil
+}
+
+// planLayers asks the planner which layers to melt together.
+func (m *state) planLayers() error {
+	images := make([][]string, 0, len(m.manifest.Manifest))
+	for _, mf := range m.manifest.Manifest {
+		images = append(images, mf.layers)
+	}
+	if m.opts.sizeReport != nil {
+		// Melting edits the layers of the manifest in place.
+		for _, layers := range images {
+			m.origLayers = append(m.origLayers, append([]string(nil), layers...))
+		}
+	}
+	planner := m.opts.planner
+	if m.opts.minLayerSize > 0 {
+		sizes := make(map[string]int64, len(m.allLayers))
+		for l := range m.allLayers {
+			fi, err := os.Stat(filepath.Join(m.tmpDir, l))
+			if err != nil {
+				return err
+			}
+			sizes[l] = fi.Size()
+		}
+		planner = smallLayersPlanner(func(l string) bool {
+			return sizes[l] < m.opts.minLayerSize
+		})
+	}
+	if m.opts.base != "" {
+		keep, err := m.baseLayers()
+		if err != nil {
+			return err
+		}
+		m.base = keep
+		planner = keepLayers(keep, planner)
+	}
+	var plan Plan
+	var err error
+	if m.opts.ranges != nil {
+		plan, err = m.rangePlan()
+	} else {
+		plan, err = planner(images)
+	}
+	if err != nil {
+		return err
+	}
+	err = plan.check(images)
+	if err != nil {
+		return err
+	}
+	m.plan = plan
+
+	hasMembers := make(map[string]bool)
+	for l := range m.allLayers {
+		if r := plan.root(l); r != l {
+			hasMembers[r] = true
+		}
+	}
+	m.untouched = make(map[string]bool)
+	for l := range m.allLayers {
+		if plan.root(l) == l && !hasMembers[l] {
+			m.untouched[l] = true
+		}
+	}
+	m.origDiffID = make(map[string]string)
+	for _, mf := range m.manifest.Manifest {
+		if mf.config == nil || len(mf.config.RootFS.DiffIDs) != len(mf.layers) {
+			return errors.New("Corrupt image configuration file.")
+		}
+		for j, l := range mf.layers {
+			m.origDiffID[l] = string(mf.config.RootFS.DiffIDs[j])
+		}
+	}
+	m.planImages()
+	m.keySources()
+	err = m.planReuse()
+	if err != nil {
+		return err
+	}
+	if m.recordsEntries() {
+		m.sources = m.meltSources()
+		m.entries = make(map[string][]overlayEntry[fileMeta])
+		m.lost = make(map[string]map[string]bool)
+	}
+	return nil
+}
+
+// runWorkers runs all jobs with at most the configured number of workers
+// running concurrently, fewer if the file descriptors run short. All errors
+// are logged and the first one is returned.
+func (m *state) runWorkers(jobs []func() error) error {
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+
+	for _, job := range jobs {
+		m.workers.acquire()
+		if err := m.ctx.Err(); err != nil {
+			m.workers.release()
+			errMutex.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			errMutex.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func(job func() error) {
+			defer func() {
+				m.workers.release()
+				wg.Done()
+			}()
+			err := job()
+			if err != nil {
+				m.opts.logger.Error(err.Error())
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMutex.Unlock()
+			}
+		}(job)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// unpackLayers unpacks the layer.tar of every layer into the layer
+// subdirectory of the layer.
+func (m *state) unpackLayers() error {
+	m.sizes = make(map[string]int64, len(m.allLayers))
+	m.gzSizes = make(map[string]int64, len(m.allLayers))
+	jobs := make([]func() error, 0, len(m.allLayers))
+	for key := range m.allLayers {
+		fi, err := os.Stat(filepath.Join(m.tmpDir, key))
+		if err != nil {
+			return err
+		}
+		m.sizes[key] = fi.Size()
+		if layerDir := ownDir(key); layerDir != "" {
+			direntries, err := ioutil.ReadDir(filepath.Join(m.tmpDir, layerDir))
+			if err != nil {
+				return err
+			}
+			// There usually are only a few (<=3) entries per
+			// directory so there's no point in using goroutines
+			// for this.
+			for _, val := range direntries {
+				curName := val.Name()
+				if curName == path.Base(key) {
+					continue
+				}
+				err = os.Remove(filepath.Join(m.tmpDir, layerDir, curName))
+				if err != nil {
+					err = m.degrade(err.Error())
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if m.untouched[key] {
+			if m.opts.sizeReport != nil {
+				key := key
+				jobs = append(jobs, func() error {
+					return m.measureLayer(key, false)
+				})
+			}
+			continue
+		}
+		if m.opts.keepOriginal {
+			err = m.saveOriginal(key)
+			if err != nil {
+				return err
+			}
+		}
+		if prev, ok := m.reuse[key]; ok {
+			key := key
+			jobs = append(jobs, func() error {
+				err := m.measureLayer(key, false)
+				if err != nil {
+					return err
+				}
+				return m.reuseLayer(key, prev)
+			})
+			continue
+		}
+		if m.reusedSources[key] {
+			// Nothing is merged from it, so it is removed right
+			// away.
+			key := key
+			jobs = append(jobs, func() error {
+				err := m.measureLayer(key, false)
+				if err != nil {
+					return err
+				}
+				return m.removeLayer(key)
+			})
+			continue
+		}
+		// Unpacking everything under sha-hash/layer
+		tmptar := unpackDir(key)
+		err = os.Mkdir(filepath.Join(m.tmpDir, tmptar), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Chmod(filepath.Join(m.tmpDir, tmptar), 0755)
+		if err != nil {
+			return err
+		}
+		key, size := key, m.sizes[key]
+		jobs = append(jobs, m.budgeted(size, func() error {
+			err := m.measureLayer(key, false)
+			if err != nil {
+				return err
+			}
+			err = m.dropUnsupported(key)
+			if err != nil {
+				return err
+			}
+			err = m.recordEntries(key)
+			if err != nil {
+				return err
+			}
+			err = m.retry("Extracting "+key, func() error {
+				return m.withUmask(func() error {
+					return tarski.Extract(filepath.Join(m.tmpDir, key), filepath.Join(m.tmpDir, tmptar))
+				})
+			})
+			if err != nil {
+				return err
+			}
+			m.emit(Event{Type: LayerExtracted, Layer: key, Bytes: size})
+			return nil
+		}))
+	}
+	err := m.runWorkers(jobs)
+	if err != nil || m.reuse == nil {
+		return err
+	}
+	// The reused layers are linked or copied into the archive by now.
+	return os.RemoveAll(filepath.Join(m.workDir, previousDir))
+}
+
+// meltTime returns the time to record for melted layers. It has a resolution
+// of seconds like the timestamps in the annotations.
+func (m *state) meltTime() time.Time {
+	if !m.opts.created.IsZero() {
+		return m.opts.created.Truncate(time.Second)
+	}
+	if !m.meltedAt.IsZero() {
+		return m.meltedAt
+	}
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// annotation returns the note recorded in the history entry n layers were
+// melted into so that consumers can tell a melted image from an original one.
+func (m *state) annotation(n int, sources string) string {
+	note := fmt.Sprintf("go-docker-melt %s: melted %d layers", Version, n)
+	if sources != "" {
+		// WithPrevious finds the melted layer by it.
+		note += " from sources " + sources
+	}
+	note += " on " + m.meltTime().Format(time.RFC3339)
+	if m.opts.invocation != "" {
+		note += " with " + m.opts.invocation
+	}
+	return note
+}
+
+// mergeLayers syncs the layers into their root layers, deletes whiteouts and
+// updates manifest.json and the image configurations accordingly.
+func (m *state) mergeLayers() error {
+	tmpDir := m.tmpDir
+	var err error
+
+	// Whiteouts of layers melted into a root that is not at the bottom of
+	// an image are kept for the layers below it.
+	lower := make(map[string]bool)
+	for _, mf := range m.manifest.Manifest {
+		for j, l := range mf.layers {
+			if j > 0 && m.plan.root(l) == l {
+				lower[l] = true
+			}
+		}
+	}
+
+	for i := 0; i < len(m.manifest.Manifest); i++ {
+		manfst := &m.manifest.Manifest[i]
+		if manfst.config == nil {
+			return errors.New("Corrupt image configuration file.")
+		}
+
+		// Maps the history entry of each root layer to the number of
+		// layers that were melted into it.
+		meltedInto := make(map[int]int)
+		roots := make(map[int]string)
+		rootHist := 0
+		for j, hist := 0, 0; j < len(manfst.layers); j, hist = j+1, hist+1 {
+			if err := m.ctx.Err(); err != nil {
+				return err
+			}
+			layer := &manfst.layers[j]
+			for ; manfst.config.History[hist].EmptyLayer == true; hist++ {
+				// Keep all history entries that do not
+				// correspond to a layer in the tar archive.
+			}
+			rootLayer := m.plan.root(*layer)
+			if rootLayer == *layer {
+				rootHist = hist
+				roots[hist] = rootLayer
+				continue
+			}
+
+			// This layer will be melted into rootLayer.
+			meltFrom := filepath.Join(tmpDir, unpackDir(*layer))
+			meltInto := filepath.Join(tmpDir, unpackDir(rootLayer))
+
+			// melt
+			_, err := os.Stat(meltFrom)
+			if err == nil {
+				err = m.recordCapabilities(meltInto, meltFrom)
+				if err != nil {
+					return err
+				}
+				// Remove the entries of rootLayer that this
+				// layer replaces by a different type, so every
+				// directory of this layer is a directory or
+				// missing in rootLayer.
+				err = replaceTypeChanges(meltFrom, meltInto, lower[rootLayer])
+				if err != nil {
+					return err
+				}
+				// Apply the whiteouts of this layer to
+				// rootLayer before its files are copied.
+				err = applyWhiteouts(meltFrom, meltInto, lower[rootLayer])
+				if err != nil {
+					return err
+				}
+				err = m.checkPermissions(meltFrom, meltInto, *layer, manfst.config.History[hist].CreatedBy)
+				if err != nil {
+					return err
+				}
+				// Merge everything except whiteout files.
+				err = m.backend.merge(m, meltFrom, meltInto)
+				if err == errLabelsLost {
+					err = m.degrade(fmt.Sprintf("SELinux labels of %s could not be preserved on this host.", *layer))
+				}
+				if err != nil {
+					return err
+				}
+				// Delete melted layers.
+				err = m.removeLayer(*layer)
+				if err != nil {
+					return err
+				}
+				m.emit(Event{Type: LayerMerged, Layer: *layer, Bytes: m.sizes[*layer]})
+			}
+
+			meltedInto[rootHist]++
+
+			// Delete corresponding history entry for this layer.
+			manfst.config.delHistoryElem(hist)
+			hist--
+
+			// Delete corresponding diff_ids entry for this layer.
+			manfst.config.delRootfsElem(j)
+			// Delete corresponding layer entry.
+			manfst.delLayerElem(j)
+			j--
+		}
+
+		if !m.opts.noAnnotate {
+			for hist, n := range meltedInto {
+				manfst.config.annotateHistoryElem(hist, m.annotation(n+1, m.sourceKey[roots[hist]]))
+			}
+		}
+
+		if !m.opts.created.IsZero() {
+			ts := m.meltTime()
+			for hist := range meltedInto {
+				manfst.config.History[hist].Created = &ts
+			}
+			if m.opts.canonical {
+				manfst.config.Created = &ts
+			} else {
+				err = manfst.config.updateCreated(ts)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// With canonical JSON the metadata is encoded anew when it
+		// is written.
+		if m.opts.canonical {
+			continue
+		}
+		err = manfst.config.updateHistory()
+		if err != nil {
+			return err
+		}
+
+		err = m.manifest.updateLayers(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareLayer applies the changes made to the files of the melted layer
+// unpacked in dir before it is packed.
+func (m *state) prepareLayer(key string, dir string) error {
+	if m.opts.dereference {
+		err := m.dereference(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if m.opts.breakHardlinks {
+		err := m.breakHardlinks(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.opts.stripXattrs) > 0 {
+		err := m.stripXattrs(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if m.opts.selinux == SELinuxRelabel {
+		err := m.relabel(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.opts.transforms) > 0 {
+		err := m.transformFiles(key, dir)
+		if err != nil {
+			return err
+		}
+	}
+	if m.opts.clamp {
+		return clampMtimes(dir, m.opts.clampMtime)
+	}
+	return nil
+}
+
+// hashLayers packs every remaining layer into its layer.tar and records its
+// new diffID.
+func (m *state) hashLayers() error {
+	m.diffID = make(map[string]string, len(m.allLayers))
+	m.meltedSizes = make(map[string]int64, len(m.allLayers))
+	m.meltedGzSizes = make(map[string]int64, len(m.allLayers))
+	m.stripped = make(map[string]int)
+	// With a test command all layers are prepared before the images are
+	// tested and only packed afterwards.
+	var prepare []func() error
+	jobs := make([]func() error, 0, len(m.allLayers))
+	for key := range m.allLayers {
+		l := filepath.Join(m.tmpDir, key)
+		_, err := os.Stat(l)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if prev, ok := m.reuse[key]; ok {
+			key := key
+			jobs = append(jobs, func() error {
+				return m.finishReused(key, prev)
+			})
+			continue
+		}
+		if m.untouched[key] {
+			m.diffID[key] = m.origDiffID[key]
+			m.meltedSizes[key] = m.sizes[key]
+			m.meltedGzSizes[key] = m.gzSizes[key]
+			m.emit(Event{Type: LayerHashed, Layer: key, Bytes: m.sizes[key], DiffID: m.origDiffID[key]})
+			continue
+		}
+
+		err = os.Remove(l)
+		if err != nil {
+			return err
+		}
+
+		dir := filepath.Join(m.tmpDir, unpackDir(key))
+
+		key, weight := key, m.meltedSize(key)
+		if m.opts.testCmd != "" {
+			prepare = append(prepare, m.budgeted(weight, func() error {
+				return m.prepareLayer(key, dir)
+			}))
+		}
+		jobs = append(jobs, m.budgeted(weight, func() error {
+			if m.opts.testCmd == "" {
+				err := m.prepareLayer(key, dir)
+				if err != nil {
+					return err
+				}
+			}
+			exp := m.expectedMeta(key)
+			if m.opts.preserveAtime {
+				err := restoreAtimes(dir, exp, m.atimeClamp())
+				if err != nil {
+					return err
+				}
+			}
+			var checksum []byte
+			err := m.retry("Packing "+key, func() error {
+				var err error
+				checksum, err = tarski.CreateSHA256(l, dir, dir)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if m.opts.preserveAtime {
+				checksum, err = writeAtimes(l, exp, m.atimeClamp())
+				if err != nil {
+					return err
+				}
+			}
+			err = m.verifyMetadata(key, exp)
+			if err != nil {
+				return err
+			}
+			diffID := "sha256:" + hex.EncodeToString(checksum)
+			m.diffIDMutex.Lock()
+			m.diffID[key] = diffID
+			m.diffIDMutex.Unlock()
+			err = os.RemoveAll(dir)
+			if err != nil {
+				return err
+			}
+			var size int64
+			if fi, err := os.Stat(l); err == nil {
+				size = fi.Size()
+			}
+			m.sizesMutex.Lock()
+			m.meltedSizes[key] = size
+			m.sizesMutex.Unlock()
+			err = m.measureLayer(key, true)
+			if err != nil {
+				return err
+			}
+			if m.compresses(CompressLayers) {
+				err = gzipFile(l, l, m.opts.compressionLevel)
+				if err != nil {
+					return err
+				}
+			}
+			m.emit(Event{Type: LayerHashed, Layer: key, Bytes: size, DiffID: diffID})
+			return nil
+		}))
+	}
+	if m.opts.testCmd != "" {
+		err := m.runWorkers(prepare)
+		if err != nil {
+			return err
+		}
+		err = m.testImages()
+		if err != nil {
+			return err
+		}
+	}
+	err := m.runWorkers(jobs)
+	if err != nil {
+		return err
+	}
+	m.reportStripped()
+	m.reportBrokenLinks()
+	return nil
+}
+
+// writeConfigs records the new diffIDs in the image configurations and
+// writes them out under their new digest.
+func (m *state) writeConfigs() error {
+	for i := 0; i < len(m.manifest.Manifest); i++ {
+		mf := &m.manifest.Manifest[i]
+		for j := 0; j < len(mf.layers); j++ {
+			l := &mf.layers[j]
+			mf.config.RootFS.DiffIDs[j] = digest.Digest(m.diffID[*l])
+		}
+		var err error
+		if m.opts.canonical {
+			mf.config.rawJSON, err = mf.config.canonicalJSON()
+		} else {
+			err = mf.config.updateRootfs()
+		}
+		if err != nil {
+			return err
+		}
+		mf.config.rawJSON, err = m.formatJSON(mf.config.rawJSON)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(mf.config.rawJSON)
+		name := hex.EncodeToString(sum[:]) + ".json"
+		err = ioutil.WriteFile(filepath.Join(m.tmpDir, name), mf.config.rawJSON, 0666)
+		if err != nil {
+			return err
+		}
+		if name != mf.ConfigHash && !m.opts.keepOriginal {
+			err = os.Remove(filepath.Join(m.tmpDir, mf.ConfigHash))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		mf.ConfigHash = name
+		mf.config.release()
+	}
+	return nil
+}
+
+// writeManifest writes manifest.json with the new names of the image
+// configurations and the tags set with WithTags and the repositories file
+// matching it. With WithKeepOriginal the original images are added as well.
+func (m *state) writeManifest() error {
+	for i := range m.manifest.Manifest {
+		mf := &m.manifest.Manifest[i]
+		if m.opts.tags != nil {
+			mf.RepoTags = m.opts.tags
+			err := m.manifest.setField(i, "RepoTags", mf.RepoTags)
+			if err != nil {
+				return err
+			}
+		}
+		err := m.manifest.setField(i, "Config", mf.ConfigHash)
+		if err != nil {
+			return err
+		}
+		if m.opts.annotations != nil {
+			err = m.manifest.mergeAnnotations(i, m.opts.annotations)
+			if err != nil {
+				return err
+			}
+		}
+		if mf.config != nil {
+			err = m.manifest.pruneLayerSources(i, mf.config.diffIDs())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	manifest := &m.manifest
+	if m.opts.keepOriginal {
+		var err error
+		manifest, err = m.withOriginal()
+		if err != nil {
+			return err
+		}
+	}
+	buf := manifest.rawJSON
+	if m.opts.canonical {
+		var err error
+		buf, err = manifest.canonicalJSON()
+		if err != nil {
+			return err
+		}
+	}
+	buf, err := m.formatJSON(buf)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(m.tmpDir, "manifest.json"), buf, 0666)
+	if err != nil {
+		return err
+	}
+	m.manifest.rawJSON = nil
+	return writeRepositories(m.tmpDir)
+}
+
+// removeLayer removes the tarball of a layer that was melted into another one
+// and everything that belongs to it.
+func (m *state) removeLayer(layer string) error {
+	if dir := ownDir(layer); dir != "" {
+		return os.RemoveAll(filepath.Join(m.tmpDir, dir))
+	}
+	err := os.Remove(filepath.Join(m.tmpDir, layer))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(m.tmpDir, unpackDir(layer)))
+}
@@ -0,0 +1,268 @@
+package melt
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Depending on the rsync on the host, the filesystem below the temporary
+// directory and the privileges of the melt, metadata can get lost between
+// extracting the source layers and packing the melted ones without any step
+// failing. The headers of every layer that is melted are therefore recorded
+// when it is unpacked and compared with the headers of the melted layer once
+// it is packed.
+
+const xattrRecord = "SCHILY.xattr."
+
+// WithMetadataCheck sets how metadata lost while melting is reported: modes,
+// owners, modification times and xattrs, including ACLs, of files that do not
+// end up in the melted layer like in the topmost source layer containing them.
+// Changes made on purpose, like stripped xattrs or clamped times, are not
+// reported. Layers rewritten by file transforms are not checked. It defaults
+// to CheckWarn, WithStrict turns it into CheckFail.
+func WithMetadataCheck(mode CheckMode) Option {
+	return func(o *options) {
+		o.metaCheck = mode
+	}
+}
+
+// fileMeta is the metadata of a layer entry that has to survive melting.
+type fileMeta struct {
+	typeflag byte
+	mode     int64
+	uid      int
+	gid      int
+	mtime    time.Time
+	atime    time.Time
+	xattrs   map[string]string
+}
+
+func headerMeta(hdr *tar.Header) fileMeta {
+	meta := fileMeta{
+		typeflag: hdr.Typeflag,
+		mode:     hdr.Mode & 07777,
+		uid:      hdr.Uid,
+		gid:      hdr.Gid,
+		mtime:    hdr.ModTime,
+		atime:    hdr.AccessTime,
+	}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, xattrRecord) {
+			if meta.xattrs == nil {
+				meta.xattrs = make(map[string]string)
+			}
+			meta.xattrs[strings.TrimPrefix(k, xattrRecord)] = v
+		}
+	}
+	return meta
+}
+
+// readEntries returns the entries of the layer tarball file. Hardlinks carry
+// the metadata of the file they link to and are left out.
+func readEntries(file string) ([]overlayEntry[fileMeta], error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []overlayEntry[fileMeta]
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeLink || hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if name == "." {
+			continue
+		}
+		entries = append(entries, overlayEntry[fileMeta]{name: name, dir: hdr.Typeflag == tar.TypeDir, value: headerMeta(hdr)})
+	}
+}
+
+// checksMetadata reports whether the metadata of melted layers is checked.
+func (m *state) checksMetadata() bool {
+	return m.opts.metaCheck != CheckOff && len(m.opts.transforms) == 0
+}
+
+// recordsEntries reports whether the entries of melted layers are recorded,
+// for the metadata check or to restore access times.
+func (m *state) recordsEntries() bool {
+	return m.checksMetadata() || m.opts.preserveAtime
+}
+
+// recordEntries keeps the entries of layer before it is unpacked.
+func (m *state) recordEntries(layer string) error {
+	if !m.recordsEntries() {
+		return nil
+	}
+	entries, err := readEntries(filepath.Join(m.tmpDir, layer))
+	if err != nil {
+		return err
+	}
+	m.metaMutex.Lock()
+	m.entries[layer] = entries
+	m.metaMutex.Unlock()
+	return nil
+}
+
+// meltSources maps every root layer with layers melted into it to itself
+// followed by those layers from the bottom to the top.
+func (m *state) meltSources() map[string][]string {
+	sources := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, mf := range m.manifest.Manifest {
+		for _, l := range mf.layers {
+			if seen[l] || m.untouched[l] {
+				continue
+			}
+			seen[l] = true
+			r := m.plan.root(l)
+			sources[r] = append(sources[r], l)
+		}
+	}
+	return sources
+}
+
+// expectedMeta returns the metadata the files of the melted root layer are
+// expected to have: that of the topmost source layer containing them. It
+// returns nil if entries are not recorded.
+func (m *state) expectedMeta(root string) map[string]fileMeta {
+	if !m.recordsEntries() {
+		return nil
+	}
+	exp := newOverlay[fileMeta]()
+	m.metaMutex.Lock()
+	defer m.metaMutex.Unlock()
+	for _, l := range m.sources[root] {
+		exp.apply(m.entries[l])
+		delete(m.entries, l)
+	}
+	return exp.files
+}
+
+// keepsXattr reports whether the melt is meant to keep the xattr name.
+func (m *state) keepsXattr(name string) bool {
+	if matchXattr(name, m.opts.stripXattrs) {
+		return false
+	}
+	return name != selinuxXattr || m.opts.selinux == SELinuxPreserve
+}
+
+// metaLosses compares the metadata of a melted file with what it is expected
+// to be and returns what got lost.
+func (m *state) metaLosses(want fileMeta, have fileMeta) []string {
+	var lost []string
+	if want.mode != have.mode {
+		lost = append(lost, "mode")
+	}
+	if want.uid != have.uid || want.gid != have.gid {
+		lost = append(lost, "owner")
+	}
+	mtime := want.mtime
+	if m.opts.clamp && mtime.After(m.opts.clampMtime) {
+		mtime = m.opts.clampMtime
+	}
+	// Directory times change whenever their content does.
+	if want.typeflag != tar.TypeDir && !mtime.Equal(have.mtime) {
+		if mtime.Truncate(time.Second).Equal(have.mtime.Truncate(time.Second)) {
+			lost = append(lost, "sub-second modification time")
+		} else {
+			lost = append(lost, "modification time")
+		}
+	}
+	for name, v := range want.xattrs {
+		if !m.keepsXattr(name) || have.xattrs[name] == v {
+			continue
+		}
+		if strings.HasPrefix(name, "system.posix_acl_") {
+			lost = append(lost, "ACL "+name)
+		} else {
+			lost = append(lost, "xattr "+name)
+		}
+	}
+	return lost
+}
+
+// verifyMetadata compares the entries of the packed root layer with exp, the
+// metadata expected from the layers melted into it, and records the paths of the files
+// whose metadata got lost. Files that were removed, replaced by a different
+// type or renamed are skipped.
+func (m *state) verifyMetadata(root string, exp map[string]fileMeta) error {
+	if !m.checksMetadata() {
+		return nil
+	}
+	entries, err := readEntries(filepath.Join(m.tmpDir, root))
+	if err != nil {
+		return err
+	}
+	m.metaMutex.Lock()
+	defer m.metaMutex.Unlock()
+	for _, e := range entries {
+		want, ok := exp[e.name]
+		if !ok || want.typeflag != e.value.typeflag {
+			continue
+		}
+		for _, what := range m.metaLosses(want, e.value) {
+			if m.lost[what] == nil {
+				m.lost[what] = make(map[string]bool)
+			}
+			m.lost[what][e.name] = true
+		}
+	}
+	return nil
+}
+
+// reportLostMetadata warns about the metadata lost in all melted layers or
+// fails the melt for CheckFail.
+func (m *state) reportLostMetadata() error {
+	kinds := make([]string, 0, len(m.lost))
+	for what := range m.lost {
+		kinds = append(kinds, what)
+	}
+	sort.Strings(kinds)
+	msgs := make([]string, 0, len(kinds))
+	for _, what := range kinds {
+		files := make([]string, 0, len(m.lost[what]))
+		for f := range m.lost[what] {
+			files = append(files, f)
+		}
+		sort.Strings(files)
+		listed := files
+		if len(listed) > maxListed {
+			listed = listed[:maxListed]
+		}
+		noun := "files"
+		if len(files) == 1 {
+			noun = "file"
+		}
+		msg := fmt.Sprintf("Lost the %s of %d %s while melting: %s", what, len(files), noun, strings.Join(listed, ", "))
+		if len(listed) < len(files) {
+			msg += ", ..."
+		}
+		msgs = append(msgs, msg+".")
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if m.opts.metaCheck == CheckFail || m.opts.strict {
+		return fmt.Errorf("Metadata was lost while melting: %s", strings.Join(msgs, " "))
+	}
+	for _, msg := range msgs {
+		m.warn(msg)
+	}
+	return nil
+}
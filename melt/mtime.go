@@ -0,0 +1,30 @@
+package melt
+
+import (
+	"os"
+	"time"
+)
+
+// WithClampMtime clamps the access and modification times of all files in
+// melted layers to t. Files with an older modification time are left alone.
+// With a fixed t melted layers are byte-stable across rebuilds of the same
+// content and passing the epoch zeroes all timestamps.
+func WithClampMtime(t time.Time) Option {
+	return func(o *options) {
+		o.clampMtime = t
+		o.clamp = true
+	}
+}
+
+// clampMtimes clamps the times of dir and everything below it to t.
+func clampMtimes(dir string, t time.Time) error {
+	return walkTree(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().After(t) {
+			return nil
+		}
+		return lutimes(path, t)
+	})
+}
@@ -0,0 +1,35 @@
+package melt
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+// lutimes sets the access and modification times of path to t without
+// following symlinks.
+func lutimes(path string, t time.Time) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(t.UnixNano()),
+		unix.NsecToTimespec(t.UnixNano()),
+	}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return &os.PathError{Op: "utimensat", Path: path, Err: err}
+	}
+	return nil
+}
+
+// latime sets the access time of path to t without following symlinks and
+// without touching its modification time.
+func latime(path string, t time.Time) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(t.UnixNano()),
+		{Nsec: unix.UTIME_OMIT},
+	}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return &os.PathError{Op: "utimensat", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+package melt
+
+import (
+	"os"
+	"time"
+)
+
+// lutimes sets the access and modification times of path to t. Without
+// utimensat(2) the times of a symlink cannot be set without following it, so
+// symlinks keep theirs.
+func lutimes(path string, t time.Time) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(path, t, t)
+}
+
+// latime sets the access time of path to t and keeps its modification time.
+// Symlinks keep their times.
+func latime(path string, t time.Time) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(path, t, fi.ModTime())
+}
@@ -0,0 +1,96 @@
+package melt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/brauner/tarski"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// objectTransport handles docker save tarballs in object storage, like
+// s3://bucket/key or gs://bucket/key, by copying them with the command line
+// tool of the provider. Both directions are staged once in the work
+// directory: downloads are written into an archive there and checked before
+// they are extracted, and uploads are packed into an archive there with
+// tarski, which only writes files, before the tool reads it.
+type objectTransport struct {
+	name string
+	// cmd copies from its first to its second argument, - standing for
+	// standard input or output.
+	cmd []string
+	// sizeFlag passes the size of an upload read from standard input,
+	// which lets the tool pick large enough parts.
+	sizeFlag string
+}
+
+func (t objectTransport) run(ctx context.Context, from string, to string, args []string, stdin *os.File, stdout *os.File) error {
+	args = append(append(append([]string{}, t.cmd[1:]...), args...), from, to)
+	cmd := exec.CommandContext(ctx, t.cmd[0], args...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, &stderr
+	err := cmd.Run()
+	if err != nil {
+		// Most failures are caused by the network or the provider.
+		return &transientError{fmt.Errorf("Failed to copy %s to %s: %s: %s", from, to, err, strings.TrimSpace(stderr.String()))}
+	}
+	return nil
+}
+
+func (t objectTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	archive, err := tempArchive(dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	err = t.run(ctx, t.name+":"+ref, "-", nil, nil, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return extractTar(archive, dir)
+}
+
+func (t objectTransport) Pack(ctx context.Context, dir string, ref string) error {
+	archive, err := tempArchive(dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+
+	err = tarski.Create(archive, dir, dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var args []string
+	if t.sizeFlag != "" {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		args = append(args, t.sizeFlag, strconv.FormatInt(fi.Size(), 10))
+	}
+	return t.run(ctx, "-", t.name+":"+ref, args, f, nil)
+}
+
+func init() {
+	RegisterTransport("s3", objectTransport{name: "s3", cmd: []string{"aws", "s3", "cp"}, sizeFlag: "--expected-size"})
+	RegisterTransport("gs", objectTransport{name: "gs", cmd: []string{"gcloud", "storage", "cp"}})
+}
@@ -0,0 +1,110 @@
+package melt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociTransport reads OCI image layouts, directories with oci: and tarballs
+// with oci-archive:, without skopeo. They are converted when they are loaded
+// like any archive holding only an OCI image layout, which keeps their
+// annotations. Writing them is left to skopeo, unless FormatOCI writes the
+// layout itself.
+type ociTransport struct {
+	skopeoTransport
+	archive bool
+}
+
+// splitOCIReference splits ref, like skopeo does, into the path of the layout
+// and the optional name of an image in it, the value of its
+// org.opencontainers.image.ref.name annotation.
+func splitOCIReference(ref string) (string, string) {
+	p, name, _ := strings.Cut(ref, ":")
+	return p, name
+}
+
+func (t ociTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	p, name := splitOCIReference(ref)
+	var err error
+	if t.archive {
+		err = extractTar(p, dir)
+	} else {
+		err = copyDir(ctx, p, dir)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(dir, "index.json"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is not an OCI image layout.", p)
+	}
+	if err != nil || name == "" {
+		return err
+	}
+	return selectOCIImage(dir, name)
+}
+
+// selectOCIImage removes every manifest but the ones named name from the index
+// of the OCI image layout in dir. A manifest.json next to it describes all
+// images and is removed, so it is written anew for the selected ones.
+func selectOCIImage(dir string, name string) error {
+	file := filepath.Join(dir, "index.json")
+	buf, err := readMetadata(file, MaxManifestSize)
+	if err != nil {
+		return err
+	}
+	// Only manifests is decoded, so that all other fields are kept.
+	var index map[string]json.RawMessage
+	err = json.Unmarshal(buf, &index)
+	if err != nil {
+		return fmt.Errorf("Corrupt OCI image index %s: %v", file, err)
+	}
+	var manifests []json.RawMessage
+	err = json.Unmarshal(index["manifests"], &manifests)
+	if err != nil {
+		return fmt.Errorf("Corrupt OCI image index %s: %v", file, err)
+	}
+	var selected []json.RawMessage
+	for _, raw := range manifests {
+		var d v1.Descriptor
+		err = json.Unmarshal(raw, &d)
+		if err != nil {
+			return fmt.Errorf("Corrupt OCI image index %s: %v", file, err)
+		}
+		if d.Annotations[annotationRefName] == name {
+			selected = append(selected, raw)
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("No image named %s in the OCI image layout.", name)
+	}
+
+	index["manifests"], err = json.Marshal(selected)
+	if err != nil {
+		return err
+	}
+	buf, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, buf, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func init() {
+	RegisterTransport("oci", ociTransport{skopeoTransport{"oci"}, false})
+	RegisterTransport("oci-archive", ociTransport{skopeoTransport{"oci-archive"}, true})
+}
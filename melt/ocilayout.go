@@ -0,0 +1,301 @@
+package melt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The OCI output format stores the melted images as an OCI image layout
+// instead of a docker save archive: index.json, oci-layout and the manifests,
+// configurations and layers as blobs, named after their digests. It is
+// written like archives are, so all transports of the file system work:
+//
+//   - docker-archive:path, oci-archive:path and plain paths write a tarball,
+//     the oci-archive format of skopeo and podman.
+//   - dir:path and oci:path write the layout into a directory.
+//
+// oci:path:name and oci-archive:path:name name the image in the layout, which
+// then has to hold a single image. Otherwise every tag of an image gets an
+// entry in index.json, with the tag in org.opencontainers.image.ref.name and
+// the full name in io.containerd.image.name like docker save writes them.
+
+// FormatOCI writes the melted images as an OCI image layout to the output.
+const FormatOCI OutputFormat = "oci"
+
+const ociLayoutVersion = "1.0.0"
+
+// ociOutput returns the reference the OCI image layout is written to with
+// Pack and the name given to its image, if any.
+func ociOutput(output string) (string, string, error) {
+	name, ref := ParseReference(output)
+	refName := ""
+	switch name {
+	case "oci", "oci-archive":
+		ref, refName = splitOCIReference(ref)
+	case "docker-archive", "dir":
+	default:
+		return "", "", fmt.Errorf("The %s output format only writes tarballs and directories, not %s.", FormatOCI, output)
+	}
+	if name == "oci" || name == "dir" {
+		return "dir:" + ref, refName, nil
+	}
+	return "docker-archive:" + ref, refName, nil
+}
+
+// writeOCI turns the melted archive in tmpDir into an OCI image layout and
+// writes it to output.
+func (m *state) writeOCI(output string) error {
+	target, refName, err := ociOutput(output)
+	if err != nil {
+		return err
+	}
+	if refName != "" && len(m.manifest.Manifest) != 1 {
+		return fmt.Errorf("Only a single image can be named %s.", refName)
+	}
+	err = m.convertToOCILayout(refName)
+	if err != nil {
+		return err
+	}
+	return m.writeOutput(target)
+}
+
+// convertToOCILayout replaces the docker save archive in tmpDir by an OCI
+// image layout holding the same images. Layers are stored as they are, so
+// compressed layers keep their compression and get the matching media type.
+func (m *state) convertToOCILayout(refName string) error {
+	annotations, err := manifestAnnotations(filepath.Join(m.tmpDir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(m.tmpDir, "blobs", "sha256"), 0755)
+	if err != nil {
+		return err
+	}
+	// keep holds the blobs of the layout.
+	keep := make(map[string]bool)
+
+	// Files are moved into blobs/ after all images are described, since
+	// images may share layers and configurations.
+	moved := make(map[string]v1.Descriptor)
+	describe := func(file string, mediaType types.MediaType) (v1.Descriptor, error) {
+		if d, ok := moved[file]; ok {
+			return d, nil
+		}
+		p := filepath.Join(m.tmpDir, file)
+		diffID, err := layerDiffID(p)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		digest, err := v1.NewHash(diffID)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		if mediaType == "" {
+			mediaType, err = ociLayerMediaType(p)
+			if err != nil {
+				return v1.Descriptor{}, err
+			}
+		}
+		d := v1.Descriptor{MediaType: mediaType, Digest: digest, Size: info.Size()}
+		moved[file] = d
+		return d, nil
+	}
+
+	var index v1.IndexManifest
+	index.SchemaVersion = 2
+	index.MediaType = types.OCIImageIndex
+	for i, mf := range m.manifest.Manifest {
+		config, err := describe(mf.ConfigHash, types.OCIConfigJSON)
+		if err != nil {
+			return err
+		}
+		manifest := v1.Manifest{
+			SchemaVersion: 2,
+			MediaType:     types.OCIManifestSchema1,
+			Config:        config,
+			Layers:        []v1.Descriptor{},
+		}
+		if i < len(annotations) {
+			manifest.Annotations = annotations[i]
+		}
+		for _, l := range mf.layers {
+			d, err := describe(l, "")
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, d)
+		}
+		d, err := writeBlob(m.tmpDir, types.OCIManifestSchema1, manifest)
+		if err != nil {
+			return err
+		}
+		blob, err := blobPath(d.Digest)
+		if err != nil {
+			return err
+		}
+		keep[blob] = true
+		if mf.config != nil && mf.config.OS != "" {
+			d.Platform = &v1.Platform{
+				Architecture: mf.config.Architecture,
+				OS:           mf.config.OS,
+				Variant:      mf.config.Variant,
+			}
+		}
+
+		switch {
+		case refName != "":
+			d.Annotations = map[string]string{annotationRefName: refName}
+			index.Manifests = append(index.Manifests, d)
+		case len(mf.RepoTags) == 0:
+			index.Manifests = append(index.Manifests, d)
+		default:
+			for _, t := range mf.RepoTags {
+				_, tag := SplitTag(t)
+				tagged := d
+				tagged.Annotations = map[string]string{
+					annotationImageName: t,
+					annotationRefName:   tag,
+				}
+				index.Manifests = append(index.Manifests, tagged)
+			}
+		}
+	}
+
+	for file, d := range moved {
+		blob, err := blobPath(d.Digest)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(m.tmpDir, file), filepath.Join(m.tmpDir, blob))
+		if err != nil {
+			return err
+		}
+		keep[blob] = true
+	}
+
+	// Everything else is removed: manifest.json, repositories, the
+	// directories of the layers with their legacy files and the blobs of
+	// OCI inputs that were not written anew.
+	var dirs []string
+	err = walkTree(m.tmpDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(m.tmpDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		}
+		if keep[filepath.ToSlash(rel)] {
+			return nil
+		}
+		return os.Remove(p)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = IsEmptyDir(dirs[i])
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			err = os.Remove(dirs[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(m.tmpDir, "index.json"), buf, 0644)
+	if err != nil {
+		return err
+	}
+	layout := fmt.Sprintf(`{"imageLayoutVersion":%q}`, ociLayoutVersion)
+	return ioutil.WriteFile(filepath.Join(m.tmpDir, "oci-layout"), []byte(layout), 0644)
+}
+
+// writeBlob stores the JSON encoding of v in the blobs of the OCI image layout
+// in dir and returns its descriptor.
+func writeBlob(dir string, mediaType types.MediaType, v interface{}) (v1.Descriptor, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	sum := sha256.Sum256(buf)
+	d := v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])},
+		Size:      int64(len(buf)),
+	}
+	blob, err := blobPath(d.Digest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return d, ioutil.WriteFile(filepath.Join(dir, blob), buf, 0644)
+}
+
+// ociLayerMediaType returns the media type of the layer stored in file,
+// which depends on its compression.
+func ociLayerMediaType(file string) (types.MediaType, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return types.OCILayer, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return types.OCILayerZStd, nil
+	}
+	return types.OCIUncompressedLayer, nil
+}
+
+// manifestAnnotations returns the Annotations fields of the entries of the
+// manifest.json file.
+func manifestAnnotations(file string) ([]map[string]string, error) {
+	buf, err := readMetadata(file, MaxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Annotations map[string]string
+	}
+	err = json.Unmarshal(buf, &entries)
+	if err != nil {
+		return nil, errors.New("Corrupt manifest file.")
+	}
+	annotations := make([]map[string]string, len(entries))
+	for i, e := range entries {
+		annotations[i] = e.Annotations
+	}
+	return annotations, nil
+}
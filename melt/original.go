@@ -0,0 +1,140 @@
+package melt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// originalDir is the directory of the archive the original layers are kept
+// in with WithKeepOriginal.
+const originalDir = "original"
+
+// WithKeepOriginal keeps the original images in the output next to the melted
+// ones so both can be compared after a single load. The original images keep
+// their tags, the tags of the melted images get suffix appended. Only the
+// docker-archive output format supports it.
+func WithKeepOriginal(suffix string) Option {
+	return func(o *options) {
+		o.keepOriginal = true
+		o.meltedSuffix = suffix
+	}
+}
+
+// linkOrCopy hardlinks src to dst and falls back to copying it.
+func linkOrCopy(src string, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// saveOriginal keeps the layer.tar of layer before it is unpacked.
+func (m *state) saveOriginal(layer string) error {
+	dst := filepath.Join(m.tmpDir, originalDir, layer)
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	return linkOrCopy(filepath.Join(m.tmpDir, layer), dst)
+}
+
+// withOriginal returns manifest.json with the original images in front of
+// the melted ones. Entries are edited as raw JSON so fields unknown to
+// go-docker-melt are preserved.
+func (m *state) withOriginal() (*RawManifest, error) {
+	var original RawManifest
+	err := original.Parse(m.original)
+	if err != nil {
+		return nil, err
+	}
+	var entries []map[string]json.RawMessage
+	err = json.Unmarshal(original.rawJSON, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for i := range original.Manifest {
+		mf := &original.Manifest[i]
+		for j, l := range mf.layers {
+			if !m.untouched[l] {
+				mf.layers[j] = originalDir + "/" + l
+			}
+		}
+		entries[i]["Layers"], err = json.Marshal(mf.layers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var melted []map[string]json.RawMessage
+	err = json.Unmarshal(m.manifest.rawJSON, &melted)
+	if err != nil {
+		return nil, err
+	}
+	for i, mf := range m.manifest.Manifest {
+		tags := make([]string, len(mf.RepoTags))
+		for j, t := range mf.RepoTags {
+			tags[j] = t + m.opts.meltedSuffix
+		}
+		if len(tags) > 0 {
+			melted[i]["RepoTags"], err = json.Marshal(tags)
+			if err != nil {
+				return nil, err
+			}
+		}
+		mf.RepoTags = tags
+		original.Manifest = append(original.Manifest, mf)
+	}
+
+	original.rawJSON, err = json.Marshal(append(entries, melted...))
+	if err != nil {
+		return nil, err
+	}
+	return &original, nil
+}
+
+// materialize replaces the member name of the unpacked archive by a hardlink
+// to, or a copy of, the file it points to if it is a symlink. Some tools store
+// identical layers once and link to them from the other layers. Links are
+// resolved within the archive and layers are only ever replaced, never
+// written to, so sharing the file is safe.
+func (m *state) materialize(name string) error {
+	p := filepath.Join(m.tmpDir, name)
+	fi, err := os.Lstat(p)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return err
+	}
+	target, err := resolveIn(m.tmpDir, name)
+	if err != nil {
+		return fmt.Errorf("Cannot resolve %s: %v", name, err)
+	}
+	src := filepath.Join(m.tmpDir, target)
+	fi, err = os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s does not point to a regular file.", name)
+	}
+	err = os.Remove(p)
+	if err != nil {
+		return err
+	}
+	return linkOrCopy(src, p)
+}
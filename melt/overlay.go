@@ -0,0 +1,86 @@
+package melt
+
+import (
+	"path"
+	"strings"
+)
+
+// overlay is the root filesystem a stack of layers presents, the way an
+// overlay filesystem or a container runtime sees it, mapping every path to a
+// value of the caller. It is used wherever the result of a stack of layers has
+// to be known without extracting them.
+type overlay[V any] struct {
+	files map[string]V
+	// dirs holds every path that was a directory, explicitly or as the
+	// parent of another path. Paths are never removed, it only saves
+	// looking for the children of files that never had any.
+	dirs map[string]bool
+}
+
+// overlayEntry is an entry of a layer applied to an overlay.
+type overlayEntry[V any] struct {
+	name  string
+	dir   bool
+	value V
+}
+
+func newOverlay[V any]() *overlay[V] {
+	return &overlay[V]{files: make(map[string]V), dirs: make(map[string]bool)}
+}
+
+// removeBelow removes everything below dir, or everything if dir is empty.
+func (o *overlay[V]) removeBelow(dir string) {
+	for p := range o.files {
+		if dir == "" || strings.HasPrefix(p, dir+"/") {
+			delete(o.files, p)
+		}
+	}
+}
+
+// apply stacks a layer with the given entries on top. Whiteouts, opaque
+// whiteouts and entries that are not directories hide what the layers below
+// have at and below their path. They do not hide entries of the same layer.
+// AUFS metadata is dropped.
+func (o *overlay[V]) apply(entries []overlayEntry[V]) {
+	// files holds the entries that are not directories but were one, or
+	// the parent of one, below.
+	files := make(map[string]bool)
+	for _, e := range entries {
+		dir, base := path.Split(e.name)
+		dir = strings.TrimSuffix(dir, "/")
+		switch {
+		case base == opaqueWhiteout:
+			o.removeBelow(dir)
+		case strings.HasPrefix(base, whiteoutMeta):
+		case strings.HasPrefix(base, whiteoutPrefix):
+			target := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			delete(o.files, target)
+			o.removeBelow(target)
+		case !e.dir && o.dirs[e.name]:
+			files[e.name] = true
+		}
+	}
+	if len(files) > 0 {
+		for p := range o.files {
+			for parent := path.Dir(p); parent != "."; parent = path.Dir(parent) {
+				if files[parent] {
+					delete(o.files, p)
+					break
+				}
+			}
+		}
+	}
+
+	for _, e := range entries {
+		if strings.HasPrefix(path.Base(e.name), whiteoutPrefix) {
+			continue
+		}
+		o.files[e.name] = e.value
+		if e.dir {
+			o.dirs[e.name] = true
+		}
+		for parent := path.Dir(e.name); parent != "." && !o.dirs[parent]; parent = path.Dir(parent) {
+			o.dirs[parent] = true
+		}
+	}
+}
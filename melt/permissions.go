@@ -0,0 +1,121 @@
+package melt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxListed is the number of paths listed in a message about many files.
+const maxListed = 5
+
+// WithPermissionCheck sets how permission changes hidden by melting are
+// reported: files that become setuid, setgid or world-writable and files whose
+// owner changes in a melted layer. Once layers are melted the history no
+// longer tells which step introduced them. It defaults to CheckWarn.
+func WithPermissionCheck(mode CheckMode) Option {
+	return func(o *options) {
+		o.permCheck = mode
+	}
+}
+
+// permissionChanges compares the files of the layer unpacked in from with the
+// files they replace in the layer unpacked in into and describes the risky
+// changes. createdBy is the command that created the layer.
+func permissionChanges(from string, into string, layer string, createdBy string) ([]string, error) {
+	origin := layer
+	if createdBy != "" {
+		if len(createdBy) > 60 {
+			createdBy = createdBy[:57] + "..."
+		}
+		origin = fmt.Sprintf("%s (%s)", layer, createdBy)
+	}
+
+	var changes []string
+	var chowned []string
+	err := walkTree(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == from || strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		old, err := os.Lstat(filepath.Join(into, rel))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil {
+			old = nil
+		}
+
+		mode := info.Mode()
+		gained := func(bit os.FileMode) bool {
+			return mode&bit != 0 && (old == nil || old.Mode()&bit == 0)
+		}
+		if gained(os.ModeSetuid) {
+			changes = append(changes, fmt.Sprintf("%s becomes setuid in layer %s.", rel, origin))
+		}
+		if gained(os.ModeSetgid) && !mode.IsDir() {
+			changes = append(changes, fmt.Sprintf("%s becomes setgid in layer %s.", rel, origin))
+		}
+		// Sticky directories like tmp are meant to be world-writable.
+		if mode&os.ModeSymlink == 0 && mode&os.ModeSticky == 0 && mode.Perm()&0002 != 0 &&
+			(old == nil || old.Mode().Perm()&0002 == 0) {
+			changes = append(changes, fmt.Sprintf("%s becomes world-writable in layer %s.", rel, origin))
+		}
+		if old != nil {
+			uid, gid, ok := fileOwner(info)
+			oldUID, oldGID, _ := fileOwner(old)
+			if ok && (uid != oldUID || gid != oldGID) {
+				chowned = append(chowned, rel)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chowned) > 0 {
+		sort.Strings(chowned)
+		listed := chowned
+		if len(listed) > maxListed {
+			listed = listed[:maxListed]
+		}
+		files := "files"
+		if len(chowned) == 1 {
+			files = "file"
+		}
+		msg := fmt.Sprintf("Layer %s changes the owner of %d %s: %s", origin, len(chowned), files, strings.Join(listed, ", "))
+		if len(listed) < len(chowned) {
+			msg += ", ..."
+		}
+		changes = append(changes, msg+".")
+	}
+	return changes, nil
+}
+
+// checkPermissions reports the risky permission changes of the layer unpacked
+// in from before it is melted into the layer unpacked in into.
+func (m *state) checkPermissions(from string, into string, layer string, createdBy string) error {
+	if m.opts.permCheck == CheckOff {
+		return nil
+	}
+	changes, err := permissionChanges(from, into, layer, createdBy)
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 && m.opts.permCheck == CheckFail {
+		return fmt.Errorf("Melting would hide permission changes: %s", strings.Join(changes, " "))
+	}
+	for _, c := range changes {
+		m.warn(c)
+	}
+	return nil
+}
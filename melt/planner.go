@@ -0,0 +1,285 @@
+package melt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Plan maps every layer of an archive to the layer it is melted into. A layer
+// that is not melted into another one is a root and maps to itself. Layers
+// missing from a plan are roots as well. The layers melted into a root must
+// directly follow it in every image that contains it.
+type Plan map[string]string
+
+// Planner computes the plan for the images of an archive. Every image is
+// given as the list of its layers from the bottom to the top.
+type Planner func(images [][]string) (Plan, error)
+
+// WithPlanner sets the planner deciding which layers are melted together. It
+// defaults to DefaultPlanner.
+func WithPlanner(p Planner) Option {
+	return func(o *options) {
+		o.planner = p
+	}
+}
+
+// WithBase keeps the layers of the base image referenced by ref untouched.
+// Only the layers above them are planned. Every image in the input has to be
+// built on top of the base.
+func WithBase(ref string) Option {
+	return func(o *options) {
+		o.base = ref
+	}
+}
+
+// keepLayers returns a planner that leaves the layers in keep untouched and
+// plans the layers above them with p. The kept layers have to be at the
+// bottom of every image.
+func keepLayers(keep map[string]bool, p Planner) Planner {
+	return func(images [][]string) (Plan, error) {
+		plan := make(Plan)
+		rest := make([][]string, 0, len(images))
+		for _, layers := range images {
+			i := 0
+			for ; i < len(layers) && keep[layers[i]]; i++ {
+				plan[layers[i]] = layers[i]
+			}
+			rest = append(rest, layers[i:])
+		}
+		restPlan, err := p(rest)
+		if err != nil {
+			return nil, err
+		}
+		for l, r := range restPlan {
+			plan[l] = r
+		}
+		return plan, nil
+	}
+}
+
+// baseLayers returns the layers of the images that belong to the base image.
+func (m *state) baseLayers() (map[string]bool, error) {
+	dir := filepath.Join(m.workDir, baseDir)
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	err = m.unpackImageRetry(m.opts.base, dir)
+	if err != nil {
+		return nil, err
+	}
+	var manifest RawManifest
+	err = manifest.Load(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifest) != 1 {
+		return nil, fmt.Errorf("Base image %s has to contain a single image.", m.opts.base)
+	}
+	var config ImageConfig
+	err = config.Load(filepath.Join(dir, manifest.Manifest[0].ConfigHash))
+	if err != nil {
+		return nil, err
+	}
+	base := config.RootFS.DiffIDs
+
+	keep := make(map[string]bool)
+	for _, mf := range m.manifest.Manifest {
+		if mf.config == nil {
+			return nil, errors.New("Corrupt image configuration file.")
+		}
+		diffIDs := mf.config.RootFS.DiffIDs
+		if len(diffIDs) < len(base) {
+			return nil, fmt.Errorf("Image %s is not built on %s.", mf.Name(), m.opts.base)
+		}
+		for j, diffID := range base {
+			if diffIDs[j] != diffID {
+				return nil, fmt.Errorf("Image %s is not built on %s.", mf.Name(), m.opts.base)
+			}
+			keep[mf.layers[j]] = true
+		}
+	}
+	return keep, nil
+}
+
+// sharing returns the number of images each layer is part of.
+func sharing(images [][]string) map[string]int {
+	n := make(map[string]int)
+	for _, layers := range images {
+		for _, l := range layers {
+			n[l]++
+		}
+	}
+	return n
+}
+
+// DefaultPlanner melts all layers of a single image into one. For multiple
+// images sequences of shared layers and sequences of unique layers are melted
+// but unique layers are never melted into shared layers.
+func DefaultPlanner(images [][]string) (Plan, error) {
+	n := sharing(images)
+
+	// If a shared layer is followed by a unique layer the sequence of
+	// shared layers ends with it.
+	ends := make(map[string]bool)
+	for _, layers := range images {
+		for i := 1; i < len(layers); i++ {
+			if n[layers[i]] == 1 && n[layers[i-1]] > 1 {
+				ends[layers[i-1]] = true
+			}
+		}
+	}
+
+	plan := make(Plan)
+	for _, layers := range images {
+		root := ""
+		for _, l := range layers {
+			if r, ok := plan[l]; ok {
+				// Already planned as part of another image.
+				root = r
+			} else {
+				if root == "" {
+					root = l
+				}
+				plan[l] = root
+			}
+			if ends[l] {
+				root = ""
+			}
+		}
+	}
+	return plan, nil
+}
+
+// layerChains returns a function reporting whether the layer l always
+// directly follows the layer prev: every image containing one of them contains
+// both, one after the other. Only then can l be melted into prev without
+// affecting what the images share.
+func layerChains(images [][]string) func(prev string, l string) bool {
+	// The empty string marks the bottom and the top of an image.
+	succ := make(map[string]map[string]bool)
+	pred := make(map[string]map[string]bool)
+	link := func(m map[string]map[string]bool, from string, to string) {
+		if m[from] == nil {
+			m[from] = make(map[string]bool)
+		}
+		m[from][to] = true
+	}
+	for _, layers := range images {
+		prev := ""
+		for _, l := range layers {
+			link(succ, prev, l)
+			link(pred, l, prev)
+			prev = l
+		}
+		link(succ, prev, "")
+	}
+	return func(prev string, l string) bool {
+		return len(succ[prev]) == 1 && len(pred[l]) == 1
+	}
+}
+
+// SharedPlanner keeps as much sharing between the images as possible. The
+// layers of all images form a tree. Every chain of layers in it without
+// branches is melted into a single layer, so each image ends up with the
+// layers it shares with every group of siblings followed by a single unique
+// layer. For two images this is the longest common prefix followed by the
+// unique rest of each image.
+func SharedPlanner(images [][]string) (Plan, error) {
+	chained := layerChains(images)
+	plan := make(Plan)
+	for _, layers := range images {
+		for i, l := range layers {
+			if i > 0 && chained(layers[i-1], l) {
+				plan[l] = plan[layers[i-1]]
+			} else {
+				plan[l] = l
+			}
+		}
+	}
+	return plan, nil
+}
+
+// root returns the layer l is melted into according to p.
+func (p Plan) root(l string) string {
+	if r, ok := p[l]; ok && r != "" {
+		return r
+	}
+	return l
+}
+
+// check verifies that the layers melted into a root directly follow it and
+// are the same in every image.
+func (p Plan) check(images [][]string) error {
+	runs := make(map[string]string)
+	for i, layers := range images {
+		var run []string
+		finish := func() error {
+			if len(run) == 0 {
+				return nil
+			}
+			joined := strings.Join(run, " ")
+			if prev, ok := runs[run[0]]; ok && prev != joined {
+				return fmt.Errorf("Layers melted into %s differ between images.", run[0])
+			}
+			runs[run[0]] = joined
+			return nil
+		}
+		for _, l := range layers {
+			r := p.root(l)
+			if r == l {
+				err := finish()
+				if err != nil {
+					return err
+				}
+				run = []string{l}
+				continue
+			}
+			if len(run) == 0 || run[0] != r {
+				return fmt.Errorf("Layer %s of image %d does not directly follow %s it is melted into.", l, i, r)
+			}
+			run = append(run, l)
+		}
+		err := finish()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithMinLayerSize only melts runs of adjacent layers smaller than size bytes,
+// each into the first layer of its run, and leaves larger layers untouched.
+// This removes the long tail of tiny metadata layers while keeping large
+// layers cacheable. Layers are only melted if they are shared by the same
+// images. It replaces the planner.
+func WithMinLayerSize(size int64) Option {
+	return func(o *options) {
+		o.minLayerSize = size
+	}
+}
+
+// smallLayersPlanner returns a planner melting runs of adjacent layers for
+// which small returns true. Like SharedPlanner it only melts a layer into the
+// one below it if they always follow each other.
+func smallLayersPlanner(small func(layer string) bool) Planner {
+	return func(images [][]string) (Plan, error) {
+		chained := layerChains(images)
+		plan := make(Plan)
+		for _, layers := range images {
+			for i, l := range layers {
+				if i > 0 && small(l) && small(layers[i-1]) && chained(layers[i-1], l) {
+					plan[l] = plan[layers[i-1]]
+				} else {
+					plan[l] = l
+				}
+			}
+		}
+		return plan, nil
+	}
+}
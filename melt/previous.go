@@ -0,0 +1,249 @@
+package melt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Incremental melts reuse the melted layers of a previous output whose source
+// layers did not change. The history annotation of every melted layer records
+// a key of its sources: the diffIDs of the layers melted into it, whether
+// whiteouts had to be kept for layers below it and the options that change
+// the files of melted layers. A melted layer of the previous output with the
+// same key has the same content, so it is taken as it is instead of
+// extracting and merging its sources again. Layers are only reused as a
+// whole: a single changed source layer melts the whole chain again.
+
+// WithPrevious reuses the melted layers of the images in ref, a transport
+// reference like the output, whose source layers are unchanged. ref has to be
+// melted with history annotations. It cannot be combined with
+// WithFileTransform, whose effect is not recorded in the annotations.
+func WithPrevious(ref string) Option {
+	return func(o *options) {
+		o.previous = ref
+	}
+}
+
+// sourcesNote finds the key of the sources in the history annotation of a
+// melted layer.
+var sourcesNote = regexp.MustCompile(`go-docker-melt \S+: melted [0-9]+ layers from sources (sha256:[0-9a-f]{64}) on `)
+
+// previousLayer is a melted layer of the previous output.
+type previousLayer struct {
+	// file is the path of its tarball.
+	file   string
+	diffID string
+}
+
+// contentOptions returns the options that change the files of melted layers
+// together with the version of go-docker-melt and the backend merging them,
+// since both decide how the files end up in the layer as well.
+func (o *options) contentOptions(backend Backend) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "version %s\n", Version)
+	fmt.Fprintf(&b, "backend %s\n", backend)
+	fmt.Fprintf(&b, "umask %o\n", o.umask)
+	if o.clamp {
+		fmt.Fprintf(&b, "clamp-mtime %d\n", o.clampMtime.Unix())
+	}
+	fmt.Fprintf(&b, "preserve-atime %t\n", o.preserveAtime)
+	fmt.Fprintf(&b, "strip-xattrs %q\n", o.stripXattrs)
+	fmt.Fprintf(&b, "selinux %s %q\n", o.selinux, o.selinuxContext)
+	fmt.Fprintf(&b, "break-hardlinks %t\n", o.breakHardlinks)
+	fmt.Fprintf(&b, "dereference %t %q\n", o.dereference, o.dereferenceExclude)
+	fmt.Fprintf(&b, "case-collisions %s\n", o.casePolicy)
+	return b.String()
+}
+
+// keySources fills in sourceKey for every root layer other layers are melted
+// into.
+func (m *state) keySources() {
+	lower := make(map[string]bool)
+	for _, mf := range m.manifest.Manifest {
+		for j, l := range mf.layers {
+			if j > 0 && m.plan.root(l) == l {
+				lower[l] = true
+			}
+		}
+	}
+	opts := m.opts.contentOptions(m.backendName)
+	m.sourceKey = make(map[string]string)
+	for root, chain := range m.meltSources() {
+		if len(chain) < 2 {
+			continue
+		}
+		h := sha256.New()
+		fmt.Fprintf(h, "go-docker-melt sources 1\n%slower %t\n", opts, lower[root])
+		for _, l := range chain {
+			fmt.Fprintf(h, "%s\n", m.origDiffID[l])
+		}
+		m.sourceKey[root] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// planReuse unpacks the previous output of WithPrevious and picks the root
+// layers whose melted layer it already holds. Their sources are neither
+// unpacked nor merged.
+func (m *state) planReuse() error {
+	if m.opts.previous == "" {
+		return nil
+	}
+	dir := filepath.Join(m.workDir, previousDir)
+	err := m.unpackImageRetry(m.opts.previous, dir)
+	if err != nil {
+		return err
+	}
+	layers, err := readPrevious(dir)
+	if err != nil {
+		return fmt.Errorf("Previous output %s: %v", m.opts.previous, err)
+	}
+
+	m.reuse = make(map[string]previousLayer)
+	m.reusedSources = make(map[string]bool)
+	chains := m.meltSources()
+	for root, key := range m.sourceKey {
+		prev, ok := layers[key]
+		if !ok {
+			continue
+		}
+		m.reuse[root] = prev
+		for _, l := range chains[root][1:] {
+			m.reusedSources[l] = true
+		}
+	}
+	m.opts.logger.Info("reusing melted layers of the previous output", "reused", len(m.reuse), "melted", len(m.sourceKey))
+	return nil
+}
+
+// readPrevious maps the keys of the sources of the melted layers of the
+// images unpacked in dir to those layers.
+func readPrevious(dir string) (map[string]previousLayer, error) {
+	type image struct {
+		config string
+		layers []string
+	}
+	var images []image
+	_, err := os.Stat(filepath.Join(dir, "manifest.json"))
+	if os.IsNotExist(err) {
+		oci, _, err := readOCILayout(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range oci {
+			config, err := blobPath(img.manifest.Config.Digest)
+			if err != nil {
+				return nil, err
+			}
+			i := image{config: config}
+			for _, d := range img.manifest.Layers {
+				l, err := blobPath(d.Digest)
+				if err != nil {
+					return nil, err
+				}
+				i.layers = append(i.layers, l)
+			}
+			images = append(images, i)
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		var r RawManifest
+		err = r.Load(filepath.Join(dir, "manifest.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, mf := range r.Manifest {
+			images = append(images, image{config: mf.ConfigHash, layers: mf.layers})
+		}
+	}
+
+	layers := make(map[string]previousLayer)
+	for _, img := range images {
+		var config ImageConfig
+		err = config.Load(filepath.Join(dir, img.config))
+		if err != nil {
+			return nil, err
+		}
+		diffIDs := config.RootFS.DiffIDs
+		if len(diffIDs) != len(img.layers) {
+			continue
+		}
+		j := 0
+		for _, h := range config.History {
+			if h.EmptyLayer {
+				continue
+			}
+			if j >= len(img.layers) {
+				break
+			}
+			if match := sourcesNote.FindStringSubmatch(h.Comment); match != nil {
+				layers[match[1]] = previousLayer{
+					file:   filepath.Join(dir, img.layers[j]),
+					diffID: string(diffIDs[j]),
+				}
+			}
+			j++
+		}
+	}
+	return layers, nil
+}
+
+// reuseLayer replaces the tarball of the root layer by the melted layer prev
+// of the previous output.
+func (m *state) reuseLayer(root string, prev previousLayer) error {
+	p := filepath.Join(m.tmpDir, root)
+	err := os.Remove(p)
+	if err != nil {
+		return err
+	}
+	err = linkOrCopy(prev.file, p)
+	if err != nil {
+		return err
+	}
+	err = m.decompressLayer(root)
+	if err != nil {
+		return err
+	}
+	diffID, err := layerDiffID(p)
+	if err != nil {
+		return err
+	}
+	if diffID != prev.diffID {
+		return fmt.Errorf("Layer %s of the previous output does not match its diffID %s.", filepath.Base(prev.file), prev.diffID)
+	}
+	m.opts.logger.Debug("reused melted layer", "layer", root, "diffID", diffID)
+	return nil
+}
+
+// finishReused records the diffID and sizes of the reused melted layer of the
+// root layer and compresses it like the other melted layers.
+func (m *state) finishReused(root string, prev previousLayer) error {
+	l := filepath.Join(m.tmpDir, root)
+	m.diffIDMutex.Lock()
+	m.diffID[root] = prev.diffID
+	m.diffIDMutex.Unlock()
+	var size int64
+	if fi, err := os.Stat(l); err == nil {
+		size = fi.Size()
+	}
+	m.sizesMutex.Lock()
+	m.meltedSizes[root] = size
+	m.sizesMutex.Unlock()
+	err := m.measureLayer(root, true)
+	if err != nil {
+		return err
+	}
+	if m.compresses(CompressLayers) {
+		err = gzipFile(l, l, m.opts.compressionLevel)
+		if err != nil {
+			return err
+		}
+	}
+	m.emit(Event{Type: LayerHashed, Layer: root, Bytes: size, DiffID: prev.diffID})
+	return nil
+}
@@ -0,0 +1,217 @@
+package melt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PruneResult describes what Prune removed.
+type PruneResult struct {
+	// Files are the names of the removed archive members.
+	Files []string
+	// Bytes is their combined size.
+	Bytes int64
+}
+
+// Prune removes the members of the archive referenced by input that no image
+// references, like layers and configurations of images whose manifest.json
+// entries are gone, and writes the rest to output. Nothing is melted: the
+// images, their layers and their history are kept as they are. Layer
+// directories of docker save archives are kept with their legacy json and
+// VERSION files and blobs of an OCI image layout are kept if anything
+// reachable from its index.json refers to them. The repositories file is
+// regenerated from manifest.json.
+func (ml *Melter) Prune(ctx context.Context, input string, output string) (PruneResult, error) {
+	m, err := ml.newState(ctx)
+	if err != nil {
+		return PruneResult{}, err
+	}
+	defer m.cleanup()
+
+	m.work.Input, m.work.Output = input, output
+	err = m.phase(PhaseExtract)
+	if err != nil {
+		return PruneResult{}, err
+	}
+	err = m.unpackInput(input)
+	if err != nil {
+		return PruneResult{}, err
+	}
+	res, err := m.prune()
+	if err != nil {
+		return res, err
+	}
+	err = m.phase(PhaseWrite)
+	if err != nil {
+		return res, err
+	}
+	return res, m.writeOutput(output)
+}
+
+// prune removes the unreferenced members of the archive unpacked in tmpDir.
+func (m *state) prune() (PruneResult, error) {
+	var res PruneResult
+	keep := make(map[string]bool)
+	// keepDirs holds the layer directories of docker save archives.
+	keepDirs := make(map[string]bool)
+
+	_, err := os.Stat(filepath.Join(m.tmpDir, "manifest.json"))
+	hasManifest := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return res, err
+	}
+	if hasManifest {
+		err = m.manifest.Load(filepath.Join(m.tmpDir, "manifest.json"))
+		if err != nil {
+			return res, err
+		}
+		// repositories is written anew below.
+		keep["manifest.json"] = true
+		keep["repositories"] = true
+		for _, mf := range m.manifest.Manifest {
+			keep[mf.ConfigHash] = true
+			for _, l := range mf.layers {
+				keep[l] = true
+				if dir := path.Dir(l); dir != "." && !strings.HasPrefix(l, "blobs/") {
+					keepDirs[dir] = true
+				}
+			}
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(m.tmpDir, "index.json"))
+	hasIndex := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return res, err
+	}
+	if hasIndex {
+		blobs, err := ociReferences(m.tmpDir)
+		if err != nil {
+			return res, err
+		}
+		keep["index.json"] = true
+		keep["oci-layout"] = true
+		for _, b := range blobs {
+			keep[b] = true
+		}
+	}
+	if !hasManifest && !hasIndex {
+		return res, fmt.Errorf("Archive %s has neither manifest.json nor index.json.", m.work.Input)
+	}
+
+	var dirs []string
+	err = walkTree(m.tmpDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(m.tmpDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if keepDirs[rel] {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, p)
+			return nil
+		}
+		if keep[rel] {
+			return nil
+		}
+		m.opts.logger.Debug("pruning", "file", rel)
+		res.Files = append(res.Files, rel)
+		res.Bytes += info.Size()
+		return os.Remove(p)
+	})
+	if err != nil {
+		return res, err
+	}
+	// Directories left empty are removed, children first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = IsEmptyDir(dirs[i])
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			err = os.Remove(dirs[i])
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if hasManifest {
+		err = writeRepositories(m.tmpDir)
+		if err != nil {
+			return res, err
+		}
+	}
+	m.opts.logger.Info("pruned archive", "files", len(res.Files), "bytes", res.Bytes)
+	return res, nil
+}
+
+// ociReferences returns the blobs of the OCI image layout in dir that its
+// index.json refers to, directly or through nested indexes and manifests.
+// Unlike readOCILayout it keeps attestations and blobs of unknown media
+// types, which a pruned layout still refers to.
+func ociReferences(dir string) ([]string, error) {
+	var blobs []string
+	var walk func(file string, depth int) error
+	walk = func(file string, depth int) error {
+		if depth > 4 {
+			return fmt.Errorf("Image indexes in %s are nested too deeply.", file)
+		}
+		buf, err := readMetadata(filepath.Join(dir, file), MaxManifestSize)
+		if err != nil {
+			return err
+		}
+		var index v1.IndexManifest
+		err = json.Unmarshal(buf, &index)
+		if err != nil {
+			return fmt.Errorf("Corrupt OCI image index %s: %v", file, err)
+		}
+		for _, d := range index.Manifests {
+			blob, err := blobPath(d.Digest)
+			if err != nil {
+				return err
+			}
+			blobs = append(blobs, blob)
+			switch d.MediaType {
+			case types.OCIImageIndex, types.DockerManifestList:
+				err = walk(blob, depth+1)
+				if err != nil {
+					return err
+				}
+			case types.OCIManifestSchema1, types.DockerManifestSchema2:
+				buf, err := readMetadata(filepath.Join(dir, blob), MaxManifestSize)
+				if err != nil {
+					return err
+				}
+				var mf v1.Manifest
+				err = json.Unmarshal(buf, &mf)
+				if err != nil {
+					return fmt.Errorf("Corrupt OCI image manifest %s: %v", blob, err)
+				}
+				for _, d := range append([]v1.Descriptor{mf.Config}, mf.Layers...) {
+					blob, err := blobPath(d.Digest)
+					if err != nil {
+						return err
+					}
+					blobs = append(blobs, blob)
+				}
+			}
+		}
+		return nil
+	}
+	err := walk("index.json", 0)
+	return blobs, err
+}
@@ -0,0 +1,56 @@
+package melt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// reportPush emits a LayerPushed event for every layer of the pushed images,
+// telling whether the destination had it already, and logs the totals. skopeo
+// asks the registry for every blob before uploading it and mounts blobs from
+// other repositories of the registry where it knows about them, so unchanged
+// layers are not transferred again.
+func (m *state) reportPush(r pushResult) {
+	var uploaded, reused int64
+	var nUploaded, nReused int
+	seen := make(map[string]bool)
+	for _, mf := range m.manifest.Manifest {
+		if mf.config == nil || len(mf.config.RootFS.DiffIDs) != len(mf.layers) {
+			continue
+		}
+		for i, l := range mf.layers {
+			if seen[l] {
+				continue
+			}
+			seen[l] = true
+			fi, err := os.Stat(filepath.Join(m.tmpDir, l))
+			if err != nil {
+				continue
+			}
+			diffID := string(mf.config.RootFS.DiffIDs[i])
+			e := Event{Type: LayerPushed, Layer: l, Bytes: fi.Size(), DiffID: diffID, Message: "uploaded"}
+			if isReused(r.reused, diffID) {
+				e.Message = "reused"
+				reused += fi.Size()
+				nReused++
+			} else {
+				uploaded += fi.Size()
+				nUploaded++
+			}
+			m.emit(e)
+		}
+	}
+	m.opts.logger.Info("pushed image", "digest", r.digest, "uploaded_layers", nUploaded, "uploaded_bytes", uploaded, "reused_layers", nReused, "reused_bytes", reused)
+}
+
+// isReused reports whether the layer with diffID is among the reused blobs.
+func isReused(reused []string, diffID string) bool {
+	hex := strings.TrimPrefix(diffID, "sha256:")
+	for _, d := range reused {
+		if len(d) >= 12 && strings.HasPrefix(hex, d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package melt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LayerRange selects the layers From to To of an image, both included. Each
+// end is either the index of a layer, counted from 0 at the bottom, or a
+// prefix of its diffID or of its path in the archive. If History is set,
+// From and To are ignored and every run of consecutive layers whose history
+// entries match the regular expression History is selected instead.
+type LayerRange struct {
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	History string `json:"history,omitempty"`
+}
+
+// LoadLayerRanges reads a rules file describing how layers are grouped. It
+// holds a JSON list of LayerRange values, e.g.
+//
+//	[
+//		{"from": "0", "to": "3"},
+//		{"history": "^/bin/sh -c #\\(nop\\) (LABEL|ENV) "}
+//	]
+func LoadLayerRanges(file string) ([]LayerRange, error) {
+	buf, err := readMetadata(file, MaxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []LayerRange
+	err = json.Unmarshal(buf, &ranges)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid layer rules file %s: %v", file, err)
+	}
+	for _, r := range ranges {
+		err = r.validate()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid layer rules file %s: %v", file, err)
+		}
+	}
+	return ranges, nil
+}
+
+func (r LayerRange) validate() error {
+	if r.History != "" {
+		_, err := regexp.Compile(r.History)
+		return err
+	}
+	if r.From == "" || r.To == "" {
+		return errors.New("A layer range needs both ends or a history pattern.")
+	}
+	return nil
+}
+
+func (r LayerRange) String() string {
+	if r.History != "" {
+		return "history " + r.History
+	}
+	return r.From + ":" + r.To
+}
+
+// layerHistory returns the history entries of the layers of mf.
+func layerHistory(mf *Manifest) []History {
+	var hist []History
+	for _, h := range mf.config.History {
+		if !h.EmptyLayer {
+			hist = append(hist, h)
+		}
+	}
+	return hist
+}
+
+// resolve returns the ranges of layer indexes of mf that r selects.
+func (r LayerRange) resolve(mf *Manifest) ([][2]int, error) {
+	if r.History == "" {
+		from, err := resolveLayer(mf, r.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := resolveLayer(mf, r.To)
+		if err != nil || from < 0 || to < 0 {
+			return nil, err
+		}
+		if from > to {
+			return nil, fmt.Errorf("Layer range %s of image %s runs backwards.", r, mf.Name())
+		}
+		return [][2]int{{from, to}}, nil
+	}
+
+	re, err := regexp.Compile(r.History)
+	if err != nil {
+		return nil, err
+	}
+	hist := layerHistory(mf)
+	var runs [][2]int
+	start := -1
+	for j := 0; j <= len(mf.layers); j++ {
+		if j < len(mf.layers) && j < len(hist) && re.MatchString(hist[j].CreatedBy) {
+			if start < 0 {
+				start = j
+			}
+			continue
+		}
+		if start >= 0 {
+			runs = append(runs, [2]int{start, j - 1})
+			start = -1
+		}
+	}
+	return runs, nil
+}
+
+// ParseLayerRange parses a range given as from:to, e.g. 2:7. A diffID may
+// keep its sha256: prefix.
+func ParseLayerRange(s string) (LayerRange, error) {
+	rest := strings.Replace(s, "sha256:", "", -1)
+	i := strings.Index(rest, ":")
+	if i <= 0 || i == len(rest)-1 {
+		return LayerRange{}, fmt.Errorf("Invalid layer range %q, expected from:to.", s)
+	}
+	return LayerRange{From: rest[:i], To: rest[i+1:]}, nil
+}
+
+// WithLayerRanges melts each of the given ranges of layers into its bottom
+// layer and leaves all other layers untouched. The ranges are resolved in
+// every image that has both ends and replace the planner. They cannot be
+// combined with WithBase.
+func WithLayerRanges(ranges ...LayerRange) Option {
+	return func(o *options) {
+		o.ranges = append(o.ranges, ranges...)
+	}
+}
+
+// resolveLayer returns the index of the layer of mf that ref refers to or -1
+// if mf has no such layer.
+func resolveLayer(mf *Manifest, ref string) (int, error) {
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n < 0 || n >= len(mf.layers) {
+			return -1, nil
+		}
+		return n, nil
+	}
+	found := -1
+	for j, l := range mf.layers {
+		diffID := mf.config.RootFS.DiffIDs[j].Encoded()
+		if strings.HasPrefix(diffID, ref) || strings.HasPrefix(l, ref) {
+			if found >= 0 {
+				return 0, fmt.Errorf("Layer %s is ambiguous in image %s.", ref, mf.Name())
+			}
+			found = j
+		}
+	}
+	return found, nil
+}
+
+// rangePlan returns the plan melting the layer ranges of every image.
+func (m *state) rangePlan() (Plan, error) {
+	if m.opts.base != "" {
+		return nil, errors.New("Layer ranges cannot be combined with a base image.")
+	}
+	for _, r := range m.opts.ranges {
+		err := r.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	plan := make(Plan)
+	used := make([]bool, len(m.opts.ranges))
+	for i := range m.manifest.Manifest {
+		mf := &m.manifest.Manifest[i]
+		if mf.config == nil || len(mf.config.RootFS.DiffIDs) != len(mf.layers) {
+			return nil, errors.New("Corrupt image configuration file.")
+		}
+		taken := make([]bool, len(mf.layers))
+		for k, r := range m.opts.ranges {
+			runs, err := r.resolve(mf)
+			if err != nil {
+				return nil, err
+			}
+			for _, run := range runs {
+				used[k] = true
+				for j := run[0]; j <= run[1]; j++ {
+					if taken[j] {
+						return nil, fmt.Errorf("Layer ranges overlap at layer %d of image %s.", j, mf.Name())
+					}
+					taken[j] = true
+					plan[mf.layers[j]] = mf.layers[run[0]]
+				}
+			}
+		}
+	}
+	for k, r := range m.opts.ranges {
+		if !used[k] {
+			return nil, fmt.Errorf("No image has layers matching %s.", r)
+		}
+	}
+	return plan, nil
+}
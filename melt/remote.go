@@ -0,0 +1,35 @@
+package melt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// RemoteLayers returns the diffIDs of the layers of the image ref, like
+// docker://registry.example.com/app:1, by reading its configuration with
+// skopeo inspect without pulling any layer.
+func RemoteLayers(ctx context.Context, ref string) ([]string, error) {
+	name, _ := ParseReference(ref)
+	switch lookupTransport(name).(type) {
+	case skopeoTransport, ociTransport:
+	default:
+		return nil, fmt.Errorf("Cannot inspect %s, only skopeo transports can.", ref)
+	}
+	out, err := exec.CommandContext(ctx, "skopeo", "inspect", "--config", ref).Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, fmt.Errorf("Failed to inspect %s: %v", ref, err)
+	}
+	var img ImageConfig
+	err = img.Parse(out)
+	if err != nil {
+		return nil, fmt.Errorf("Configuration of %s: %v", ref, err)
+	}
+	return img.diffIDs(), nil
+}
@@ -0,0 +1,125 @@
+package melt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SplitTag splits a tag like registry:5000/app:1 into repository and tag. The
+// tag defaults to latest.
+func SplitTag(t string) (string, string) {
+	i := strings.LastIndex(t, ":")
+	if i < 0 || strings.Contains(t[i+1:], "/") {
+		return t, "latest"
+	}
+	return t[:i], t[i+1:]
+}
+
+// layerID returns the ID of layer for legacy consumers, the name of the
+// directory holding it, or the empty string if it is not stored in a
+// directory of its own at the top level of the archive.
+func layerID(layer string) string {
+	id := path.Dir(layer)
+	if strings.Contains(id, "/") || id == "." {
+		return ""
+	}
+	return id
+}
+
+// writeLayerJSON writes the json and VERSION files legacy consumers read the
+// layers of an image from into the directory of the top layer of mf in dir,
+// unless it has them already. The melted top layer of an image is often
+// stored in a directory without them, e.g. when it was added by
+// WithBaseRootfs.
+func writeLayerJSON(dir string, mf *Manifest) error {
+	top := len(mf.layers) - 1
+	id := layerID(mf.layers[top])
+	_, err := os.Stat(filepath.Join(dir, id, "VERSION"))
+	if os.IsNotExist(err) {
+		err = ioutil.WriteFile(filepath.Join(dir, id, "VERSION"), []byte("1.0"), 0666)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(dir, id, "json"))
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	layer := LayerJSON{Id: id}
+	if mf.ConfigHash != "" {
+		var config ImageConfig
+		err = config.Load(filepath.Join(dir, mf.ConfigHash))
+		if err != nil {
+			return err
+		}
+		layer.Config = config.Config
+		layer.Arch, layer.OS = config.Architecture, config.OS
+		if config.Created != nil {
+			layer.Created = config.Created.Format(time.RFC3339Nano)
+		}
+	}
+	if top > 0 {
+		layer.Parent = layerID(mf.layers[top-1])
+	}
+	buf, err := json.Marshal(layer)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, id, "json"), buf, 0666)
+}
+
+// writeRepositories writes the repositories file older Docker versions and
+// other legacy consumers read from the final manifest.json in dir. It maps
+// every tag to the ID of the top layer of its image, the name of the
+// directory holding it, which gets the json and VERSION files of a legacy
+// layer if it lacks them. Untagged images are left out and the file is
+// removed if there is no tagged image.
+func writeRepositories(dir string) error {
+	var manifest RawManifest
+	err := manifest.Load(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	repos := make(map[string]map[string]string)
+	for _, mf := range manifest.Manifest {
+		if len(mf.layers) == 0 {
+			continue
+		}
+		// Only layers at the top level have an ID.
+		id := layerID(mf.layers[len(mf.layers)-1])
+		if id == "" || len(mf.RepoTags) == 0 {
+			continue
+		}
+		err = writeLayerJSON(dir, &mf)
+		if err != nil {
+			return err
+		}
+		for _, t := range mf.RepoTags {
+			repo, tag := SplitTag(t)
+			if repos[repo] == nil {
+				repos[repo] = make(map[string]string)
+			}
+			repos[repo][tag] = id
+		}
+	}
+
+	file := filepath.Join(dir, "repositories")
+	if len(repos) == 0 {
+		err = os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	buf, err := json.Marshal(repos)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(buf, '\n'), 0666)
+}
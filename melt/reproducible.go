@@ -0,0 +1,121 @@
+package melt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// WithVerifyReproducible melts every input twice, each time from a fresh copy
+// of the unpacked input, and fails unless both melts produce identical
+// images. It checks that options like WithCreated and WithClampMtime make the
+// result reproducible for a given image. Only the second melt reports events
+// and sizes.
+func WithVerifyReproducible() Option {
+	return func(o *options) {
+		o.verifyReproducible = true
+	}
+}
+
+// result describes the images of a finished melt: manifest.json and the
+// configuration and diffIDs of every image.
+type result struct {
+	manifest []byte
+	images   []imageResult
+}
+
+type imageResult struct {
+	name    string
+	config  string
+	diffIDs []string
+}
+
+// result returns the description of the melted images in tmpDir.
+func (m *state) result() (*result, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(m.tmpDir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	r := &result{manifest: buf}
+	for _, mf := range m.manifest.Manifest {
+		img := imageResult{name: mf.Name(), config: mf.ConfigHash}
+		if mf.config != nil {
+			img.diffIDs = mf.config.diffIDs()
+		}
+		r.images = append(r.images, img)
+	}
+	return r, nil
+}
+
+// diff describes the first difference between r and other or returns the
+// empty string if they are identical.
+func (r *result) diff(other *result) string {
+	if len(r.images) != len(other.images) {
+		return fmt.Sprintf("%d and %d images", len(r.images), len(other.images))
+	}
+	for i, img := range r.images {
+		o := other.images[i]
+		if len(img.diffIDs) != len(o.diffIDs) {
+			return fmt.Sprintf("image %s has %d and %d layers", img.name, len(img.diffIDs), len(o.diffIDs))
+		}
+		for j := range img.diffIDs {
+			if img.diffIDs[j] != o.diffIDs[j] {
+				return fmt.Sprintf("layer %d of image %s has diffIDs %s and %s", j, img.name, img.diffIDs[j], o.diffIDs[j])
+			}
+		}
+		if img.config != o.config {
+			return fmt.Sprintf("image %s has configurations %s and %s", img.name, img.config, o.config)
+		}
+	}
+	if !bytes.Equal(r.manifest, other.manifest) {
+		return "manifest.json differs"
+	}
+	return ""
+}
+
+// verifyReproducible melts a copy of the unpacked input as a reference, melts
+// the input and compares both.
+func (m *state) verifyReproducible() error {
+	opts := *m.opts
+	opts.events = nil
+	opts.sizeReport = nil
+	opts.verifyReproducible = false
+	opts.expectDigest = ""
+	opts.workDir = ""
+	ref, err := newState(m.ctx, &opts)
+	if err != nil {
+		return err
+	}
+	defer ref.cleanup()
+	// The annotations record the time of the melt, which both melts
+	// have to agree on.
+	m.meltedAt = m.meltTime()
+	ref.meltedAt = m.meltedAt
+	err = copyDir(m.ctx, m.tmpDir, ref.tmpDir)
+	if err != nil {
+		return err
+	}
+	err = ref.build()
+	if err != nil {
+		return err
+	}
+	want, err := ref.result()
+	if err != nil {
+		return err
+	}
+
+	err = m.build()
+	if err != nil {
+		return err
+	}
+	got, err := m.result()
+	if err != nil {
+		return err
+	}
+	if d := want.diff(got); d != "" {
+		return fmt.Errorf("Melting twice produced different images: %s.", d)
+	}
+	m.opts.logger.Info("verified that the melt is reproducible")
+	return nil
+}
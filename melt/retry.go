@@ -0,0 +1,105 @@
+package melt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// WithRetries retries steps that failed with a transient error up to n times.
+// The first retry waits for delay and every further one twice as long as the
+// one before. Only steps that can be repeated safely are retried, like
+// extracting and packing layers or copying images from and to registries.
+func WithRetries(n int, delay time.Duration) Option {
+	return func(o *options) {
+		o.retries = n
+		o.retryDelay = delay
+	}
+}
+
+// transientError marks an error worth retrying that cannot be recognized by
+// its type, like the failure of an external command talking to a registry.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// isTransient reports whether err might go away when trying again.
+func isTransient(err error) bool {
+	var te *transientError
+	if errors.As(err, &te) {
+		return true
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EIO, syscall.EAGAIN, syscall.ETIMEDOUT, syscall.ESTALE,
+			syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED,
+			syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return true
+		}
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// retry calls fn until it succeeds, fails with an error that is not transient
+// or the retries are used up. what describes fn in warnings. Running out of
+// file descriptors lowers the number of workers and is retried on its own
+// account, as it goes away once other workers finish.
+func (m *state) retry(what string, fn func() error) error {
+	delay := m.opts.retryDelay
+	fdDelay := fdRetryDelay
+	fdAttempt := 0
+	for attempt := 0; ; {
+		err := fn()
+		if err != nil && fdAttempt < fdRetries && isFDExhausted(err) && m.ctx.Err() == nil {
+			m.throttle(what, err)
+			select {
+			case <-m.ctx.Done():
+				return m.ctx.Err()
+			case <-time.After(fdDelay):
+			}
+			fdAttempt++
+			fdDelay *= 2
+			continue
+		}
+		if err == nil || attempt >= m.opts.retries || !isTransient(err) || m.ctx.Err() != nil {
+			return err
+		}
+		m.warn(fmt.Sprintf("%s failed, retrying in %s: %v", what, delay, err))
+		select {
+		case <-m.ctx.Done():
+			return m.ctx.Err()
+		case <-time.After(delay):
+		}
+		attempt++
+		delay *= 2
+	}
+}
+
+// unpackImageRetry unpacks the image s into the empty directory dir, starting
+// over with an empty dir on every retry.
+func (m *state) unpackImageRetry(s string, dir string) error {
+	return m.retry("Unpacking "+s, func() error {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+		err = os.Mkdir(dir, 0755)
+		if err != nil {
+			return err
+		}
+		return unpackImage(m.ctx, s, dir)
+	})
+}
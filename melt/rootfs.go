@@ -0,0 +1,74 @@
+package melt
+
+import (
+	"errors"
+	digest "github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithBaseRootfs melts every image onto the root filesystem in the tarball
+// file, which may be gzip compressed, for instance to rebase an application
+// image onto a hardened golden root filesystem. The tarball is added as the
+// bottom layer of every image and melted like any other layer, so it counts
+// as layer 0 for WithLayerRanges. It cannot be combined with WithBase.
+func WithBaseRootfs(file string) Option {
+	return func(o *options) {
+		o.baseRootfs = file
+	}
+}
+
+// addBaseRootfs adds the base root filesystem as the bottom layer of every
+// image.
+func (m *state) addBaseRootfs() error {
+	if m.opts.baseRootfs == "" {
+		return nil
+	}
+	if m.opts.base != "" {
+		return errors.New("A base root filesystem cannot be combined with a base image.")
+	}
+	tmp := "base-rootfs.tar"
+	err := copyFile(m.opts.baseRootfs, filepath.Join(m.tmpDir, tmp))
+	if err != nil {
+		return err
+	}
+	err = m.decompressLayer(tmp)
+	if err != nil {
+		return err
+	}
+	diffID, err := layerDiffID(filepath.Join(m.tmpDir, tmp))
+	if err != nil {
+		return err
+	}
+	layer := path.Join(strings.TrimPrefix(diffID, "sha256:"), "layer.tar")
+	err = os.MkdirAll(filepath.Join(m.tmpDir, path.Dir(layer)), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(filepath.Join(m.tmpDir, tmp), filepath.Join(m.tmpDir, layer))
+	if err != nil {
+		return err
+	}
+
+	created := m.meltTime()
+	entry := History{History: imagespec.History{
+		Created:   &created,
+		CreatedBy: "go-docker-melt: base root filesystem " + filepath.Base(m.opts.baseRootfs),
+	}}
+	for i := range m.manifest.Manifest {
+		mf := &m.manifest.Manifest[i]
+		if mf.config == nil {
+			return errors.New("Corrupt image configuration file.")
+		}
+		mf.layers = append([]string{layer}, mf.layers...)
+		rootfs := &mf.config.RootFS
+		rootfs.DiffIDs = append([]digest.Digest{digest.Digest(diffID)}, rootfs.DiffIDs...)
+		history := append([]History{entry}, mf.config.History...)
+		mf.config.History = history
+	}
+	m.opts.logger.Info("added base root filesystem", "file", m.opts.baseRootfs, "diffID", diffID)
+	return nil
+}
@@ -0,0 +1,82 @@
+package melt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// sandboxArg is the first argument of a process started to run a command in
+// the sandbox.
+const sandboxArg = "__go-docker-melt-sandbox"
+
+// sandboxChrootArg follows sandboxArg when the command is chrooted into the
+// directory after it.
+const sandboxChrootArg = "-chroot"
+
+// WithSandbox runs the external commands that process layer content, rsync
+// during the merge and the smoke test of WithTestCommand, in a sandbox. Rsync
+// can only write below the work directory, the smoke test only inside its
+// chroot, and both are denied some system calls no melt needs, like mount,
+// chroot or ptrace. Extraction and the go backend run in the
+// calling process and are not sandboxed. Programs using this option have to
+// call SandboxInit at the start of main.
+func WithSandbox() Option {
+	return func(o *options) {
+		o.sandbox = true
+	}
+}
+
+// SandboxInit has to be called at the start of main by programs using
+// WithSandbox. Sandboxed commands are started by running the program itself
+// which sets up the sandbox in SandboxInit and then replaces itself with the
+// command. In any other case SandboxInit returns immediately.
+func SandboxInit() {
+	if len(os.Args) < 2 || os.Args[1] != sandboxArg {
+		return
+	}
+	// os.Args: self sandboxArg [-chroot root] dir... -- path argv...
+	root := ""
+	i := 2
+	if i+1 < len(os.Args) && os.Args[i] == sandboxChrootArg {
+		root = os.Args[i+1]
+		i += 2
+	}
+	var dirs []string
+	for ; i < len(os.Args) && os.Args[i] != "--"; i++ {
+		dirs = append(dirs, os.Args[i])
+	}
+	if i+2 >= len(os.Args) {
+		fmt.Fprintln(os.Stderr, "Invalid sandbox invocation.")
+		os.Exit(1)
+	}
+	err := sandboxExec(root, dirs, os.Args[i+1], os.Args[i+2:])
+	fmt.Fprintf(os.Stderr, "Cannot run %s in the sandbox: %v\n", os.Args[i+1], err)
+	os.Exit(1)
+}
+
+// sandbox changes cmd to run in the sandbox if it is enabled.
+func (m *state) sandbox(cmd *exec.Cmd) error {
+	if !m.opts.sandbox {
+		return nil
+	}
+	return sandboxCommand(cmd, "", m.workDir)
+}
+
+// sandboxCommand changes cmd to run in the sandbox, only able to write below
+// dirs. Unless root is empty, the command is chrooted into root first and
+// dirs as well as the path of the command are resolved inside of it.
+func sandboxCommand(cmd *exec.Cmd, root string, dirs ...string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{self, sandboxArg}
+	if root != "" {
+		args = append(args, sandboxChrootArg, root)
+	}
+	args = append(append(args, dirs...), "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
@@ -0,0 +1,210 @@
+package melt
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"runtime"
+	"unsafe"
+)
+
+// sandboxSupported reports whether WithSandbox works on this system. The
+// kernel may still lack Landlock.
+const sandboxSupported = true
+
+// sandboxExec restricts the calling thread, chrooted into root unless it is
+// empty, and replaces the process with path. Landlock and seccomp apply to a
+// single thread, which after execve(2) is the only one left. The chroot is
+// set up before seccomp denies chroot(2), so the command cannot leave it.
+func sandboxExec(root string, dirs []string, path string, argv []string) error {
+	runtime.LockOSThread()
+
+	err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("no_new_privs: %v", err)
+	}
+	if root != "" {
+		err = unix.Chroot(root)
+		if err != nil {
+			return fmt.Errorf("chroot %s: %v", root, err)
+		}
+		err = unix.Chdir("/")
+		if err != nil {
+			return fmt.Errorf("chdir: %v", err)
+		}
+	}
+	err = landlock(dirs)
+	if err != nil {
+		return err
+	}
+	err = seccomp()
+	if err != nil {
+		return err
+	}
+	return unix.Exec(path, argv, os.Environ())
+}
+
+// landlockABI returns the version of the Landlock ABI of the kernel.
+func landlockABI() (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0, fmt.Errorf("Landlock is not available: %v", errno)
+	}
+	return int(abi), nil
+}
+
+// landlock denies writing anywhere but below dirs. Reading is not restricted.
+func landlock(dirs []string) error {
+	abi, err := landlockABI()
+	if err != nil {
+		return err
+	}
+	var access uint64 = unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: access}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %v", errno)
+	}
+	defer unix.Close(int(fd))
+
+	allow := func(path string, access uint64) error {
+		pathfd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		defer unix.Close(pathfd)
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(pathfd)}
+		_, _, errno := unix.Syscall(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)))
+		if errno != 0 {
+			return fmt.Errorf("landlock_add_rule %s: %v", path, errno)
+		}
+		return nil
+	}
+	for _, dir := range dirs {
+		err := allow(dir, access)
+		if err != nil {
+			return err
+		}
+	}
+	// Many programs send unwanted output to /dev/null. Chroots of the
+	// smoke test have no /dev.
+	err = allow(os.DevNull, access&(unix.LANDLOCK_ACCESS_FS_WRITE_FILE|unix.LANDLOCK_ACCESS_FS_TRUNCATE))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	_, _, errno = unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %v", errno)
+	}
+	return nil
+}
+
+// Constants for seccomp filters missing from golang.org/x/sys.
+const (
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+	// Offsets of the syscall number and the architecture in struct
+	// seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	// x32 system calls on amd64 have this bit set.
+	x32SyscallBit = 0x40000000
+)
+
+// auditArch maps GOARCH to the architecture seccomp reports for the native
+// system calls.
+var auditArch = map[string]uint32{
+	"386":     0x40000003,
+	"amd64":   0xc000003e,
+	"arm":     0x40000028,
+	"arm64":   0xc00000b7,
+	"ppc64":   0x80000015,
+	"ppc64le": 0xc0000015,
+	"riscv64": 0xc00000f3,
+	"s390x":   0x80000016,
+}
+
+// deniedSyscalls are never needed to melt an image but are commonly used to
+// break out of a compromised process. The filter is a denylist and only
+// best-effort: system calls missing here, including ones of newer kernels,
+// are allowed.
+var deniedSyscalls = []uint32{
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+}
+
+// seccomp installs a filter failing the denied system calls as well as
+// system calls of other architectures with EPERM.
+func seccomp() error {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp filters are not supported on %s.", runtime.GOARCH)
+	}
+	deny := uint32(seccompRetErrno | uint32(unix.EPERM))
+
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt uint8, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	filter := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, deny),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+		jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+		stmt(unix.BPF_RET|unix.BPF_K, deny),
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter,
+			jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, deny))
+	}
+	filter = append(filter, stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow))
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0)
+	if err != nil {
+		return fmt.Errorf("seccomp: %v", err)
+	}
+	return nil
+}
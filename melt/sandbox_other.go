@@ -0,0 +1,18 @@
+//go:build !linux
+
+package melt
+
+import (
+	"errors"
+)
+
+// sandboxSupported reports whether WithSandbox works on this system.
+const sandboxSupported = false
+
+func sandboxExec(root string, dirs []string, path string, argv []string) error {
+	return errors.New("The sandbox is only supported on Linux.")
+}
+
+func landlockABI() (int, error) {
+	return 0, errors.New("Landlock is only available on Linux.")
+}
@@ -0,0 +1,96 @@
+package melt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// SELinuxPolicy selects how security.selinux labels are treated.
+type SELinuxPolicy string
+
+const (
+	// SELinuxPreserve keeps the labels of the source layers. Labels the
+	// build host does not allow to be set are lost with a warning.
+	SELinuxPreserve SELinuxPolicy = "preserve"
+	// SELinuxStrip removes all labels from melted layers.
+	SELinuxStrip SELinuxPolicy = "strip"
+	// SELinuxRelabel sets the label of all files in melted layers to a
+	// given context.
+	SELinuxRelabel SELinuxPolicy = "relabel"
+)
+
+const selinuxXattr = "security.selinux"
+
+// WithSELinux sets how SELinux labels are treated. context is the label used
+// by SELinuxRelabel and ignored otherwise. It defaults to SELinuxPreserve.
+func WithSELinux(policy SELinuxPolicy, context string) Option {
+	return func(o *options) {
+		o.selinux = policy
+		o.selinuxContext = context
+	}
+}
+
+// rsyncExitPartial is the exit code of rsync if some files or attributes
+// could not be transferred.
+const rsyncExitPartial = 23
+
+// selinuxOnlyFailure reports whether rsync failed solely because it was not
+// allowed to set SELinux labels.
+func selinuxOnlyFailure(err error, out []byte) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != rsyncExitPartial {
+		return false
+	}
+	var found bool
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "rsync") || strings.HasPrefix(line, "rsync error: some files/attrs were not transferred") {
+			continue
+		}
+		if !strings.Contains(line, `"`+selinuxXattr+`"`) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+var errRelabelDenied = errors.New("relabeling denied")
+
+// relabel sets the SELinux label of dir and everything below it. If the host
+// does not allow it a warning is emitted instead of failing the melt, unless
+// in strict mode.
+func (m *state) relabel(dir string) error {
+	label := append([]byte(m.opts.selinuxContext), 0)
+	err := walkTree(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		err = lsetxattr(path, selinuxXattr, label)
+		if err != nil {
+			if pe, ok := err.(*os.PathError); ok {
+				switch pe.Err {
+				case syscall.EPERM, syscall.EACCES, syscall.ENOTSUP:
+					err = m.degrade(fmt.Sprintf("Cannot relabel %s: %s.", dir, pe.Err))
+					if err != nil {
+						return err
+					}
+					return errRelabelDenied
+				}
+			}
+			return err
+		}
+		return nil
+	})
+	if err == errRelabelDenied {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+package melt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// SignatureTool is the tool signatures of input images are verified with.
+type SignatureTool string
+
+const (
+	// SignatureCosign verifies sigstore signatures with cosign.
+	SignatureCosign SignatureTool = "cosign"
+	// SignatureNotation verifies notary project signatures with notation
+	// against the trust store and trust policy it is configured with.
+	SignatureNotation SignatureTool = "notation"
+)
+
+// SignaturePolicy describes the signatures an input image needs to be melted.
+type SignaturePolicy struct {
+	Tool SignatureTool
+	// Key is the public key, or a reference to it cosign understands,
+	// the image has to be signed with.
+	Key string
+	// Identity and Issuer are the certificate identity and OIDC issuer a
+	// keyless cosign signature has to be made by. They are used if Key is
+	// empty.
+	Identity string
+	Issuer   string
+}
+
+// WithSignaturePolicy refuses to melt images pulled from a registry unless
+// they carry a valid signature according to policy. The image is resolved to
+// the digest of its manifest first, and both the signature check and the pull
+// use that digest so that the tag cannot be moved in between. Inputs from
+// other transports are rejected as they carry no signatures.
+func WithSignaturePolicy(policy SignaturePolicy) Option {
+	return func(o *options) {
+		o.signatures = &policy
+	}
+}
+
+// validate reports whether the policy can be checked.
+func (p *SignaturePolicy) validate() error {
+	switch p.Tool {
+	case SignatureCosign:
+		if p.Key == "" && (p.Identity == "" || p.Issuer == "") {
+			return errors.New("Verifying cosign signatures needs a key or a certificate identity and issuer.")
+		}
+	case SignatureNotation:
+	default:
+		return fmt.Errorf("Unsupported signature tool %q.", p.Tool)
+	}
+	return nil
+}
+
+// args returns the command verifying the signature of the image ref.
+func (p *SignaturePolicy) args(ref string) []string {
+	if p.Tool == SignatureNotation {
+		return []string{"notation", "verify", ref}
+	}
+	args := []string{"cosign", "verify"}
+	if p.Key != "" {
+		args = append(args, "--key", p.Key)
+	} else {
+		args = append(args, "--certificate-identity", p.Identity, "--certificate-oidc-issuer", p.Issuer)
+	}
+	return append(args, ref)
+}
+
+// pinReference replaces the tag or digest of the registry reference ref, like
+// //registry.example.com/app:1, by digest.
+func pinReference(ref string, digest string) string {
+	name := strings.TrimPrefix(ref, "//")
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name + "@" + digest
+}
+
+// manifestDigest returns the digest of the manifest of the image ref in a
+// registry.
+func manifestDigest(ctx context.Context, ref string) (string, error) {
+	out, err := exec.CommandContext(ctx, "skopeo", "inspect", "--raw", "docker:"+ref).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", &transientError{fmt.Errorf("Failed to inspect %s: %v", ref, err)}
+	}
+	sum := sha256.Sum256(out)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// unpackSigned verifies the signature of the image input according to the
+// signature policy and unpacks it into tmpDir.
+func (m *state) unpackSigned(input string) error {
+	p := m.opts.signatures
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+	name, ref := ParseReference(input)
+	if name != "docker" {
+		return fmt.Errorf("Signatures can only be verified for images pulled from a registry, not %s.", input)
+	}
+	var digest string
+	err = m.retry("Inspecting "+input, func() error {
+		var err error
+		digest, err = manifestDigest(m.ctx, ref)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	pinned := pinReference(ref, digest)
+	args := p.args(pinned)
+	out, err := exec.CommandContext(m.ctx, args[0], args[1:]...).CombinedOutput()
+	if m.ctx.Err() != nil {
+		return m.ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("Image %s has no valid %s signature: %v: %s", input, p.Tool, err, strings.TrimSpace(string(out)))
+	}
+	m.opts.logger.Info("verified signature", "image", input, "digest", digest, "tool", string(p.Tool))
+	return m.unpackImageRetry("docker://"+pinned, m.tmpDir)
+}
+
+// SigningPolicy describes how a melted image is signed once it is written.
+type SigningPolicy struct {
+	// Key is the private key cosign signs the image with, or a KMS
+	// reference like awskms://... cosign understands.
+	Key string
+	// Command is run with sh -c instead of cosign. It finds the output
+	// in $MELT_OUTPUT, the digest of the manifest written to a registry
+	// or OCI layout in $MELT_DIGEST and the IDs of the melted images,
+	// separated by spaces, in $MELT_IMAGE_IDS.
+	Command string
+}
+
+// WithSigning signs the melted image according to policy right after it is
+// written, since melting invalidates the signatures of the input. Signing
+// with cosign needs an output in a registry. Failing to sign fails the melt,
+// but the image has been written by then.
+func WithSigning(policy SigningPolicy) Option {
+	return func(o *options) {
+		o.signing = &policy
+	}
+}
+
+// checkSigning fails before anything is melted if the melted image cannot be
+// signed as asked for when it is written to output.
+func (m *state) checkSigning(output string) error {
+	p := m.opts.signing
+	if p == nil {
+		return nil
+	}
+	if m.opts.format != FormatDockerArchive {
+		return fmt.Errorf("Only images can be signed, not the %s output format.", m.opts.format)
+	}
+	if p.Command == "" {
+		if p.Key == "" {
+			return errors.New("Signing needs a key or a command.")
+		}
+		if name, _ := ParseReference(output); name != "docker" {
+			return fmt.Errorf("Signing with cosign needs an image in a registry, not %s.", output)
+		}
+	}
+	return nil
+}
+
+// sign signs the melted image written to output according to the signing
+// policy.
+func (m *state) sign(output string) error {
+	p := m.opts.signing
+	if p == nil {
+		return nil
+	}
+	var cmd *exec.Cmd
+	if p.Command == "" {
+		if m.outputDigest == "" {
+			return fmt.Errorf("Cannot sign %s: the digest of its manifest is unknown.", output)
+		}
+		_, ref := ParseReference(output)
+		cmd = exec.CommandContext(m.ctx, "cosign", "sign", "--yes", "--key", p.Key, pinReference(ref, m.outputDigest))
+	} else {
+		ids := make([]string, 0, len(m.manifest.Manifest))
+		for _, mf := range m.manifest.Manifest {
+			ids = append(ids, "sha256:"+strings.TrimSuffix(path.Base(mf.ConfigHash), ".json"))
+		}
+		cmd = exec.CommandContext(m.ctx, "sh", "-c", p.Command)
+		cmd.Env = append(os.Environ(), "MELT_OUTPUT="+output, "MELT_DIGEST="+m.outputDigest, "MELT_IMAGE_IDS="+strings.Join(ids, " "))
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to sign %s: %v: %s", output, err, strings.TrimSpace(string(out)))
+	}
+	m.opts.logger.Info("signed melted image", "output", output, "digest", m.outputDigest)
+	return nil
+}
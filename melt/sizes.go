@@ -0,0 +1,119 @@
+package melt
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ImageSizes compares an image before and after melting. Sizes are the sums
+// of the layer.tar files of the layers of the image, compressed sizes what
+// they take up gzip compressed as in a registry.
+type ImageSizes struct {
+	// Name is the name of the melted image as returned by Manifest.Name.
+	Name                         string
+	RepoTags                     []string
+	Layers, MeltedLayers         int
+	Size, MeltedSize             int64
+	Compressed, MeltedCompressed int64
+}
+
+// SizeReport compares all images of a melt before and after. The totals
+// count layers shared between images once.
+type SizeReport struct {
+	Images                       []ImageSizes
+	Size, MeltedSize             int64
+	Compressed, MeltedCompressed int64
+}
+
+// Saved returns the number of bytes melting saved, uncompressed and
+// compressed.
+func (r SizeReport) Saved() (int64, int64) {
+	return r.Size - r.MeltedSize, r.Compressed - r.MeltedCompressed
+}
+
+// WithSizeReport calls fn with the sizes of the images before and after
+// melting once the output was written. Compressing every layer to measure it
+// takes time, so it is only done if a report was asked for.
+func WithSizeReport(fn func(SizeReport)) Option {
+	return func(o *options) {
+		o.sizeReport = fn
+	}
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// gzipSize returns the size of file after gzip compression at level.
+func gzipSize(file string, level int) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var n countingWriter
+	err = gzipTo(&n, f, level)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+// measureLayer records the compressed size of layer.tar of layer. If melted
+// is set it is the size after melting.
+func (m *state) measureLayer(layer string, melted bool) error {
+	if m.opts.sizeReport == nil {
+		return nil
+	}
+	size, err := gzipSize(filepath.Join(m.tmpDir, layer), m.opts.compressionLevel)
+	if err != nil {
+		return err
+	}
+	m.sizesMutex.Lock()
+	defer m.sizesMutex.Unlock()
+	if melted {
+		m.meltedGzSizes[layer] = size
+	} else {
+		m.gzSizes[layer] = size
+	}
+	return nil
+}
+
+// reportSizes passes the size report to the callback of WithSizeReport.
+func (m *state) reportSizes() {
+	if m.opts.sizeReport == nil {
+		return
+	}
+	var r SizeReport
+	seen := make(map[string]bool)
+	for i, mf := range m.manifest.Manifest {
+		img := ImageSizes{
+			Name:         mf.Name(),
+			RepoTags:     mf.RepoTags,
+			Layers:       len(m.origLayers[i]),
+			MeltedLayers: len(mf.layers),
+		}
+		for _, l := range m.origLayers[i] {
+			img.Size += m.sizes[l]
+			img.Compressed += m.gzSizes[l]
+			if !seen[l] {
+				r.Size += m.sizes[l]
+				r.Compressed += m.gzSizes[l]
+			}
+			seen[l] = true
+		}
+		for _, l := range mf.layers {
+			img.MeltedSize += m.meltedSizes[l]
+			img.MeltedCompressed += m.meltedGzSizes[l]
+		}
+		r.Images = append(r.Images, img)
+	}
+	for l, size := range m.meltedSizes {
+		r.MeltedSize += size
+		r.MeltedCompressed += m.meltedGzSizes[l]
+	}
+	m.opts.sizeReport(r)
+}
@@ -0,0 +1,126 @@
+package melt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// smokeDir is the directory in the work directory the root filesystems of the
+// images are assembled in to run the test command.
+const smokeDir = "smoke"
+
+// defaultPath is the PATH of the test command if the image does not set one,
+// like docker does for containers.
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// WithTestCommand runs cmd with /bin/sh -c chrooted into the root filesystem
+// of every melted image before its layers are packed and fails the melt if it
+// does not succeed. The command gets the environment of the image
+// configuration. The root filesystem is mounted read-only below an overlay
+// with its upper directory on a tmpfs, so the command can write files without
+// changing the image. Neither /proc nor /dev are mounted. With WithSandbox the
+// command also runs in the sandbox, confined to its chroot. It is only
+// supported on Linux and needs the privileges to mount and chroot.
+func WithTestCommand(cmd string) Option {
+	return func(o *options) {
+		o.testCmd = cmd
+	}
+}
+
+// testImages runs the test command in every image.
+func (m *state) testImages() error {
+	scratch := filepath.Join(m.workDir, smokeDir)
+	defer os.RemoveAll(scratch)
+	for _, mf := range m.manifest.Manifest {
+		err := os.RemoveAll(scratch)
+		if err != nil {
+			return err
+		}
+		rootfs := filepath.Join(scratch, "rootfs")
+		err = os.MkdirAll(rootfs, 0755)
+		if err != nil {
+			return err
+		}
+		err = m.assembleRootfs(mf, scratch, rootfs)
+		if err != nil {
+			return err
+		}
+		out, err := runChrooted(m.ctx, rootfs, scratch, m.opts.testCmd, imageEnv(mf.config), m.opts.sandbox)
+		if err != nil {
+			msg := fmt.Sprintf("Smoke test of image %s failed: %v", mf.Name(), err)
+			if out := strings.TrimSpace(string(out)); out != "" {
+				msg += ": " + out
+			}
+			return errors.New(msg + ".")
+		}
+		m.opts.logger.Info("smoke test passed", "image", mf.Name())
+	}
+	return nil
+}
+
+// assembleRootfs copies the files of the layers of mf into rootfs, applying
+// their whiteouts. Melted layers are taken from the directories they are
+// unpacked in, the others are extracted into scratch first.
+func (m *state) assembleRootfs(mf Manifest, scratch string, rootfs string) error {
+	for _, l := range mf.layers {
+		if !m.untouched[l] && m.plan.root(l) != l {
+			// Its files are in the directory of its root layer.
+			continue
+		}
+		_, reused := m.reuse[l]
+		dir := filepath.Join(m.tmpDir, unpackDir(l))
+		if m.untouched[l] || reused {
+			dir = filepath.Join(scratch, "layer")
+			err := os.RemoveAll(dir)
+			if err != nil {
+				return err
+			}
+			err = os.Mkdir(dir, 0755)
+			if err != nil {
+				return err
+			}
+			err = extractTar(filepath.Join(m.tmpDir, l), dir)
+			if err != nil {
+				return err
+			}
+		}
+		err := replaceTypeChanges(dir, rootfs, false)
+		if err != nil {
+			return err
+		}
+		err = applyWhiteouts(dir, rootfs, false)
+		if err != nil {
+			return err
+		}
+		flags := "-aXhH"
+		if !xattrSupported {
+			flags = "-ahH"
+		}
+		cmd := exec.CommandContext(m.ctx, "rsync", flags, "--numeric-ids", "--exclude=.wh.*", dir+"/", rootfs)
+		err = m.sandbox(cmd)
+		if err != nil {
+			return err
+		}
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Cannot copy %s for the smoke test: %v: %s", l, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// imageEnv returns the environment configured for the image.
+func imageEnv(config *ImageConfig) []string {
+	var env []string
+	if config != nil && config.Config != nil {
+		env = append(env, config.Config.Env...)
+	}
+	if hasPath(env) {
+		return env
+	}
+	return append([]string{defaultPath}, env...)
+}
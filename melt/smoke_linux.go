@@ -0,0 +1,78 @@
+package melt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// smokeSupported reports whether WithTestCommand works on this system.
+const smokeSupported = true
+
+// overlaySupported reports why the kernel cannot mount overlays, if it
+// cannot.
+func overlaySupported() error {
+	data, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(strings.TrimPrefix(line, "nodev")) == "overlay" {
+			return nil
+		}
+	}
+	return errors.New("The kernel does not support overlay mounts.")
+}
+
+// runChrooted runs command with /bin/sh -c chrooted into an overlay of rootfs
+// whose upper directory is on a tmpfs mounted below scratch. If sandboxed, it
+// runs in the sandbox, which sets up the chroot itself and only lets it write
+// inside of it.
+func runChrooted(ctx context.Context, rootfs string, scratch string, command string, env []string, sandboxed bool) ([]byte, error) {
+	tmpfs := filepath.Join(scratch, "tmpfs")
+	mnt := filepath.Join(scratch, "mnt")
+	for _, dir := range []string{tmpfs, mnt} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := unix.Mount("tmpfs", tmpfs, "tmpfs", 0, "mode=0755")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot mount a tmpfs: %v", err)
+	}
+	defer unix.Unmount(tmpfs, unix.MNT_DETACH)
+	upper := filepath.Join(tmpfs, "upper")
+	work := filepath.Join(tmpfs, "work")
+	for _, dir := range []string{upper, work} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", rootfs, upper, work)
+	err = unix.Mount("overlay", mnt, "overlay", 0, data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot mount an overlay: %v", err)
+	}
+	defer unix.Unmount(mnt, unix.MNT_DETACH)
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Dir = "/"
+	cmd.Env = env
+	if sandboxed {
+		err = sandboxCommand(cmd, mnt, "/")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: mnt}
+	}
+	return cmd.CombinedOutput()
+}
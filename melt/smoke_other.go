@@ -0,0 +1,19 @@
+//go:build !linux
+
+package melt
+
+import (
+	"context"
+	"errors"
+)
+
+// smokeSupported reports whether WithTestCommand works on this system.
+const smokeSupported = false
+
+func runChrooted(ctx context.Context, rootfs string, scratch string, command string, env []string, sandboxed bool) ([]byte, error) {
+	return nil, errors.New("Smoke tests are only supported on Linux.")
+}
+
+func overlaySupported() error {
+	return errors.New("Overlay mounts are only supported on Linux.")
+}
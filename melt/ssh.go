@@ -0,0 +1,121 @@
+package melt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/brauner/tarski"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// sshTransport handles docker save tarballs on other hosts, addressed as
+// ssh://[user@]host[:port]/path. Paths starting with /~/ are relative to the
+// home directory of the user like those of scp. The tarball is streamed
+// through ssh, which has to be able to log in without asking for a password,
+// and is moved into place on the remote host once it is complete.
+type sshTransport struct{}
+
+// parseSSH splits the reference //[user@]host[:port]/path into the ssh
+// destination, port and remote path.
+func parseSSH(ref string) (string, string, string, error) {
+	rest := strings.TrimPrefix(ref, "//")
+	i := strings.Index(rest, "/")
+	if !strings.HasPrefix(ref, "//") || i <= 0 || i == len(rest)-1 {
+		return "", "", "", fmt.Errorf("Invalid ssh reference %s, expected ssh://[user@]host[:port]/path.", ref)
+	}
+	host, path := rest[:i], rest[i:]
+	var port string
+	if j := strings.LastIndex(host, ":"); j >= 0 && !strings.HasSuffix(host, "]") {
+		host, port = host[:j], host[j+1:]
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.HasPrefix(path, "/~/") {
+		path = path[len("/~/"):]
+	}
+	return host, port, path, nil
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// run runs the shell command remote returns for the remote path on the host
+// of ref.
+func (sshTransport) run(ctx context.Context, ref string, remote func(path string) string, stdin *os.File, stdout *os.File) error {
+	host, port, path, err := parseSSH(ref)
+	if err != nil {
+		return err
+	}
+	args := []string{"-o", "BatchMode=yes"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", host, remote(path))
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, &stderr
+	err = cmd.Run()
+	if err != nil {
+		// ssh exits with 255 if the connection failed.
+		err = fmt.Errorf("Failed to copy ssh:%s: %s: %s", ref, err, strings.TrimSpace(stderr.String()))
+		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 255 {
+			err = &transientError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (t sshTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	archive, err := tempArchive(dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	err = t.run(ctx, ref, func(path string) string {
+		return "cat -- " + shellQuote(path)
+	}, nil, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return extractTar(archive, dir)
+}
+
+func (t sshTransport) Pack(ctx context.Context, dir string, ref string) error {
+	archive, err := tempArchive(dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+
+	err = tarski.Create(archive, dir, dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return t.run(ctx, ref, func(path string) string {
+		tmp := shellQuote(path + ".part")
+		return "cat > " + tmp + " && mv -f -- " + tmp + " " + shellQuote(path)
+	}, f, nil)
+}
+
+func init() {
+	RegisterTransport("ssh", sshTransport{})
+}
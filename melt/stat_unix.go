@@ -0,0 +1,38 @@
+//go:build !windows
+
+package melt
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode identifies a file on the host.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// fileInode returns the inode of the file described by info and its number of
+// links.
+func fileInode(info os.FileInfo) (inode, uint64) {
+	st := info.Sys().(*syscall.Stat_t)
+	return inode{uint64(st.Dev), uint64(st.Ino)}, uint64(st.Nlink)
+}
+
+// fileOwner returns the owner of the file described by info.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	st := info.Sys().(*syscall.Stat_t)
+	return int(st.Uid), int(st.Gid), true
+}
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system of dir.
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
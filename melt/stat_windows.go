@@ -0,0 +1,23 @@
+package melt
+
+import (
+	"errors"
+	"os"
+)
+
+// Windows exposes neither the number of links nor the owner of a file through
+// os.FileInfo. Every file counts as a single link and files have no owner.
+
+type inode struct{}
+
+func fileInode(info os.FileInfo) (inode, uint64) {
+	return inode{}, 1
+}
+
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("The free space is not known on Windows.")
+}
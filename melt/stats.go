@@ -0,0 +1,233 @@
+package melt
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ImageStats estimates what melting an image into a single layer saves.
+type ImageStats struct {
+	// Name is the name of the image as returned by Manifest.Name.
+	Name     string
+	RepoTags []string
+	Layers   int
+	// Size is the sum of the sizes of the layer.tar files of the image.
+	Size int64
+	// Estimated is the size of the layer.tar the image would be melted
+	// into.
+	Estimated int64
+	// Transfer and MeltedTransfer are the bytes of the layers pushing the
+	// image and the melted image would upload to a registry that has the
+	// layers passed to StatsAgainst already. Both count uncompressed
+	// layers.
+	Transfer       int64
+	MeltedTransfer int64
+}
+
+// Saved returns the number of bytes melting the image would save.
+func (s ImageStats) Saved() int64 {
+	return s.Size - s.Estimated
+}
+
+// blocks returns the number of bytes an entry of size bytes takes up in a tar
+// archive without extended headers.
+func blocks(size int64) int64 {
+	return 512 + (size+511)/512*512
+}
+
+// paxSize returns the number of bytes the PAX extended header holding records
+// takes up.
+func paxSize(records map[string]string) int64 {
+	if len(records) == 0 {
+		return 0
+	}
+	var n int64
+	for k, v := range records {
+		// "%d %s=%s\n" with a length of up to four digits.
+		n += int64(len(k)+len(v)) + 7
+	}
+	return blocks(n)
+}
+
+// readIndex returns the entries of the layer.tar read from r, each with the
+// number of bytes it takes up in the archive including its headers.
+func readIndex(r io.Reader) ([]overlayEntry[int64], error) {
+	var entries []overlayEntry[int64]
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		var size int64
+		if hdr.Typeflag == tar.TypeReg {
+			size = hdr.Size
+		}
+		entries = append(entries, overlayEntry[int64]{
+			name:  name,
+			dir:   hdr.Typeflag == tar.TypeDir,
+			value: blocks(size) + paxSize(hdr.PAXRecords),
+		})
+	}
+}
+
+// estimate returns the size of the single layer the layers with the given
+// indexes are melted into.
+func estimate(indexes [][]overlayEntry[int64]) int64 {
+	root := newOverlay[int64]()
+	for _, index := range indexes {
+		root.apply(index)
+	}
+	// Two zero blocks end the archive.
+	size := int64(1024)
+	for _, s := range root.files {
+		size += s
+	}
+	return size
+}
+
+// Stats estimates for every image in the docker save tarball archive how
+// large it would be melted into a single layer. Only the headers of the layers
+// are read, nothing is extracted. The result is sorted by the number of bytes
+// saved, largest first.
+func Stats(archive string) ([]ImageStats, error) {
+	return StatsAgainst(archive, nil)
+}
+
+// StatsAgainst is Stats for pushing to a registry that has the layers with
+// the given diffIDs already, like those RemoteLayers returns for the images
+// in the target repository. It also estimates the bytes pushing every image
+// and its melted version would transfer. The melted layer is new to every
+// registry unless the image has a single layer already.
+func StatsAgainst(archive string, existing []string) ([]ImageStats, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var manifest []Manifest
+	indexes := make(map[string][]overlayEntry[int64])
+	sizes := make(map[string]int64)
+	configs := make(map[string][]byte)
+	// Some tools store identical layers once and link to them.
+	links := make(map[string]string)
+	outer := tar.NewReader(f)
+	for {
+		hdr, err := outer.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == "manifest.json":
+			if hdr.Size > MaxManifestSize {
+				return nil, errors.New("manifest.json exceeds the size limit.")
+			}
+			buf, err := ioutil.ReadAll(outer)
+			if err != nil {
+				return nil, err
+			}
+			var r RawManifest
+			err = r.Parse(buf)
+			if err != nil {
+				return nil, err
+			}
+			manifest = r.Manifest
+		case existing != nil && strings.HasSuffix(name, ".json") && hdr.Typeflag == tar.TypeReg:
+			if hdr.Size > MaxConfigSize {
+				return nil, fmt.Errorf("%s exceeds the size limit.", name)
+			}
+			configs[name], err = ioutil.ReadAll(outer)
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasSuffix(name, "/layer.tar") && hdr.Typeflag == tar.TypeLink:
+			links[name] = path.Clean(strings.TrimLeft(hdr.Linkname, "/"))
+		case strings.HasSuffix(name, "/layer.tar") && hdr.Typeflag == tar.TypeSymlink:
+			target := hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(name), target)
+			}
+			links[name] = path.Clean(strings.TrimLeft(target, "/"))
+		case strings.HasSuffix(name, "/layer.tar"):
+			index, err := readIndex(outer)
+			if err != nil {
+				return nil, err
+			}
+			indexes[name] = index
+			sizes[name] = hdr.Size
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("Archive has no manifest.json.")
+	}
+
+	have := make(map[string]bool, len(existing))
+	for _, d := range existing {
+		have[d] = true
+	}
+	var stats []ImageStats
+	for _, mf := range manifest {
+		s := ImageStats{Name: mf.Name(), RepoTags: mf.RepoTags, Layers: len(mf.layers)}
+		var diffIDs []string
+		if existing != nil {
+			var img ImageConfig
+			err = img.Parse(configs[mf.ConfigHash])
+			if err != nil {
+				return nil, fmt.Errorf("Configuration of %s: %v", mf.Name(), err)
+			}
+			if len(img.RootFS.DiffIDs) != len(mf.layers) {
+				return nil, fmt.Errorf("Image %s has %d layers but a different number of diffIDs.", mf.Name(), len(mf.layers))
+			}
+			diffIDs = img.diffIDs()
+		}
+		layers := make([][]overlayEntry[int64], 0, len(mf.layers))
+		for i, l := range mf.layers {
+			for i := 0; i < maxSymlinks && links[l] != ""; i++ {
+				l = links[l]
+			}
+			index, ok := indexes[l]
+			if !ok {
+				return nil, fmt.Errorf("Layer %s is missing from the archive.", l)
+			}
+			layers = append(layers, index)
+			s.Size += sizes[l]
+			if diffIDs != nil && !have[diffIDs[i]] {
+				s.Transfer += sizes[l]
+			}
+		}
+		s.Estimated = estimate(layers)
+		if diffIDs != nil {
+			s.MeltedTransfer = s.Estimated
+			if len(mf.layers) == 1 {
+				s.MeltedTransfer = s.Transfer
+			}
+		}
+		stats = append(stats, s)
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Saved() > stats[j].Saved()
+	})
+	return stats, nil
+}
@@ -0,0 +1,101 @@
+package melt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MeltStream melts the docker save tarball read from src and writes the
+// melted tarball to dst. The stream is spooled into the temporary directory
+// and removed as soon as it is unpacked, so at most the unpacked image and
+// one archive occupy the disk at any time. Everything is removed before
+// MeltStream returns, unless WithWorkDir asks to keep it. Only the docker-archive output format is supported. If
+// there is nothing to be done, ErrSingleLayer or ErrAllShared is returned and
+// nothing is written to dst.
+func (ml *Melter) MeltStream(ctx context.Context, src io.Reader, dst io.Writer) error {
+	if ml.opts.format != FormatDockerArchive {
+		return fmt.Errorf("Streaming only supports the %s output format.", FormatDockerArchive)
+	}
+	if ml.opts.signing != nil {
+		return errors.New("Streamed images cannot be signed.")
+	}
+	m, err := ml.newState(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.cleanup()
+	err = m.meltStream(src, dst)
+	m.finishState(err)
+	return err
+}
+
+// meltStream spools src to the work directory, melts it and copies the result
+// to dst.
+func (m *state) meltStream(src io.Reader, dst io.Writer) error {
+	err := m.phase(PhaseExtract)
+	if err != nil {
+		return err
+	}
+	archive := filepath.Join(m.workDir, streamFile)
+	err = m.spool(src, archive)
+	if err != nil {
+		return err
+	}
+	err = extractTar(archive, m.tmpDir)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(archive)
+	if err != nil {
+		return err
+	}
+
+	err = m.meltUnpacked("docker-archive:" + archive)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, ctxReader{m.ctx, f})
+	return err
+}
+
+// spool writes src to the file path and records its digest as the digest of
+// the input.
+func (m *state) spool(src io.Reader, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), ctxReader{m.ctx, src})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	m.inputDigest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	return f.Close()
+}
+
+// ctxReader stops reading from r once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	err := c.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
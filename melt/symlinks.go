@@ -0,0 +1,92 @@
+package melt
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runtimeDirs are the directories container runtimes mount over the root
+// file system. Symlinks into them are expected to dangle in the image.
+var runtimeDirs = map[string]bool{"proc": true, "sys": true, "dev": true}
+
+// WithSymlinkCheck sets how symlinks in the root file system of a melted image
+// whose targets do not exist are reported. They often mean that melting or a
+// whiteout removed something the image needs. Symlinks into /proc, /sys and
+// /dev are not reported. It defaults to CheckOff, WithStrict turns CheckWarn
+// into CheckFail.
+func WithSymlinkCheck(mode CheckMode) Option {
+	return func(o *options) {
+		o.linkCheck = mode
+	}
+}
+
+// danglingSymlinks returns the symlinks in the root file system files whose
+// targets do not exist or cannot be resolved, formatted as link -> target.
+func danglingSymlinks(files map[string]rootEntry) []string {
+	lookup := func(p string) (string, bool, error) {
+		if runtimeDirs[strings.SplitN(p, "/", 2)[0]] {
+			return "", false, nil
+		}
+		e, ok := files[p]
+		if !ok {
+			return "", false, os.ErrNotExist
+		}
+		return e.link, e.link != "", nil
+	}
+	var dangling []string
+	for p, e := range files {
+		if e.link == "" {
+			continue
+		}
+		_, err := resolveWith(p, lookup)
+		if err != nil {
+			dangling = append(dangling, fmt.Sprintf("%s -> %s", p, e.link))
+		}
+	}
+	sort.Strings(dangling)
+	return dangling
+}
+
+// checkSymlinks looks for dangling symlinks in the root file system of every
+// melted image.
+func (m *state) checkSymlinks() error {
+	if m.opts.linkCheck == CheckOff {
+		return nil
+	}
+	var msgs []string
+	for _, mf := range m.manifest.Manifest {
+		files, err := m.imagePaths(mf.layers)
+		if err != nil {
+			return err
+		}
+		dangling := danglingSymlinks(files)
+		if len(dangling) == 0 {
+			continue
+		}
+		listed := dangling
+		if len(listed) > maxListed {
+			listed = listed[:maxListed]
+		}
+		noun := "symlinks"
+		if len(dangling) == 1 {
+			noun = "symlink"
+		}
+		msg := fmt.Sprintf("Image %s has %d dangling %s: %s", mf.Name(), len(dangling), noun, strings.Join(listed, ", "))
+		if len(listed) < len(dangling) {
+			msg += ", ..."
+		}
+		msgs = append(msgs, msg+".")
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if m.opts.linkCheck == CheckFail || m.opts.strict {
+		return fmt.Errorf("%s", strings.Join(msgs, " "))
+	}
+	for _, msg := range msgs {
+		m.warn(msg)
+	}
+	return nil
+}
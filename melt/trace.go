@@ -0,0 +1,103 @@
+package melt
+
+import (
+	"context"
+	"fmt"
+)
+
+// LayerTrace describes what melting does to the layer of a history entry.
+type LayerTrace struct {
+	History History
+	// Layer and DiffID are empty for history entries without a layer.
+	Layer  string
+	DiffID string
+	// Into is the layer of the melted image that holds the content of
+	// Layer.
+	Into string
+	// Reason explains why Layer is melted or preserved.
+	Reason string
+}
+
+// ImageTrace lists the history entries of an image and what melting does to
+// their layers.
+type ImageTrace struct {
+	Name    string
+	Entries []LayerTrace
+}
+
+// Trace plans the melt of input like Melt would and returns for every history
+// entry of every image the layer of the melted image its layer ends up in,
+// without melting anything. If there is nothing to be done, ErrSingleLayer or
+// ErrAllShared is returned.
+func (ml *Melter) Trace(ctx context.Context, input string) ([]ImageTrace, error) {
+	m, err := ml.newState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.cleanup()
+
+	err = m.unpackInput(input)
+	if err != nil {
+		return nil, err
+	}
+	err = m.load()
+	if err != nil {
+		return nil, err
+	}
+	err = m.classifyLayers()
+	if err != nil {
+		return nil, err
+	}
+	err = m.planLayers()
+	if err != nil {
+		return nil, err
+	}
+	return m.trace(), nil
+}
+
+// trace maps the history entries of every image to the layers they are
+// melted into according to the plan.
+func (m *state) trace() []ImageTrace {
+	members := make(map[string]int)
+	for l := range m.allLayers {
+		if r := m.plan.root(l); r != l {
+			members[r]++
+		}
+	}
+
+	var traces []ImageTrace
+	for _, mf := range m.manifest.Manifest {
+		t := ImageTrace{Name: mf.Name()}
+		j := 0
+		for _, h := range mf.config.History {
+			e := LayerTrace{History: h}
+			if h.EmptyLayer || j >= len(mf.layers) {
+				e.Reason = "no layer"
+				t.Entries = append(t.Entries, e)
+				continue
+			}
+			l := mf.layers[j]
+			e.Layer = l
+			e.DiffID = string(mf.config.RootFS.DiffIDs[j])
+			e.Into = m.plan.root(l)
+			switch {
+			case e.Into != l:
+				e.Reason = "melted"
+			case m.base[l]:
+				e.Reason = "preserved, part of the base image"
+			case members[l] == 1:
+				e.Reason = "preserved, 1 layer melted into it"
+			case members[l] > 1:
+				e.Reason = fmt.Sprintf("preserved, %d layers melted into it", members[l])
+			case m.allLayers[l] > 0:
+				e.Reason = "preserved, shared with other images"
+			default:
+				e.Reason = "preserved"
+			}
+			t.Entries = append(t.Entries, e)
+			j++
+		}
+		traces = append(traces, t)
+	}
+	return traces
+}
@@ -0,0 +1,261 @@
+package melt
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileTransform is called for every file of a melted layer before the layer is
+// packed. name is the slash separated path of the file in the layer, hdr
+// describes it as it would be stored and r reads the content of regular files
+// and is nil for everything else. The returned header and content are stored
+// instead: a nil header drops the file and a nil reader keeps its content.
+// Changing the name moves the file within the layer, changing the type
+// replaces it by a regular file, directory or symlink. Layers are packed in
+// parallel, so the callback has to be safe for concurrent use.
+type FileTransform func(name string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error)
+
+// WithFileTransform calls fn for every file entering a melted layer, e.g. to
+// strip binaries or render configuration templates. Layers that are not
+// melted are passed through unchanged. Multiple transforms are applied in the
+// order they are given, each seeing the result of the previous one.
+func WithFileTransform(fn FileTransform) Option {
+	return func(o *options) {
+		o.transforms = append(o.transforms, fn)
+	}
+}
+
+// applyTransforms passes a file through all transforms. A transform that
+// keeps the content passes the reader it was given on, rewound if possible.
+func (m *state) applyTransforms(name string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+	var content io.Reader
+	for _, fn := range m.opts.transforms {
+		if s, ok := r.(io.Seeker); ok {
+			_, err := s.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		var c io.Reader
+		var err error
+		hdr, c, err = fn(name, hdr, r)
+		if err != nil || hdr == nil {
+			return nil, nil, err
+		}
+		if c != nil {
+			content, r = c, c
+		}
+	}
+	return hdr, content, nil
+}
+
+// transformFiles passes every file below dir, the unpacked layer, through the
+// transform callback.
+func (m *state) transformFiles(layer string, dir string) error {
+	// moved holds the files that were moved or created by the callback.
+	// They might be walked over later but must not be transformed twice.
+	moved := make(map[string]bool)
+	return walkTree(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if moved[name] {
+			return nil
+		}
+		dst, err := m.transformFile(dir, name, info)
+		if err != nil {
+			return fmt.Errorf("Transforming %s of %s: %v", rel, layer, err)
+		}
+		if dst != "" && dst != name {
+			moved[dst] = true
+		}
+		// Directories that were dropped or replaced are not entered.
+		if info.IsDir() {
+			if fi, err := os.Lstat(p); err != nil || !fi.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+}
+
+// transformFile passes the file name of dir through the transform callback and
+// returns the name it ends up with, or "" if it was dropped.
+func (m *state) transformFile(dir string, name string, info os.FileInfo) (string, error) {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return "", err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	orig := *hdr
+
+	var r io.Reader
+	if info.Mode().IsRegular() {
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	hdr, content, err := m.applyTransforms(name, hdr, r)
+	if err != nil {
+		return "", err
+	}
+	if hdr == nil {
+		return "", os.RemoveAll(p)
+	}
+
+	dst := p
+	newName := strings.TrimSuffix(hdr.Name, "/")
+	if newName != name {
+		clean := path.Clean(newName)
+		if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return "", fmt.Errorf("Name %s escapes the layer.", hdr.Name)
+		}
+		if info.IsDir() {
+			return "", fmt.Errorf("Cannot rename directory to %s.", hdr.Name)
+		}
+		dst = filepath.Join(dir, filepath.FromSlash(clean))
+		newName = clean
+	}
+
+	if hdr.Typeflag != orig.Typeflag || hdr.Linkname != orig.Linkname {
+		err = os.RemoveAll(p)
+		if err != nil {
+			return "", err
+		}
+		err = create(dst, hdr, content)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		if content != nil {
+			err = writeFile(p, content)
+			if err != nil {
+				return "", err
+			}
+		}
+		if dst != p {
+			err = os.MkdirAll(filepath.Dir(dst), 0755)
+			if err != nil {
+				return "", err
+			}
+			err = os.Rename(p, dst)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return newName, applyHeader(dst, hdr, &orig, content != nil)
+}
+
+// create replaces p by the file described by hdr.
+func create(p string, hdr *tar.Header, content io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		if content == nil {
+			content = strings.NewReader("")
+		}
+		return writeFile(p, content)
+	case tar.TypeDir:
+		return os.Mkdir(p, 0755)
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, p)
+	}
+	return fmt.Errorf("Unsupported file type %q.", hdr.Typeflag)
+}
+
+// writeFile replaces the content of p. The file is written next to p and
+// renamed over it, so hardlinks to p keep the old content.
+func writeFile(p string, content io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), ".go-docker-melt_")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// applyHeader applies the mode, owner and modification time of hdr to p
+// wherever they differ from orig, the header p was described by before. A
+// replaced or rewritten file gets all of them.
+func applyHeader(p string, hdr *tar.Header, orig *tar.Header, rewritten bool) error {
+	replaced := rewritten || hdr.Typeflag != orig.Typeflag || hdr.Linkname != orig.Linkname
+	// chown(2) clears the setuid and setgid bits, so the owner is set
+	// first.
+	if replaced || hdr.Uid != orig.Uid || hdr.Gid != orig.Gid {
+		err := os.Lchown(p, hdr.Uid, hdr.Gid)
+		if err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink && (replaced || hdr.Mode != orig.Mode || hdr.Uid != orig.Uid || hdr.Gid != orig.Gid) {
+		err := os.Chmod(p, os.FileMode(hdr.Mode).Perm()|modeBits(hdr.Mode))
+		if err != nil {
+			return err
+		}
+	}
+	if (replaced && !hdr.ModTime.IsZero()) || !hdr.ModTime.Equal(orig.ModTime) {
+		return lutimes(p, hdr.ModTime)
+	}
+	return nil
+}
+
+// modeBits returns the setuid, setgid and sticky bits of a tar mode as
+// os.FileMode bits.
+func modeBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,211 @@
+package melt
+
+import (
+	"context"
+	"fmt"
+	"github.com/brauner/tarski"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Transport reads and writes images in the layout produced by docker save.
+// Inputs and outputs are addressed skopeo style as transport:reference, e.g.
+// docker-archive:/tmp/image.tar or docker://docker.io/library/alpine. Strings
+// that do not start with the name of a registered transport are paths to a
+// docker save tarball.
+type Transport interface {
+	// Unpack stores the image referenced by ref in the empty directory
+	// dir.
+	Unpack(ctx context.Context, ref string, dir string) error
+	// Pack stores the image in dir as ref.
+	Pack(ctx context.Context, dir string, ref string) error
+}
+
+var transportsMutex sync.Mutex
+var transports = make(map[string]Transport)
+
+// RegisterTransport makes t available under name. A transport registered
+// earlier under the same name is replaced.
+func RegisterTransport(name string, t Transport) {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	transports[name] = t
+}
+
+func lookupTransport(name string) Transport {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	return transports[name]
+}
+
+// ParseReference splits s into the name of its transport and the reference
+// passed to the transport.
+func ParseReference(s string) (string, string) {
+	i := strings.Index(s, ":")
+	if i > 0 && lookupTransport(s[:i]) != nil {
+		return s[:i], s[i+1:]
+	}
+	return "docker-archive", s
+}
+
+// pusher is implemented by transports that report what they transferred.
+// push stores the image in dir as ref like Pack.
+type pusher interface {
+	push(ctx context.Context, dir string, ref string) (pushResult, error)
+}
+
+// pushResult describes an image that was pushed.
+type pushResult struct {
+	// digest is the digest of the manifest written.
+	digest string
+	// reused holds the digests of the blobs the destination had already,
+	// possibly abbreviated and without their algorithm.
+	reused []string
+}
+
+func unpackImage(ctx context.Context, s string, dir string) error {
+	name, ref := ParseReference(s)
+	return lookupTransport(name).Unpack(ctx, ref, dir)
+}
+
+func packImage(ctx context.Context, dir string, s string) error {
+	name, ref := ParseReference(s)
+	return lookupTransport(name).Pack(ctx, dir, ref)
+}
+
+// archiveTransport handles docker save tarballs. Directories holding an
+// unpacked one or an OCI image layout are read as well.
+type archiveTransport struct{}
+
+func (archiveTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	if fi, err := os.Stat(ref); err == nil && fi.IsDir() {
+		return copyDir(ctx, ref, dir)
+	}
+	return extractTar(ref, dir)
+}
+
+func (archiveTransport) Pack(ctx context.Context, dir string, ref string) error {
+	return tarski.Create(ref, dir, dir)
+}
+
+// dirTransport handles directories holding an unpacked docker save tarball.
+// Unlike skopeo's dir transport it does not use the OCI layout.
+type dirTransport struct{}
+
+func copyDir(ctx context.Context, from string, to string) error {
+	out, err := exec.CommandContext(ctx, "cp", "-a", from+"/.", to).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to copy %s to %s: %s: %s", from, to, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (dirTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	return copyDir(ctx, ref, dir)
+}
+
+func (dirTransport) Pack(ctx context.Context, dir string, ref string) error {
+	err := os.MkdirAll(ref, 0755)
+	if err != nil {
+		return err
+	}
+	err = IsEmptyDir(ref)
+	if err == nil {
+		return fmt.Errorf("Directory %s is not empty.", ref)
+	}
+	if err != io.EOF {
+		return err
+	}
+	return copyDir(ctx, dir, ref)
+}
+
+// skopeoTransport handles all transports skopeo knows about by letting skopeo
+// copy between them and a temporary docker save tarball.
+type skopeoTransport struct {
+	name string
+}
+
+func (t skopeoTransport) copy(ctx context.Context, from string, to string, args ...string) (string, error) {
+	args = append(append([]string{"copy"}, args...), from, to)
+	out, err := exec.CommandContext(ctx, "skopeo", args...).CombinedOutput()
+	if err != nil {
+		// Most failures are caused by the network or the registry.
+		return "", &transientError{fmt.Errorf("Failed to copy %s to %s: %s: %s", from, to, err, strings.TrimSpace(string(out)))}
+	}
+	return string(out), nil
+}
+
+// reusedBlob matches the lines skopeo copy prints for blobs the destination
+// had already.
+var reusedBlob = regexp.MustCompile(`(?m)^Copying blob (?:sha256:)?([0-9a-f]+)\s+skipped`)
+
+// tempArchive returns the path of a new temporary file next to dir.
+func tempArchive(dir string) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(dir), "go-docker-melt_*.tar")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+func (t skopeoTransport) Unpack(ctx context.Context, ref string, dir string) error {
+	archive, err := tempArchive(dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+
+	// skopeo refuses to overwrite an existing archive.
+	os.Remove(archive)
+	_, err = t.copy(ctx, t.name+":"+ref, "docker-archive:"+archive)
+	if err != nil {
+		return err
+	}
+	return extractTar(archive, dir)
+}
+
+func (t skopeoTransport) Pack(ctx context.Context, dir string, ref string) error {
+	_, err := t.push(ctx, dir, ref)
+	return err
+}
+
+func (t skopeoTransport) push(ctx context.Context, dir string, ref string) (pushResult, error) {
+	var r pushResult
+	archive, err := tempArchive(dir)
+	if err != nil {
+		return r, err
+	}
+	defer os.Remove(archive)
+
+	err = tarski.Create(archive, dir, dir)
+	if err != nil {
+		return r, err
+	}
+	digestFile := archive + ".digest"
+	defer os.Remove(digestFile)
+	out, err := t.copy(ctx, "docker-archive:"+archive, t.name+":"+ref, "--digestfile", digestFile)
+	if err != nil {
+		return r, err
+	}
+	for _, m := range reusedBlob.FindAllStringSubmatch(out, -1) {
+		r.reused = append(r.reused, m[1])
+	}
+	digest, err := ioutil.ReadFile(digestFile)
+	r.digest = strings.TrimSpace(string(digest))
+	return r, err
+}
+
+func init() {
+	RegisterTransport("docker-archive", archiveTransport{})
+	RegisterTransport("dir", dirTransport{})
+	for _, name := range []string{"docker", "containers-storage", "docker-daemon"} {
+		RegisterTransport(name, skopeoTransport{name})
+	}
+}
@@ -0,0 +1,61 @@
+package melt
+
+import "sync"
+
+// WithUmask sets the umask used while layers are extracted, so the
+// permissions of the files, and with them the diffIDs of melted layers, do
+// not depend on the umask of the caller. It defaults to 0. A negative mask
+// keeps the umask of the process. The umask is process wide, so it is only
+// set for the extraction of every layer, and files the melt creates in the
+// layers afterwards get explicit permissions. Other goroutines creating files
+// while a layer is extracted are still affected. Concurrent extractions share
+// the umask: one asking for another umask than the running ones waits until
+// they are done. It has no effect on Windows.
+func WithUmask(mask int) Option {
+	return func(o *options) {
+		o.umask = mask
+	}
+}
+
+// umasks tracks the extractions running with a umask set by withUmask. The umask of
+// the process is set by the first of them and restored by the last one.
+var umasks struct {
+	sync.Mutex
+	cond  *sync.Cond
+	users int
+	mask  int
+	saved int
+}
+
+func init() {
+	umasks.cond = sync.NewCond(&umasks.Mutex)
+}
+
+// withUmask runs fn with the configured umask and restores the previous one
+// after fn and all concurrent calls with the same umask are done.
+func (m *state) withUmask(fn func() error) error {
+	if m.opts.umask < 0 {
+		return fn()
+	}
+	umasks.Lock()
+	for umasks.users > 0 && umasks.mask != m.opts.umask {
+		umasks.cond.Wait()
+	}
+	if umasks.users == 0 {
+		umasks.saved = setUmask(m.opts.umask)
+		umasks.mask = m.opts.umask
+	}
+	umasks.users++
+	umasks.Unlock()
+
+	defer func() {
+		umasks.Lock()
+		umasks.users--
+		if umasks.users == 0 {
+			setUmask(umasks.saved)
+			umasks.cond.Broadcast()
+		}
+		umasks.Unlock()
+	}()
+	return fn()
+}
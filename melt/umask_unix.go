@@ -0,0 +1,12 @@
+//go:build !windows
+
+package melt
+
+import (
+	"syscall"
+)
+
+// setUmask sets the umask of the process and returns the previous one.
+func setUmask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,7 @@
+package melt
+
+// Windows has no umask.
+
+func setUmask(mask int) int {
+	return mask
+}
@@ -0,0 +1,82 @@
+package melt
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// walkTree walks the tree rooted at root like filepath.Walk: fn is called for
+// every file in lexical order, directories before their content, and
+// filepath.SkipDir and filepath.SkipAll have the same meaning. Unlike
+// filepath.Walk it keeps the paths still to visit on a stack instead of
+// recursing into every directory, so the depth of layer trees is only bounded
+// by the length of their paths. Files are looked up when they are visited, so
+// fn may move or remove the path it is called for.
+func walkTree(root string, fn filepath.WalkFunc) error {
+	stack := []string{root}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			err = fn(p, nil, err)
+		} else {
+			err = fn(p, info, nil)
+		}
+		switch {
+		case err == filepath.SkipAll:
+			return nil
+		case err == filepath.SkipDir && info != nil && !info.IsDir():
+			// Skip the remaining files of the directory of p.
+			// They are the topmost entries of the stack.
+			dir := filepath.Dir(p)
+			for len(stack) > 0 && filepath.Dir(stack[len(stack)-1]) == dir {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		case err == filepath.SkipDir:
+			continue
+		case err != nil:
+			return err
+		}
+		if info == nil || !info.IsDir() {
+			continue
+		}
+
+		names, err := readDirNames(p)
+		if err != nil {
+			err = fn(p, info, err)
+			if err == filepath.SkipDir {
+				continue
+			}
+			if err == filepath.SkipAll {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// Pushed in reverse, so they are visited in lexical order.
+		for i := len(names) - 1; i >= 0; i-- {
+			stack = append(stack, filepath.Join(p, names[i]))
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the sorted names of the entries of dir.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,200 @@
+package melt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Whiteouts mark files removed from the layers below. When a layer is melted
+// into a root that is not the bottom layer of its images, the files it
+// removes may still exist in the preserved layers below the root, so its
+// whiteouts have to end up in the root.
+
+const (
+	whiteoutPrefix = ".wh."
+	// whiteoutMeta prefixes AUFS metadata files, which are not whiteouts.
+	whiteoutMeta   = ".wh..wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// mkdirBeneath makes sure that rel is a directory in root. Symlinks and
+// other files on the way are replaced by directories, just like rsync
+// replaces them when copying the layer containing rel, so nothing outside of
+// root is ever touched.
+func mkdirBeneath(root string, rel string) error {
+	cur := root
+	for _, c := range strings.Split(filepath.ToSlash(rel), "/") {
+		if c == "" || c == "." {
+			continue
+		}
+		cur = filepath.Join(cur, c)
+		fi, err := os.Lstat(cur)
+		if err == nil && fi.IsDir() {
+			continue
+		}
+		if err == nil {
+			err = os.Remove(cur)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = os.Mkdir(cur, 0755)
+		if err != nil {
+			return err
+		}
+		// The umask only applies while layers are extracted.
+		err = os.Chmod(cur, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeWhiteout moves the whiteout p to rel in root.
+func placeWhiteout(p string, root string, rel string) error {
+	err := mkdirBeneath(root, filepath.Dir(rel))
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(root, rel)
+	err = os.RemoveAll(dst)
+	if err != nil {
+		return err
+	}
+	return os.Rename(p, dst)
+}
+
+// makeOpaque creates the directory rel below root with an opaque whiteout
+// hiding the content the layers below have at its path.
+func makeOpaque(root string, rel string) error {
+	err := mkdirBeneath(root, rel)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(root, rel, opaqueWhiteout), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(0644)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// applyWhiteouts applies the whiteouts of the unpacked layer from to the
+// unpacked layer into it is melted into before the content of from is copied.
+// Files that from removes are removed from into. With keep the whiteouts are
+// moved to into, for the layers below it. Whiteouts in into for files that
+// from adds again are removed; if the file is a directory, an opaque whiteout
+// keeps the old content of the directory hidden.
+func applyWhiteouts(from string, into string, keep bool) error {
+	// Opaque directories are emptied first so that nothing placed in
+	// them below is removed again.
+	err := walkTree(from, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Name() != opaqueWhiteout {
+			return err
+		}
+		rel, err := filepath.Rel(from, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		old, err := os.ReadDir(filepath.Join(into, rel))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range old {
+			err = removeBeneath(into, filepath.Join(rel, e.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return walkTree(from, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		dir, base := filepath.Split(rel)
+		switch {
+		case base == opaqueWhiteout:
+			if keep {
+				return placeWhiteout(p, into, rel)
+			}
+		case strings.HasPrefix(base, whiteoutMeta):
+			// AUFS metadata is dropped.
+		case strings.HasPrefix(base, whiteoutPrefix):
+			err = removeBeneath(into, filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return err
+			}
+			if keep {
+				return placeWhiteout(p, into, rel)
+			}
+		default:
+			wh := filepath.Join(dir, whiteoutPrefix+base)
+			_, err := os.Lstat(filepath.Join(into, wh))
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = removeBeneath(into, wh)
+			if err != nil || !info.IsDir() {
+				return err
+			}
+			return makeOpaque(into, rel)
+		}
+		return nil
+	})
+}
+
+// replaceTypeChanges removes the files of the unpacked layer into that the
+// unpacked layer from replaces by a file of a different type before the
+// content of from is copied. rsync refuses to replace a populated directory by
+// a file and would merge a directory into the directory a symlink points to.
+// Like in an overlay filesystem the new entry hides the old one completely.
+// With keep a directory replacing a file is made opaque, since the layers
+// below into may still hold a directory with content at its path that the
+// file used to hide.
+func replaceTypeChanges(from string, into string, keep bool) error {
+	return walkTree(from, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, p)
+		if err != nil || rel == "." || strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			return err
+		}
+		old, err := os.Lstat(filepath.Join(into, rel))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if old.IsDir() == info.IsDir() {
+			return nil
+		}
+		err = removeBeneath(into, rel)
+		if err != nil || !keep || !info.IsDir() {
+			return err
+		}
+		return makeOpaque(into, rel)
+	})
+}
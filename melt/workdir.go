@@ -0,0 +1,194 @@
+package melt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Every melt works in a directory of its own with a fixed layout, so tools can
+// inspect or post-process what it is doing:
+//
+//	state.json   the WorkState of the melt, rewritten whenever a phase starts
+//	owner.lock   locked by the process running the melt for as long as it runs
+//	image/       the unpacked input archive; every layer that is melted or
+//	             melted into is unpacked next to its tarball, e.g. the files
+//	             of abc/layer.tar in abc/layer and those of
+//	             blobs/sha256/abc in blobs/sha256/abc.dir
+//	base/        the base image of WithBase while it is read
+//	previous/    the previous output of WithPrevious while it is read
+//	archive.tar  the uncompressed output while it is compressed
+//	stream.tar   the input of MeltStream while it is extracted
+//	smoke/       the root filesystem of an image while WithTestCommand runs
+//
+// Melted layers are packed in place and their directories removed afterwards.
+const (
+	stateFile   = "state.json"
+	ownerFile   = "owner.lock"
+	imageDir    = "image"
+	baseDir     = "base"
+	previousDir = "previous"
+	archiveFile = "archive.tar"
+	streamFile  = "stream.tar"
+)
+
+// workDirPrefix starts the names of the temporary work directories.
+const workDirPrefix = "go-docker-melt_"
+
+// WithWorkDir melts in dir instead of a new temporary directory below the one
+// set by WithTmpDir. dir is created if it does not exist and has to be empty
+// otherwise. It is kept after the melt so its content can be inspected.
+func WithWorkDir(dir string) Option {
+	return func(o *options) {
+		o.workDir = dir
+	}
+}
+
+// WorkState describes a melt in the state file of its work directory.
+type WorkState struct {
+	// Phase is the phase the melt is in.
+	Phase Phase `json:"phase"`
+	// Done is set once the melt is over. Error holds why it failed.
+	Done   bool   `json:"done,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Input  string `json:"input,omitempty"`
+	Output string `json:"output,omitempty"`
+	// Images is filled in once the layers are planned.
+	Images []WorkImage `json:"images,omitempty"`
+}
+
+// WorkImage is an image of a melt.
+type WorkImage struct {
+	Name string `json:"name"`
+	// Config is the path of the original configuration relative to
+	// image/.
+	Config string      `json:"config"`
+	Layers []WorkLayer `json:"layers"`
+}
+
+// WorkLayer is a layer of an image before melting.
+type WorkLayer struct {
+	// Tarball is the path of the layer relative to image/.
+	Tarball string `json:"tarball"`
+	// Dir is the path the layer is unpacked in relative to image/. It is
+	// empty for layers that are left untouched.
+	Dir string `json:"dir,omitempty"`
+	// Root is the tarball of the layer it is melted into, if it is not a
+	// root itself.
+	Root   string `json:"root,omitempty"`
+	DiffID string `json:"diff_id"`
+	// MeltedDiffID is set for root layers once they are packed.
+	MeltedDiffID string `json:"melted_diff_id,omitempty"`
+}
+
+// LoadWorkState reads the state file of the work directory dir.
+func LoadWorkState(dir string) (*WorkState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		return nil, err
+	}
+	var ws WorkState
+	err = json.Unmarshal(data, &ws)
+	if err != nil {
+		return nil, fmt.Errorf("Corrupt state file in %s: %v", dir, err)
+	}
+	return &ws, nil
+}
+
+// makeWorkDir returns the work directory for a melt. It reports whether it
+// has to be kept.
+func makeWorkDir(opts *options) (string, bool, error) {
+	if opts.workDir == "" {
+		dir, err := ioutil.TempDir(opts.tmpDir, workDirPrefix)
+		return dir, false, err
+	}
+	err := os.MkdirAll(opts.workDir, 0700)
+	if err != nil {
+		return "", false, err
+	}
+	err = IsEmptyDir(opts.workDir)
+	if err == nil {
+		return "", false, fmt.Errorf("Work directory %s is not empty.", opts.workDir)
+	}
+	if err != io.EOF {
+		return "", false, err
+	}
+	return opts.workDir, true, nil
+}
+
+// lockWorkDir locks the owner file of the work directory dir so that
+// CollectWorkDirs leaves it alone. Closing the returned file unlocks it.
+func lockWorkDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, ownerFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := tryLock(f)
+	if err != nil || !ok {
+		f.Close()
+		if err == nil {
+			err = fmt.Errorf("Work directory %s is in use.", dir)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// planImages records the images and the plan in the work state.
+func (m *state) planImages() {
+	m.work.Images = make([]WorkImage, 0, len(m.manifest.Manifest))
+	for _, mf := range m.manifest.Manifest {
+		img := WorkImage{Name: mf.Name(), Config: mf.ConfigHash}
+		for _, l := range mf.layers {
+			wl := WorkLayer{Tarball: l, DiffID: m.origDiffID[l]}
+			if !m.untouched[l] {
+				wl.Dir = unpackDir(l)
+			}
+			if r := m.plan.root(l); r != l {
+				wl.Root = r
+			}
+			img.Layers = append(img.Layers, wl)
+		}
+		m.work.Images = append(m.work.Images, img)
+	}
+}
+
+// writeState writes the work state to the state file. Failing to do so only
+// makes the melt harder to inspect, so it is reported as a warning.
+func (m *state) writeState() {
+	if m.diffID != nil {
+		m.diffIDMutex.Lock()
+		for i := range m.work.Images {
+			for j := range m.work.Images[i].Layers {
+				wl := &m.work.Images[i].Layers[j]
+				if wl.Root == "" && !m.untouched[wl.Tarball] {
+					wl.MeltedDiffID = m.diffID[wl.Tarball]
+				}
+			}
+		}
+		m.diffIDMutex.Unlock()
+	}
+	data, err := json.MarshalIndent(m.work, "", "\t")
+	if err == nil {
+		tmp := filepath.Join(m.workDir, stateFile+".tmp")
+		err = ioutil.WriteFile(tmp, append(data, '\n'), 0644)
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(m.workDir, stateFile))
+		}
+	}
+	if err != nil {
+		m.warn(fmt.Sprintf("Cannot write the state file: %v", err))
+	}
+}
+
+// finishState records the outcome of the melt in the state file.
+func (m *state) finishState(err error) {
+	m.work.Done = true
+	if err != nil {
+		m.work.Error = err.Error()
+	}
+	m.writeState()
+}
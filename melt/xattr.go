@@ -0,0 +1,78 @@
+package melt
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+func xattrError(op string, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// WithStripXattrs removes extended attributes from all files in melted layers.
+// A pattern ending in * matches all attributes starting with the rest of the
+// pattern, a pattern ending in a dot matches a whole namespace like user. and
+// any other pattern matches the attribute of that name.
+func WithStripXattrs(patterns ...string) Option {
+	return func(o *options) {
+		o.stripXattrs = append(o.stripXattrs, patterns...)
+	}
+}
+
+func matchXattr(name string, patterns []string) bool {
+	for _, p := range patterns {
+		switch {
+		case strings.HasSuffix(p, "*"):
+			if strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		case strings.HasSuffix(p, "."):
+			if strings.HasPrefix(name, p) {
+				return true
+			}
+		case name == p:
+			return true
+		}
+	}
+	return false
+}
+
+// stripXattrs removes the attributes selected by WithStripXattrs from dir and
+// everything below it.
+func (m *state) stripXattrs(dir string) error {
+	return walkTree(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		names, err := llistxattr(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !matchXattr(name, m.opts.stripXattrs) {
+				continue
+			}
+			err = lremovexattr(path, name)
+			if err != nil {
+				return err
+			}
+			m.strippedMutex.Lock()
+			m.stripped[name]++
+			m.strippedMutex.Unlock()
+		}
+		return nil
+	})
+}
+
+// reportStripped logs how many files each stripped attribute was removed from.
+func (m *state) reportStripped() {
+	names := make([]string, 0, len(m.stripped))
+	for name := range m.stripped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.opts.logger.Info("stripped xattr", "name", name, "files", m.stripped[name])
+	}
+}
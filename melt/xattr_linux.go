@@ -0,0 +1,73 @@
+package melt
+
+import (
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+// xattrSupported reports whether extended attributes can be read and written
+// on this system.
+const xattrSupported = true
+
+// The functions below operate on the link itself like their l* counterparts in
+// C and wrap errors with the path they occurred on.
+
+// llistxattr returns the names of all extended attributes of path. A file
+// system without xattr support has none.
+func llistxattr(path string) ([]string, error) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := unix.Llistxattr(path, buf)
+		switch err {
+		case nil:
+		case unix.ERANGE:
+			buf = make([]byte, 2*len(buf))
+			continue
+		case unix.ENOTSUP:
+			return nil, nil
+		default:
+			return nil, xattrError("llistxattr", path, err)
+		}
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+// lgetxattr returns the value of the extended attribute name of path.
+func lgetxattr(path string, name string) ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Lgetxattr(path, name, buf)
+		switch err {
+		case nil:
+			return buf[:n], nil
+		case unix.ERANGE:
+			buf = make([]byte, 2*len(buf))
+		default:
+			return nil, xattrError("lgetxattr", path, err)
+		}
+	}
+}
+
+// lsetxattr sets the extended attribute name of path to value.
+func lsetxattr(path string, name string, value []byte) error {
+	err := unix.Lsetxattr(path, name, value, 0)
+	if err != nil {
+		return xattrError("lsetxattr", path, err)
+	}
+	return nil
+}
+
+// lremovexattr removes the extended attribute name of path.
+func lremovexattr(path string, name string) error {
+	err := unix.Lremovexattr(path, name)
+	if err != nil {
+		return xattrError("lremovexattr", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package melt
+
+import (
+	"syscall"
+)
+
+// Extended attributes are only supported on Linux. Elsewhere files have none
+// and setting them fails with ENOTSUP, so they are lost with a warning where
+// that is handled.
+
+const xattrSupported = false
+
+func llistxattr(path string) ([]string, error) {
+	return nil, nil
+}
+
+func lgetxattr(path string, name string) ([]byte, error) {
+	return nil, xattrError("lgetxattr", path, syscall.ENOTSUP)
+}
+
+func lsetxattr(path string, name string, value []byte) error {
+	return xattrError("lsetxattr", path, syscall.ENOTSUP)
+}
+
+func lremovexattr(path string, name string) error {
+	return xattrError("lremovexattr", path, syscall.ENOTSUP)
+}
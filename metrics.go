@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the phase duration
+// histogram buckets.
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, b := range durationBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics holds the service metrics. They are exported on /metrics in the
+// Prometheus text exposition format.
+type metrics struct {
+	mu            sync.Mutex
+	started       uint64
+	succeeded     uint64
+	failed        uint64
+	bytes         int64
+	queueDepth    int
+	phaseDuration map[melt.Phase]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{phaseDuration: make(map[melt.Phase]*histogram)}
+}
+
+func (m *metrics) observePhase(p melt.Phase, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.phaseDuration[p]
+	if !ok {
+		h = &histogram{}
+		m.phaseDuration[p] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// tracker returns an event callback for a single melt that feeds the metrics
+// and a function to call once the melt has finished.
+func (m *metrics) tracker() (func(melt.Event), func(err error)) {
+	var phase melt.Phase
+	var start time.Time
+
+	m.mu.Lock()
+	m.started++
+	m.mu.Unlock()
+
+	events := func(e melt.Event) {
+		switch e.Type {
+		case melt.PhaseStarted:
+			if phase != "" {
+				m.observePhase(phase, time.Since(start))
+			}
+			phase, start = e.Phase, time.Now()
+		case melt.LayerExtracted:
+			m.mu.Lock()
+			m.bytes += e.Bytes
+			m.mu.Unlock()
+		}
+	}
+	done := func(err error) {
+		if phase != "" {
+			m.observePhase(phase, time.Since(start))
+		}
+		m.mu.Lock()
+		if err != nil {
+			m.failed++
+		} else {
+			m.succeeded++
+		}
+		m.mu.Unlock()
+	}
+	return events, done
+}
+
+func (m *metrics) setQueueDepth(n int) {
+	m.mu.Lock()
+	m.queueDepth = n
+	m.mu.Unlock()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeTo writes all metrics in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counter := func(name string, help string, v uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("go_docker_melt_melts_started_total", "Number of melts started.", m.started)
+	counter("go_docker_melt_melts_succeeded_total", "Number of melts that succeeded.", m.succeeded)
+	counter("go_docker_melt_melts_failed_total", "Number of melts that failed.", m.failed)
+	counter("go_docker_melt_processed_bytes_total", "Size of all layers processed.", uint64(m.bytes))
+
+	fmt.Fprintf(w, "# HELP go_docker_melt_queue_depth Number of melts waiting to be run.\n")
+	fmt.Fprintf(w, "# TYPE go_docker_melt_queue_depth gauge\n")
+	fmt.Fprintf(w, "go_docker_melt_queue_depth %d\n", m.queueDepth)
+
+	name := "go_docker_melt_phase_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time spent in each phase of a melt.\n# TYPE %s histogram\n", name, name)
+	var phases []string
+	for p := range m.phaseDuration {
+		phases = append(phases, string(p))
+	}
+	sort.Strings(phases)
+	for _, p := range phases {
+		h := m.phaseDuration[melt.Phase(p)]
+		for i, b := range durationBuckets {
+			fmt.Fprintf(w, "%s_bucket{phase=%q,le=%q} %d\n", name, p, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{phase=%q,le=\"+Inf\"} %d\n", name, p, h.count)
+		fmt.Fprintf(w, "%s_sum{phase=%q} %s\n", name, p, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{phase=%q} %d\n", name, p, h.count)
+	}
+}
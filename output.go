@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Human output adapts to where it goes. On a terminal a status line shows the
+// progress of the melt in place and warnings and errors are colored. In CI
+// logs, or whenever stderr is not a terminal, every phase is reported on a
+// line of its own and nothing is ever rewritten. -plain forces the line
+// output and -no-color, like the NO_COLOR environment variable, turns colors
+// off.
+
+// ciVariables are environment variables set by common CI systems.
+var ciVariables = []string{"CI", "GITHUB_ACTIONS", "GITLAB_CI", "BUILDKITE", "JENKINS_URL", "TEAMCITY_VERSION", "TF_BUILD"}
+
+const (
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorGreen  = "\x1b[32m"
+	colorFaint  = "\x1b[2m"
+	colorReset  = "\x1b[0m"
+	clearLine   = "\r\x1b[K"
+)
+
+// phaseNames describes the phases of a melt for humans.
+var phaseNames = map[melt.Phase]string{
+	melt.PhaseExtract: "Extracting archive",
+	melt.PhaseUnpack:  "Unpacking layers",
+	melt.PhaseMerge:   "Melting layers",
+	melt.PhaseHash:    "Packing layers",
+	melt.PhaseWrite:   "Writing image",
+}
+
+var spinner = []string{"|", "/", "-", "\\"}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// inCI reports whether go-docker-melt runs in a CI job. CI systems often
+// attach a pseudo terminal but keep the output as a log, where rewritten
+// lines turn into noise.
+func inCI() bool {
+	for _, v := range ciVariables {
+		if s := os.Getenv(v); s != "" && s != "false" && s != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// terminal writes the human output of a melt to a terminal or a log.
+type terminal struct {
+	mu sync.Mutex
+	w  io.Writer
+	// interactive redraws a status line in place instead of printing one
+	// line per phase.
+	interactive bool
+	color       bool
+	// status is the status line currently shown.
+	status   string
+	phase    melt.Phase
+	layers   int
+	bytes    int64
+	hashed   int
+	warnings int
+	ticks    int
+	start    time.Time
+	// pushed is set once an image was pushed. uploaded and reused count
+	// the bytes of its layers that were transferred and that the
+	// destination had already.
+	pushed   bool
+	uploaded int64
+	reused   int64
+}
+
+// newTerminal returns the terminal writing to f. plain and noColor are the
+// values of -plain and -no-color.
+func newTerminal(f *os.File, plain bool, noColor bool) *terminal {
+	tty := isTerminal(f) && os.Getenv("TERM") != "dumb"
+	return &terminal{
+		w:           f,
+		interactive: tty && !plain && !inCI(),
+		color:       tty && !noColor && os.Getenv("NO_COLOR") == "",
+		start:       time.Now(),
+	}
+}
+
+// paint wraps s in the escape sequences of color if colors are enabled.
+func (t *terminal) paint(color string, s string) string {
+	if !t.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// Write prints p above the status line. The log package writes through it so
+// log lines do not get mixed into the status line.
+func (t *terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clear()
+	n, err := t.w.Write(p)
+	t.draw()
+	return n, err
+}
+
+func (t *terminal) println(s string) {
+	t.Write([]byte(s + "\n"))
+}
+
+// clear removes the status line. t.mu has to be held.
+func (t *terminal) clear() {
+	if t.status != "" {
+		io.WriteString(t.w, clearLine)
+	}
+}
+
+// draw shows the status line again. t.mu has to be held.
+func (t *terminal) draw() {
+	if t.status != "" {
+		io.WriteString(t.w, t.status)
+	}
+}
+
+// setStatus replaces the status line. t.mu has to be held.
+func (t *terminal) setStatus(s string) {
+	t.clear()
+	t.status = s
+	t.draw()
+}
+
+// event follows the progress of a melt.
+func (t *terminal) event(e melt.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch e.Type {
+	case melt.PhaseStarted:
+		t.phase = e.Phase
+		t.layers, t.bytes = 0, 0
+		if !t.interactive {
+			t.clear()
+			fmt.Fprintf(t.w, "%s...\n", phaseNames[e.Phase])
+			t.draw()
+		}
+	case melt.LayerExtracted, melt.LayerMerged, melt.LayerHashed:
+		t.layers++
+		t.bytes += e.Bytes
+		if e.Type == melt.LayerHashed {
+			t.hashed++
+		}
+	case melt.Warning:
+		t.warnings++
+	case melt.LayerPushed:
+		t.pushed = true
+		if e.Message == "reused" {
+			t.reused += e.Bytes
+		} else {
+			t.uploaded += e.Bytes
+		}
+	}
+	if !t.interactive {
+		return
+	}
+	t.ticks++
+	status := fmt.Sprintf("%s %s", t.paint(colorFaint, spinner[t.ticks%len(spinner)]), phaseNames[t.phase])
+	if t.layers > 0 {
+		status += fmt.Sprintf(" %s", t.paint(colorFaint, fmt.Sprintf("(%s, %s)", plural(t.layers, "layer"), formatBytes(t.bytes))))
+	}
+	t.setStatus(status)
+}
+
+// finish removes the status line and sums up a melt that returned err. Errors
+// are left to the caller.
+func (t *terminal) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setStatus("")
+	if err != nil {
+		return
+	}
+	summary := fmt.Sprintf("Melted into %s in %s", plural(t.hashed, "layer"), time.Since(t.start).Round(100*time.Millisecond))
+	if t.pushed {
+		summary += fmt.Sprintf(", uploaded %s and reused %s", formatBytes(t.uploaded), formatBytes(t.reused))
+	}
+	if t.warnings > 0 {
+		summary += ", " + t.paint(colorYellow, plural(t.warnings, "warning"))
+	}
+	fmt.Fprintln(t.w, t.paint(colorGreen, "✓")+" "+summary+".")
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// formatBytes formats n in binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// handler returns a slog handler printing records of at least level as
+// colored lines above the status line.
+func (t *terminal) handler(level slog.Level) slog.Handler {
+	return &terminalHandler{t: t, level: level}
+}
+
+type terminalHandler struct {
+	t     *terminal
+	level slog.Level
+	attrs []slog.Attr
+}
+
+func (h *terminalHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *terminalHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	label := strings.ToLower(r.Level.String()) + ":"
+	switch {
+	case r.Level >= slog.LevelError:
+		label = h.t.paint(colorRed, label)
+	case r.Level >= slog.LevelWarn:
+		label = h.t.paint(colorYellow, label)
+	default:
+		label = h.t.paint(colorFaint, label)
+	}
+	b.WriteString(label + " " + r.Message)
+	attr := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s", h.t.paint(colorFaint, a.Key+"="+a.Value.String()))
+		return true
+	}
+	for _, a := range h.attrs {
+		attr(a)
+	}
+	r.Attrs(attr)
+	h.t.println(b.String())
+	return nil
+}
+
+func (h *terminalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &terminalHandler{t: h.t, level: h.level, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+// WithGroup ignores groups, the melt package does not use them.
+func (h *terminalHandler) WithGroup(name string) slog.Handler {
+	return h
+}
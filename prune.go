@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"os"
+)
+
+// The prune subcommand removes layers, configurations and blobs no image of
+// an archive references, which multi-image saves often carry around, without
+// melting anything.
+
+var pruneCmd = &command{
+	name:    "prune",
+	summary: "Remove unreferenced layers from an archive without melting it.",
+	usage:   "prune -o output [-t tmpdir] [-v] input",
+	flags:   flag.NewFlagSet("prune", flag.ExitOnError),
+}
+
+var pruneOut string
+var pruneTmpDir string
+var pruneVerbose bool
+
+func init() {
+	pruneCmd.flags.StringVar(&pruneOut, "o", "", "Output reference, like -o of a melt.")
+	pruneCmd.flags.StringVar(&pruneTmpDir, "t", "", "Directory to hold temporary data, like -t of a melt.")
+	pruneCmd.flags.BoolVar(&pruneVerbose, "v", false, "List the removed files.")
+	pruneCmd.run = runPrune
+	commands = append(commands, pruneCmd)
+}
+
+func runPrune(args []string) error {
+	if len(args) != 1 || pruneOut == "" {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], pruneCmd.usage)
+	}
+	res, err := melt.New(melt.WithTmpDir(pruneTmpDir)).Prune(context.Background(), args[0], pruneOut)
+	if err != nil {
+		return err
+	}
+	if pruneVerbose {
+		for _, f := range res.Files {
+			fmt.Println(f)
+		}
+	}
+	fmt.Printf("Removed %s, %s.\n", plural(len(res.Files), "file"), formatBytes(res.Bytes))
+	return nil
+}
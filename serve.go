@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The serve subcommand runs go-docker-melt as an HTTP service. Melts are
+// submitted as jobs by POSTing the paths of the input and output tarballs on
+// the server's filesystem to /jobs. Jobs are run in submission order. At most
+// -max-jobs of them run at the same time and, if -disk-budget is set, only as
+// long as their estimated disk usage fits into the budget. The status and
+// logs of a job are available at /jobs/<id> and a job is cancelled by
+// DELETEing it. POSTing to /melt submits a job and waits for it to finish.
+// When a job has finished its status is POSTed to the callback URL given with
+// the job and to the one given with -callback. Metrics are exported on
+// /metrics. Work directories left behind by crashed instances are removed at
+// startup and every -gc-interval once they are older than -gc-retention.
+// Finished, failed and cancelled jobs are forgotten on the same interval once
+// they ended more than -job-retention ago.
+//
+// Requests are not authenticated and name arbitrary files on the server, so
+// it listens on localhost unless told otherwise.
+
+var serveCmd = &command{
+	name:    "serve",
+	summary: "Run go-docker-melt as an HTTP service.",
+	usage:   "serve [-listen address] [-t tmpdir] [-max-jobs n] [-disk-budget bytes] [-callback url] [-j n] [-gc-interval duration] [-gc-retention duration] [-job-retention duration]",
+	flags:   flag.NewFlagSet("serve", flag.ExitOnError),
+}
+
+var serveListen string
+var serveTmpDir string
+var serveMaxJobs int
+var serveDiskBudget int64
+var serveWorkers int
+var serveCallback string
+var serveGCInterval time.Duration
+var serveGCRetention time.Duration
+var serveJobRetention time.Duration
+
+func init() {
+	serveCmd.flags.StringVar(&serveListen, "listen", "localhost:8080", "Address to listen on. Clients can read and write every file the server can, so only listen on other interfaces if all clients are trusted.")
+	serveCmd.flags.StringVar(&serveTmpDir, "t", "", "Directory to hold temporary data.")
+	serveCmd.flags.IntVar(&serveMaxJobs, "max-jobs", 1, "Number of melts to run concurrently.")
+	serveCmd.flags.Int64Var(&serveDiskBudget, "disk-budget", 0, "Bytes of temporary disk space running melts may use (0 means unlimited).")
+	serveCmd.flags.StringVar(&serveCallback, "callback", "", "URL to POST the status of every finished job to.")
+	serveCmd.flags.IntVar(&serveWorkers, "j", runtime.NumCPU(), "Number of layers to unpack and pack concurrently per melt.")
+	serveCmd.flags.DurationVar(&serveGCInterval, "gc-interval", time.Hour, "Interval to remove abandoned work directories in (0 only removes them at startup).")
+	serveCmd.flags.DurationVar(&serveGCRetention, "gc-retention", 6*time.Hour, "Time an abandoned work directory is kept before it is removed.")
+	serveCmd.flags.DurationVar(&serveJobRetention, "job-retention", 24*time.Hour, "Time the status of an ended job is kept before it is removed every -gc-interval.")
+	serveCmd.run = runServe
+	commands = append(commands, serveCmd)
+}
+
+// diskFactor is used to estimate the disk usage of a melt from the size of
+// its input: the extracted archive, the unpacked layers and the new layer
+// tarballs all live in the work directory at some point.
+const diskFactor = 3
+
+// maxJobLogs is the number of log lines kept per job.
+const maxJobLogs = 1000
+
+// maxRequestSize is the largest melt request body accepted.
+const maxRequestSize = 1 << 20
+
+// callbackAttempts is the number of times a callback is tried before giving
+// up. The delay between attempts doubles starting at callbackDelay.
+const callbackAttempts = 5
+const callbackDelay = time.Second
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+type meltRequest struct {
+	Input    string `json:"input"`
+	Output   string `json:"output"`
+	Callback string `json:"callback,omitempty"`
+}
+
+type job struct {
+	mu       sync.Mutex
+	ID       string     `json:"id"`
+	Input    string     `json:"input"`
+	Output   string     `json:"output"`
+	Callback string     `json:"callback,omitempty"`
+	State    string     `json:"state"`
+	Phase    melt.Phase `json:"phase,omitempty"`
+	Layers   int        `json:"layers_done"`
+	Message  string     `json:"message,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Logs     []string   `json:"logs,omitempty"`
+
+	disk   int64
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (j *job) log(line string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.Logs) >= maxJobLogs {
+		j.Logs = j.Logs[1:]
+	}
+	j.Logs = append(j.Logs, line)
+}
+
+func (j *job) event(e melt.Event) {
+	j.mu.Lock()
+	switch e.Type {
+	case melt.PhaseStarted:
+		j.Phase = e.Phase
+	case melt.LayerHashed:
+		j.Layers++
+	}
+	j.mu.Unlock()
+	if e.Type != melt.Warning {
+		j.log(fmt.Sprintf("%s %s %s %s", time.Now().UTC().Format(time.RFC3339), e.Type, e.Phase, e.Layer))
+	}
+}
+
+// post sends the status of the job to target. Failed attempts are retried with
+// an increasing delay.
+func (j *job) post(target string) {
+	j.mu.Lock()
+	body, err := json.Marshal(j)
+	j.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to encode job %s: %s", j.ID, err)
+		return
+	}
+
+	delay := callbackDelay
+	for i := 1; ; i++ {
+		resp, err := http.Post(target, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		if i == callbackAttempts {
+			log.Printf("Failed to notify %s about job %s: %s", target, j.ID, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// notify sends the status of a finished job to its callbacks.
+func (j *job) notify() {
+	if j.Callback != "" {
+		j.post(j.Callback)
+	}
+	if serveCallback != "" && serveCallback != j.Callback {
+		j.post(serveCallback)
+	}
+}
+
+// jobLog is a slog.Handler recording the log messages of a job.
+type jobLog struct {
+	j     *job
+	attrs []slog.Attr
+}
+
+func (h *jobLog) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *jobLog) Handle(ctx context.Context, r slog.Record) error {
+	line := r.Time.UTC().Format(time.RFC3339) + " " + r.Level.String() + " " + r.Message
+	for _, a := range h.attrs {
+		line += " " + a.String()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		line += " " + a.String()
+		return true
+	})
+	h.j.log(line)
+	return nil
+}
+
+func (h *jobLog) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &jobLog{j: h.j, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *jobLog) WithGroup(name string) slog.Handler {
+	return h
+}
+
+type server struct {
+	metrics *metrics
+
+	mu       sync.Mutex
+	jobs     map[string]*job
+	queue    []*job
+	running  int
+	diskUsed int64
+}
+
+func newJobID() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *server) submit(req meltRequest) (*job, error) {
+	// The size of images from other transports is only known once they
+	// were fetched.
+	var disk int64
+	name, path := melt.ParseReference(req.Input)
+	if name == "docker-archive" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		disk = fi.Size() * diskFactor
+		// Uploads to object storage are packed into the work directory
+		// first.
+		if out, _ := melt.ParseReference(req.Output); out == "s3" || out == "gs" {
+			disk += fi.Size()
+		}
+	}
+	if serveDiskBudget > 0 && disk > serveDiskBudget {
+		return nil, fmt.Errorf("Melting %s needs about %d bytes which exceeds the disk budget.", req.Input, disk)
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		ID:       id,
+		Input:    req.Input,
+		Output:   req.Output,
+		Callback: req.Callback,
+		State:    jobQueued,
+		Created:  time.Now().UTC(),
+		disk:     disk,
+		done:     make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.jobs[id] = j
+	s.queue = append(s.queue, j)
+	s.mu.Unlock()
+	s.schedule()
+	return j, nil
+}
+
+// schedule starts queued jobs in order as long as there are free slots and
+// disk budget left.
+func (s *server) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) > 0 && s.running < serveMaxJobs {
+		j := s.queue[0]
+		if serveDiskBudget > 0 && s.diskUsed+j.disk > serveDiskBudget {
+			break
+		}
+		s.queue = s.queue[1:]
+		s.running++
+		s.diskUsed += j.disk
+
+		ctx, cancel := context.WithCancel(context.Background())
+		j.mu.Lock()
+		j.State = jobRunning
+		now := time.Now().UTC()
+		j.Started = &now
+		j.cancel = cancel
+		j.mu.Unlock()
+		go s.run(ctx, j)
+	}
+	s.metrics.setQueueDepth(len(s.queue))
+}
+
+func (s *server) run(ctx context.Context, j *job) {
+	events, done := s.metrics.tracker()
+	m := melt.New(
+		melt.WithTmpDir(serveTmpDir),
+		melt.WithWorkers(serveWorkers),
+		melt.WithLogger(&jobLog{j: j}),
+		melt.WithEvents(func(e melt.Event) {
+			events(e)
+			j.event(e)
+		}),
+	)
+	err := m.MeltContext(ctx, j.Input, j.Output)
+	if err == melt.ErrSingleLayer || err == melt.ErrAllShared {
+		j.log(err.Error())
+		j.mu.Lock()
+		j.Message = err.Error()
+		j.mu.Unlock()
+		err = nil
+	}
+	done(err)
+
+	now := time.Now().UTC()
+	j.mu.Lock()
+	j.Finished = &now
+	switch {
+	case ctx.Err() != nil:
+		j.State = jobCancelled
+	case err != nil:
+		j.State = jobFailed
+		j.Error = err.Error()
+	default:
+		j.State = jobSucceeded
+	}
+	j.mu.Unlock()
+	close(j.done)
+	go j.notify()
+
+	s.mu.Lock()
+	s.running--
+	s.diskUsed -= j.disk
+	s.mu.Unlock()
+	s.schedule()
+}
+
+// cancel cancels a queued or running job.
+func (s *server) cancel(j *job) {
+	s.mu.Lock()
+	for i, q := range s.queue {
+		if q == j {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			now := time.Now().UTC()
+			j.mu.Lock()
+			j.State = jobCancelled
+			j.Finished = &now
+			j.mu.Unlock()
+			close(j.done)
+			go j.notify()
+			break
+		}
+	}
+	s.metrics.setQueueDepth(len(s.queue))
+	s.mu.Unlock()
+
+	j.mu.Lock()
+	if j.cancel != nil {
+		j.cancel()
+	}
+	j.mu.Unlock()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJob(w http.ResponseWriter, code int, j *job) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	writeJSON(w, code, j)
+}
+
+func decodeRequest(r *http.Request) (meltRequest, error) {
+	var req meltRequest
+	err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestSize)).Decode(&req)
+	if err != nil {
+		return req, err
+	}
+	if req.Input == "" || req.Output == "" {
+		return req, fmt.Errorf("input and output are required")
+	}
+	if req.Callback != "" {
+		u, err := url.Parse(req.Callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return req, fmt.Errorf("callback must be an http or https URL")
+		}
+	}
+	return req, nil
+}
+
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.mu.Lock()
+			ids := make([]string, 0, len(s.jobs))
+			for id := range s.jobs {
+				ids = append(ids, id)
+			}
+			s.mu.Unlock()
+			writeJSON(w, http.StatusOK, ids)
+		case http.MethodPost:
+			req, err := decodeRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			j, err := s.submit(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJob(w, http.StatusAccepted, j)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJob(w, http.StatusOK, j)
+	case http.MethodDelete:
+		s.cancel(j)
+		writeJob(w, http.StatusAccepted, j)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleMelt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := s.submit(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case <-j.done:
+	case <-r.Context().Done():
+		s.cancel(j)
+		<-j.done
+	}
+
+	code := http.StatusOK
+	if j.State != jobSucceeded {
+		code = http.StatusInternalServerError
+	}
+	writeJob(w, code, j)
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.writeTo(w)
+}
+
+// collectWorkDirs removes the work directories of melts that are no longer
+// running from the temporary directory.
+func collectWorkDirs() {
+	dir := serveTmpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	removed, err := melt.CollectWorkDirs(dir, serveGCRetention)
+	for _, d := range removed {
+		log.Printf("Removed abandoned work directory %s", d)
+	}
+	if err != nil {
+		log.Printf("Failed to remove abandoned work directories: %s", err)
+	}
+}
+
+// collectJobs forgets the jobs that ended more than -job-retention ago.
+func (s *server) collectJobs() {
+	cutoff := time.Now().Add(-serveJobRetention)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		j.mu.Lock()
+		expired := j.Finished != nil && j.Finished.Before(cutoff)
+		j.mu.Unlock()
+		if expired {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func runServe(args []string) error {
+	if serveMaxJobs < 1 {
+		serveMaxJobs = 1
+	}
+	if serveGCInterval < 0 || serveGCRetention < 0 || serveJobRetention < 0 {
+		return fmt.Errorf("-gc-interval, -gc-retention and -job-retention must not be negative.")
+	}
+	s := &server{
+		metrics: newMetrics(),
+		jobs:    make(map[string]*job),
+	}
+	collectWorkDirs()
+	if serveGCInterval > 0 {
+		go func() {
+			for range time.Tick(serveGCInterval) {
+				collectWorkDirs()
+				s.collectJobs()
+			}
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJobs)
+	mux.HandleFunc("/melt", s.handleMelt)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+
+	log.Printf("Listening on %s", serveListen)
+	return http.ListenAndServe(serveListen, mux)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"text/tabwriter"
+)
+
+// printSizes writes the size report of a melt as a table with one row per
+// image followed by the total savings.
+func printSizes(w io.Writer, r melt.SizeReport) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tLAYERS\tSIZE\tCOMPRESSED\tMELTED LAYERS\tMELTED SIZE\tMELTED COMPRESSED")
+	for _, img := range r.Images {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", img.Name, img.Layers, img.Size, img.Compressed, img.MeltedLayers, img.MeltedSize, img.MeltedCompressed)
+	}
+	tw.Flush()
+	saved, savedCompressed := r.Saved()
+	fmt.Fprintf(w, "%d bytes saved in total, %d bytes compressed.\n", saved, savedCompressed)
+}
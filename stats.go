@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// The stats subcommand estimates how much melting would save for every image
+// of an archive. It only reads the headers of the layers, so it is cheap
+// enough to run over many images to pick the ones worth melting. Given images
+// in the target registry with -remote, it also estimates the bytes pushing
+// the images and their melted versions there would transfer.
+
+var statsCmd = &command{
+	name:    "stats",
+	summary: "Estimate the savings of melting without melting.",
+	usage:   "stats [-remote image]... archive",
+	flags:   flag.NewFlagSet("stats", flag.ExitOnError),
+}
+
+var statsRemote listFlag
+
+func init() {
+	statsCmd.flags.Var(&statsRemote, "remote", "Image in the registry to push to, like docker://registry.example.com/app:1, whose layers count as present. Can be given multiple times.")
+	statsCmd.run = runStats
+	commands = append(commands, statsCmd)
+}
+
+func printStats(w io.Writer, stats []melt.ImageStats, transfer bool) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if transfer {
+		fmt.Fprintln(tw, "IMAGE\tLAYERS\tSIZE\tESTIMATED\tSAVED\tPUSH\tMELTED PUSH")
+	} else {
+		fmt.Fprintln(tw, "IMAGE\tLAYERS\tSIZE\tESTIMATED\tSAVED")
+	}
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d", s.Name, s.Layers, s.Size, s.Estimated, s.Saved())
+		if transfer {
+			fmt.Fprintf(tw, "\t%d\t%d", s.Transfer, s.MeltedTransfer)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
+
+func runStats(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], statsCmd.usage)
+	}
+
+	var existing []string
+	if len(statsRemote) > 0 {
+		existing = []string{}
+		for _, ref := range statsRemote {
+			diffIDs, err := melt.RemoteLayers(context.Background(), ref)
+			if err != nil {
+				return err
+			}
+			existing = append(existing, diffIDs...)
+		}
+	}
+	stats, err := melt.StatsAgainst(args[0], existing)
+	if err != nil {
+		return err
+	}
+	printStats(os.Stdout, stats, existing != nil)
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/brauner/go-docker-melt/melt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+)
+
+// The version subcommand prints the version go-docker-melt was built from and
+// the features of the build, so bug reports and scripts can tell exactly
+// which behavior to expect.
+
+var versionCmd = &command{
+	name:    "version",
+	summary: "Print the version and the features of this build.",
+	usage:   "version [-json]",
+	flags:   flag.NewFlagSet("version", flag.ExitOnError),
+}
+
+// version is the released version, set with
+// -ldflags "-X main.version=v1.2.3". Without it the version of the main
+// module is used, which go install records.
+var version string
+
+var versionJSON bool
+
+func init() {
+	versionCmd.flags.BoolVar(&versionJSON, "json", false, "Print the version as JSON.")
+	versionCmd.run = runVersion
+	commands = append(commands, versionCmd)
+}
+
+// buildInfo is what the version subcommand prints.
+type buildInfo struct {
+	Version string `json:"version"`
+	// Commit, Time and Modified describe the VCS state the binary was
+	// built from, if the go command recorded it.
+	Commit    string        `json:"commit,omitempty"`
+	Time      string        `json:"time,omitempty"`
+	Modified  bool          `json:"modified,omitempty"`
+	GoVersion string        `json:"go_version"`
+	Platform  string        `json:"platform"`
+	Features  melt.Features `json:"features"`
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  melt.SupportedFeatures(),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		if info.Version == "" {
+			info.Version = "unknown"
+		}
+		return info
+	}
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+		case "vcs.time":
+			info.Time = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func runVersion(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("Usage: %s %s", os.Args[0], versionCmd.usage)
+	}
+	info := readBuildInfo()
+	if versionJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(info)
+	}
+
+	fmt.Printf("go-docker-melt %s\n", info.Version)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if info.Commit != "" {
+		commit := info.Commit
+		if info.Modified {
+			commit += " (modified)"
+		}
+		fmt.Fprintf(tw, "commit:\t%s\n", commit)
+	}
+	if info.Time != "" {
+		fmt.Fprintf(tw, "commit time:\t%s\n", info.Time)
+	}
+	fmt.Fprintf(tw, "go:\t%s %s\n", info.GoVersion, info.Platform)
+	backends := make([]string, len(info.Features.Backends))
+	for i, b := range info.Features.Backends {
+		backends[i] = string(b)
+	}
+	fmt.Fprintf(tw, "transports:\t%s\n", strings.Join(info.Features.Transports, ", "))
+	fmt.Fprintf(tw, "backends:\t%s\n", strings.Join(backends, ", "))
+	fmt.Fprintf(tw, "compression:\t%s\n", strings.Join(info.Features.Compression, ", "))
+	fmt.Fprintf(tw, "xattrs:\t%s\n", yesNo(info.Features.Xattrs))
+	fmt.Fprintf(tw, "sandbox:\t%s\n", yesNo(info.Features.Sandbox))
+	fmt.Fprintf(tw, "test-cmd:\t%s\n", yesNo(info.Features.TestCommand))
+	return tw.Flush()
+}